@@ -4,9 +4,15 @@ package config
 
 import (
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
@@ -16,8 +22,83 @@ type Config struct {
 	WhitelistedUUIDs []string `mapstructure:"WHITELISTED_UUIDS"`
 	BlacklistUUIDs   []string `mapstructure:"BLACKLISTED_UUIDS"`
 	WhitelistOn      bool     `mapstructure:"WHITELIST_ON"`
+	DB_TYPE          string   `mapstructure:"DB_TYPE"` // postgres, sqlite or memory
 	DB_DSN           string   `mapstructure:"DB_DSN"`
+	AutoMigrate      bool     `mapstructure:"AUTO_MIGRATE"` // otherwise we won't start until `migrate up` is run
+	Cluster          bool     `mapstructure:"CLUSTER"`      // share the database with other servers, needs postgres
 	KEY_PATH         string   `mapstructure:"KEY_PATH"`
+	AtRestKeyId      string   `mapstructure:"AT_REST_KEY_ID"` // encrypt queued messages with this key, "" is off
+	AtRestKeys       string   `mapstructure:"AT_REST_KEYS"`   // id:base64,id:base64, as well as the ones in KEY_PATH/at_rest
+	APNSHTTP2Port    int      `mapstructure:"APNS_HTTP2_PORT"`
+	APNSLegacyPort   int      `mapstructure:"APNS_LEGACY_PORT"`
+	APNSFeedbackPort int      `mapstructure:"APNS_FEEDBACK_PORT"`
+	QueueDepth       int      `mapstructure:"QUEUE_DEPTH"`
+
+	IdempotencyWindow      time.Duration `mapstructure:"IDEMPOTENCY_WINDOW"`
+	MessageStatusRetention time.Duration `mapstructure:"MESSAGE_STATUS_RETENTION"`
+	MaxScheduleAhead       time.Duration `mapstructure:"MAX_SCHEDULE_AHEAD"` // how far ahead deliver_at can be
+
+	// retention, each one is off at 0
+	RetentionInterval      time.Duration `mapstructure:"RETENTION_INTERVAL"`
+	TokenIdleRetention     time.Duration `mapstructure:"TOKEN_IDLE_RETENTION"`     // expire tokens nothing's been sent to or acked in this long
+	DeviceDormantRetention time.Duration `mapstructure:"DEVICE_DORMANT_RETENTION"` // expire the tokens of, then purge, devices not seen in this long
+	QueuedMessageRetention time.Duration `mapstructure:"QUEUED_MESSAGE_RETENTION"` // drop messages queued for longer than this
+
+	// broadcasts are queued this many tokens at a time, with a break in between
+	BroadcastBatchSize  int           `mapstructure:"BROADCAST_BATCH_SIZE"`
+	BroadcastBatchDelay time.Duration `mapstructure:"BROADCAST_BATCH_DELAY"`
+
+	// provider auth
+	RequireProviderAuth   bool             `mapstructure:"REQUIRE_PROVIDER_AUTH"`
+	AcceptRelayedMessages bool             `mapstructure:"ACCEPT_RELAYED_MESSAGES"`
+	Providers             []ProviderConfig `mapstructure:"PROVIDERS"`
+
+	// federation
+	RequireSignedFederation bool `mapstructure:"REQUIRE_SIGNED_FEDERATION"`
+	RelayWorkers            int  `mapstructure:"RELAY_WORKERS"`
+	RelayMaxAttempts        int  `mapstructure:"RELAY_MAX_ATTEMPTS"`
+	StatusCallbacks         bool `mapstructure:"STATUS_CALLBACKS"` // ask servers we relay to to tell us when it's delivered
+
+	// egress, for requests we make to other servers
+	FederationAllowHTTP       bool          `mapstructure:"FEDERATION_ALLOW_HTTP"`
+	FederationAllowedNetworks []string      `mapstructure:"FEDERATION_ALLOWED_NETWORKS"` // let these through even if they're private
+	FederationTimeout         time.Duration `mapstructure:"FEDERATION_TIMEOUT"`
+	FederationMaxResponseSize int64         `mapstructure:"FEDERATION_MAX_RESPONSE_SIZE"`
+
+	// per server rules, can be changed without restarting
+	PeerPolicies map[string]PeerPolicyConfig `mapstructure:"PEER_POLICIES"`
+
+	// discovery
+	StaticPeers               map[string]StaticPeerConfig `mapstructure:"STATIC_PEERS"`
+	DiscoveryCacheTTL         time.Duration               `mapstructure:"DISCOVERY_CACHE_TTL"`
+	DiscoveryNegativeCacheTTL time.Duration               `mapstructure:"DISCOVERY_NEGATIVE_CACHE_TTL"`
+}
+
+// StaticPeerConfig is the same as a _sgn TXT record
+type StaticPeerConfig struct {
+	TCPAddress  string `mapstructure:"TCP_ADDR"`
+	TCPPort     int    `mapstructure:"TCP_PORT"`
+	HTTPAddress string `mapstructure:"HTTP_ADDR"`
+}
+
+type PeerPolicyConfig struct {
+	Action         string  `mapstructure:"ACTION"`     // allow, deny or require_signed
+	RateLimit      float64 `mapstructure:"RATE_LIMIT"` // requests per second
+	Burst          int     `mapstructure:"BURST"`
+	MaxPayloadSize int     `mapstructure:"MAX_PAYLOAD_SIZE"`
+}
+
+type ProviderConfig struct {
+	Name      string   `mapstructure:"NAME"`
+	BundleIds []string `mapstructure:"BUNDLE_IDS"` // "*" for all of them
+
+	APIKeyHash string `mapstructure:"API_KEY_SHA256"`
+	CertHash   string `mapstructure:"CERT_SHA256"` // for the legacy APNS gateway
+
+	// ES256 JWTs, like APNS
+	KeyId         string `mapstructure:"KEY_ID"`
+	TeamId        string `mapstructure:"TEAM_ID"`
+	PublicKeyPath string `mapstructure:"PUBLIC_KEY_PATH"`
 }
 
 type CryptoKeys struct {
@@ -35,9 +116,55 @@ func LoadConfig() (config Config, err error) {
 
 	// work i stg
 	viper.BindEnv("KEY_PATH")
+	viper.BindEnv("AT_REST_KEY_ID")
+	viper.BindEnv("AT_REST_KEYS")
 	viper.BindEnv("SERVER_ADDRESS")
 	viper.BindEnv("TCP_PORT")
+	viper.BindEnv("DB_TYPE")
 	viper.BindEnv("DB_DSN")
+	viper.BindEnv("AUTO_MIGRATE")
+	viper.BindEnv("CLUSTER")
+	viper.BindEnv("APNS_HTTP2_PORT")
+	viper.BindEnv("APNS_LEGACY_PORT")
+	viper.BindEnv("APNS_FEEDBACK_PORT")
+	viper.BindEnv("QUEUE_DEPTH")
+	viper.BindEnv("IDEMPOTENCY_WINDOW")
+	viper.BindEnv("MESSAGE_STATUS_RETENTION")
+	viper.BindEnv("MAX_SCHEDULE_AHEAD")
+	viper.BindEnv("RETENTION_INTERVAL")
+	viper.BindEnv("TOKEN_IDLE_RETENTION")
+	viper.BindEnv("DEVICE_DORMANT_RETENTION")
+	viper.BindEnv("QUEUED_MESSAGE_RETENTION")
+	viper.BindEnv("BROADCAST_BATCH_SIZE")
+	viper.BindEnv("BROADCAST_BATCH_DELAY")
+
+	viper.BindEnv("REQUIRE_PROVIDER_AUTH")
+	viper.BindEnv("ACCEPT_RELAYED_MESSAGES")
+	viper.BindEnv("REQUIRE_SIGNED_FEDERATION")
+	viper.BindEnv("RELAY_WORKERS")
+	viper.BindEnv("RELAY_MAX_ATTEMPTS")
+	viper.BindEnv("STATUS_CALLBACKS")
+	viper.BindEnv("FEDERATION_ALLOW_HTTP")
+	viper.BindEnv("FEDERATION_TIMEOUT")
+	viper.BindEnv("FEDERATION_MAX_RESPONSE_SIZE")
+
+	viper.SetDefault("DB_TYPE", "postgres")
+	viper.SetDefault("AUTO_MIGRATE", true)
+	viper.SetDefault("QUEUE_DEPTH", 64)
+	viper.SetDefault("IDEMPOTENCY_WINDOW", "24h")
+	viper.SetDefault("MESSAGE_STATUS_RETENTION", "168h")
+	viper.SetDefault("MAX_SCHEDULE_AHEAD", "720h")
+	viper.SetDefault("RETENTION_INTERVAL", "1h")
+	viper.SetDefault("BROADCAST_BATCH_SIZE", 500)
+	viper.SetDefault("BROADCAST_BATCH_DELAY", "100ms")
+	viper.SetDefault("ACCEPT_RELAYED_MESSAGES", true)
+	viper.SetDefault("RELAY_WORKERS", 4)
+	viper.SetDefault("RELAY_MAX_ATTEMPTS", 12)
+	viper.SetDefault("STATUS_CALLBACKS", true)
+	viper.SetDefault("FEDERATION_TIMEOUT", "10s")
+	viper.SetDefault("FEDERATION_MAX_RESPONSE_SIZE", 64*1024)
+	viper.SetDefault("DISCOVERY_CACHE_TTL", "10m")
+	viper.SetDefault("DISCOVERY_NEGATIVE_CACHE_TTL", "1m")
 
 	viper.AutomaticEnv()
 	viper.ReadInConfig()
@@ -50,9 +177,28 @@ func LoadConfig() (config Config, err error) {
 		return config, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
+	// 0 or less would drop every notification as soon as it's queued
+	if config.QueueDepth < 1 {
+		return config, fmt.Errorf("QUEUE_DEPTH has to be at least 1, it's %d", config.QueueDepth)
+	}
+
 	return config, nil
 }
 
+// WatchConfig calls onChange with the new config whenever config.yaml is changed.
+// Most things still need a restart, it's up to onChange to pick out what can be changed live.
+func WatchConfig(onChange func(Config)) {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		var config Config
+		if err := viper.Unmarshal(&config); err != nil {
+			fmt.Printf("error unmarshaling changed config, keeping the old one: %v\n", err)
+			return
+		}
+		onChange(config)
+	})
+	viper.WatchConfig()
+}
+
 func LoadCryptoKeys(keyPath string) (keys *CryptoKeys, err error) {
 	cert, err := tls.LoadX509KeyPair(fmt.Sprintf("%s/server_public_key.pem", keyPath), fmt.Sprintf("%s/server_private_key.pem", keyPath))
 	if err != nil {
@@ -71,6 +217,49 @@ func LoadCryptoKeys(keyPath string) (keys *CryptoKeys, err error) {
 	}, nil
 }
 
+// LoadAtRestKeys loads the keys queued messages are encrypted at rest with, by id. They're 32 bytes, base64 encoded,
+// either in KEY_PATH/at_rest/<id>.key or in AT_REST_KEYS.
+func LoadAtRestKeys(_config Config) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+
+	dir := fmt.Sprintf("%s/at_rest", _config.KEY_PATH)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, isKey := strings.CutSuffix(entry.Name(), ".key")
+		if !isKey || entry.IsDir() {
+			continue
+		}
+		encoded, err := os.ReadFile(fmt.Sprintf("%s/%s", dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if keys[id], err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded))); err != nil {
+			return nil, fmt.Errorf("error decoding at rest key %s: %w", id, err)
+		}
+	}
+
+	for _, pair := range strings.Split(_config.AtRestKeys, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, errors.New("AT_REST_KEYS should look like id:base64,id:base64")
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("at rest key %s is in both KEY_PATH and AT_REST_KEYS", id)
+		}
+		if keys[id], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("error decoding at rest key %s: %w", id, err)
+		}
+	}
+
+	return keys, nil
+}
+
 func IsWhitelisted(uuid string, _config Config) bool {
 	for _, allowed := range _config.WhitelistedUUIDs {
 		if allowed == uuid {
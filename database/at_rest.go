@@ -0,0 +1,311 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Queued messages (and relay & broadcast bodies) can be encrypted at rest, so being able to read the database isn't
+// enough to read notifications. Each row gets it's own data key (AES-256-GCM) for it's payload, which is kept next to
+// it wrapped by a key encryption key. key_id says which one (NULL isn't encrypted), so rotating it only means
+// rewrapping data keys.
+
+var ErrUnknownAtRestKey = errors.New("queued message is encrypted with an at rest key we don't have")
+
+const atRestKeySize = 32
+
+type atRestKeyring struct {
+	current string            // what new messages are encrypted with, "" is not at all
+	keys    map[string][]byte // key encryption keys, by id
+}
+
+var atRest atRestKeyring
+
+// a store that can move it's rows to another at rest key, the memory store doesn't keep anything at rest
+type reencrypter interface {
+	ReencryptAtRest(cursor *ReencryptCursor, limit int) (moved int, done bool, err error)
+}
+
+// the tables with payloads that are encrypted at rest
+type atRestTable struct {
+	name      string
+	id        string   // it's primary key
+	columns   []string // the payload, only one of these is ever set
+	aadPrefix string   // goes in front of the id it's bound to, so a payload can't be moved to another table
+}
+
+var (
+	queuedMessagesAtRest = atRestTable{name: "queued_messages", id: "message_id", columns: []string{"data", "ciphertext"}}
+	relaysAtRest         = atRestTable{name: "outbound_relays", id: "message_id", columns: []string{"body"}, aadPrefix: "outbound_relays:"}
+	broadcastsAtRest     = atRestTable{name: "broadcasts", id: "broadcast_id", columns: []string{"body"}, aadPrefix: "broadcasts:"}
+
+	atRestTables = []atRestTable{queuedMessagesAtRest, relaysAtRest, broadcastsAtRest}
+)
+
+func (t atRestTable) aad(id string) string {
+	return t.aadPrefix + id
+}
+
+// UseAtRestKeys sets the key encryption keys (by id) queued messages, relays & broadcasts are encrypted with. New
+// ones are encrypted with current, or not at all if it's "". The others are only for reading what was stored before
+// a rotation, keep them until ReencryptAtRest has moved everything off of them.
+func UseAtRestKeys(keys map[string][]byte, current string) error {
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 32 {
+			return fmt.Errorf("at rest key id %q has to be 1 to 32 characters", id)
+		}
+		if len(key) != atRestKeySize {
+			return fmt.Errorf("at rest key %q has to be %d bytes, it's %d", id, atRestKeySize, len(key))
+		}
+	}
+	if _, ok := keys[current]; current != "" && !ok {
+		return fmt.Errorf("at rest key %q isn't loaded", current)
+	}
+	atRest = atRestKeyring{current: current, keys: keys}
+	return nil
+}
+
+// ReencryptCursor is how far through the tables a re-encryption pass has got. The zero value is the start.
+type ReencryptCursor struct {
+	table int
+	after string // the last id done in the table
+}
+
+// ReencryptAtRest moves up to limit rows after cursor that aren't under the current at rest key onto it (or decrypts
+// them, if at rest encryption has been turned off), moves the cursor past them, and gives back how many it did. done
+// is when it's been through every table. Rows under keys we don't have are left alone, and rows that can't be
+// decrypted are logged & skipped, so one bad row doesn't hold up the rest.
+func ReencryptAtRest(cursor *ReencryptCursor, limit int) (moved int, done bool, err error) {
+	if r, ok := store.(reencrypter); ok {
+		return r.ReencryptAtRest(cursor, limit)
+	}
+	return 0, true, nil
+}
+
+// seal encrypts a row's payload to be stored, with a new data key. It's given back as is if there's no current key.
+func (k atRestKeyring) seal(id string, payload []byte) (sealed []byte, keyId *string, wrappedKey []byte, err error) {
+	if k.current == "" {
+		return payload, nil, nil, nil
+	}
+	dataKey := make([]byte, atRestKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, nil, err
+	}
+	if sealed, err = sealGCM(dataKey, payload, id); err != nil {
+		return nil, nil, nil, err
+	}
+	if wrappedKey, err = sealGCM(k.keys[k.current], dataKey, id); err != nil {
+		return nil, nil, nil, err
+	}
+	keyId = &k.current
+	return sealed, keyId, wrappedKey, nil
+}
+
+// open decrypts a stored payload, keyId nil means it wasn't encrypted.
+func (k atRestKeyring) open(id string, payload []byte, keyId *string, wrappedKey []byte) ([]byte, error) {
+	if keyId == nil || payload == nil {
+		return payload, nil
+	}
+	dataKey, err := k.unwrap(id, *keyId, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(dataKey, payload, id)
+}
+
+func (k atRestKeyring) unwrap(id string, keyId string, wrappedKey []byte) ([]byte, error) {
+	kek, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w (%s, key %q)", ErrUnknownAtRestKey, id, keyId)
+	}
+	return openGCM(kek, wrappedKey, id)
+}
+
+// the keys rows can be moved off of, everything we have but the current one
+func (k atRestKeyring) oldKeyIds() []string {
+	var ids []string
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// sealGCM gives back the nonce followed by the ciphertext. The row's id is authenticated with it, so a payload
+// can't be moved to another row.
+func sealGCM(key []byte, plaintext []byte, id string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func openGCM(key []byte, sealed []byte, id string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted payload is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Claimed with SKIP LOCKED, so servers sharing a database don't do the same rows.
+func (s *sqlStore) ReencryptAtRest(cursor *ReencryptCursor, limit int) (int, bool, error) {
+	if cursor.table >= len(atRestTables) {
+		return 0, true, nil
+	}
+	t := atRestTables[cursor.table]
+
+	found, moved, err := s.reencryptTable(t, cursor, limit)
+	if err != nil {
+		return moved, false, err
+	}
+	if found < limit {
+		// on to the next table
+		*cursor = ReencryptCursor{table: cursor.table + 1}
+	}
+	return moved, cursor.table >= len(atRestTables), nil
+}
+
+func (s *sqlStore) reencryptTable(t atRestTable, cursor *ReencryptCursor, limit int) (found int, moved int, err error) {
+	args := []interface{}{}
+	var where string
+	if old := atRest.oldKeyIds(); len(old) > 0 {
+		where = "key_id IN (" + inList(&args, old) + ")"
+	}
+	if atRest.current != "" {
+		if where != "" {
+			where += " OR "
+		}
+		where += "key_id IS NULL"
+	}
+	if where == "" {
+		return 0, 0, nil
+	}
+	args = append(args, cursor.after, limit)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT `+t.id+`, `+strings.Join(t.columns, ", ")+`, key_id, wrapped_key
+		FROM `+t.name+`
+		WHERE (`+where+`) AND `+t.id+` > $`+fmt.Sprint(len(args)-1)+`
+		ORDER BY `+t.id+`
+		LIMIT $`+fmt.Sprint(len(args))+`
+		`+s.dialect.skipLocked,
+		args...,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	type row struct {
+		id         string
+		payloads   [][]byte
+		keyId      *string
+		wrappedKey []byte
+	}
+	var rowsFound []row
+	for rows.Next() {
+		r := row{payloads: make([][]byte, len(t.columns))}
+		dest := []interface{}{&r.id}
+		for i := range r.payloads {
+			dest = append(dest, &r.payloads[i])
+		}
+		dest = append(dest, &r.keyId, &r.wrappedKey)
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		rowsFound = append(rowsFound, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, r := range rowsFound {
+		cursor.after = r.id
+		aad := t.aad(r.id)
+
+		if r.keyId != nil && atRest.current != "" {
+			// only the data key has to change keys
+			dataKey, err := atRest.unwrap(aad, *r.keyId, r.wrappedKey)
+			if err != nil {
+				log.Printf("skipping %s %s, it's data key can't be unwrapped: %v\n", t.name, r.id, err)
+				continue
+			}
+			wrappedKey, err := sealGCM(atRest.keys[atRest.current], dataKey, aad)
+			if err != nil {
+				return len(rowsFound), moved, err
+			}
+			if _, err := tx.Exec("UPDATE "+t.name+" SET key_id = $1, wrapped_key = $2 WHERE "+t.id+" = $3", atRest.current, wrappedKey, r.id); err != nil {
+				return len(rowsFound), moved, err
+			}
+			moved++
+			continue
+		}
+
+		// going from not encrypted to encrypted, or back
+		var keyId *string
+		var wrappedKey []byte
+		ok := true
+		for i, payload := range r.payloads {
+			if payload == nil {
+				continue
+			}
+			opened, err := atRest.open(aad, payload, r.keyId, r.wrappedKey)
+			if err != nil {
+				log.Printf("skipping %s %s, it can't be decrypted: %v\n", t.name, r.id, err)
+				ok = false
+				break
+			}
+			if r.payloads[i], keyId, wrappedKey, err = atRest.seal(aad, opened); err != nil {
+				return len(rowsFound), moved, err
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		args := []interface{}{}
+		set := make([]string, len(t.columns))
+		for i, column := range t.columns {
+			args = append(args, r.payloads[i])
+			set[i] = fmt.Sprintf("%s = $%d", column, len(args))
+		}
+		args = append(args, keyId, wrappedKey, r.id)
+		if _, err := tx.Exec("UPDATE "+t.name+" SET "+strings.Join(set, ", ")+fmt.Sprintf(", key_id = $%d, wrapped_key = $%d WHERE %s = $%d", len(args)-2, len(args)-1, t.id, len(args)), args...); err != nil {
+			return len(rowsFound), moved, err
+		}
+		moved++
+	}
+
+	return len(rowsFound), moved, tx.Commit()
+}
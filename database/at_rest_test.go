@@ -0,0 +1,257 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testAtRestKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, atRestKeySize)
+}
+
+// useTestAtRestKeys sets the at rest keys for a test, and turns it back off after.
+func useTestAtRestKeys(t *testing.T, keys map[string][]byte, current string) {
+	t.Helper()
+	if err := UseAtRestKeys(keys, current); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { UseAtRestKeys(nil, "") })
+}
+
+func TestUseAtRestKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    map[string][]byte
+		current string
+		wantErr bool
+	}{
+		{name: "off", keys: nil, current: ""},
+		{name: "one key", keys: map[string][]byte{"a": testAtRestKey(1)}, current: "a"},
+		{name: "only old keys", keys: map[string][]byte{"a": testAtRestKey(1)}, current: ""},
+		{name: "current isn't loaded", keys: map[string][]byte{"a": testAtRestKey(1)}, current: "b", wantErr: true},
+		{name: "short key", keys: map[string][]byte{"a": testAtRestKey(1)[:16]}, current: "a", wantErr: true},
+		{name: "empty id", keys: map[string][]byte{"": testAtRestKey(1)}, current: "", wantErr: true},
+		{name: "long id", keys: map[string][]byte{string(bytes.Repeat([]byte("a"), 33)): testAtRestKey(1)}, current: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { UseAtRestKeys(nil, "") })
+			if err := UseAtRestKeys(tt.keys, tt.current); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	payload := []byte(`{"aps":{"alert":"hi"}}`)
+	a := atRestKeyring{current: "a", keys: map[string][]byte{"a": testAtRestKey(1)}}
+	b := atRestKeyring{current: "b", keys: map[string][]byte{"b": testAtRestKey(2)}}
+	off := atRestKeyring{}
+
+	sealed, keyId, wrappedKey, err := a.seal("message", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyId == nil || *keyId != "a" || bytes.Contains(sealed, payload) {
+		t.Fatalf("payload wasn't sealed with a (key %v)", keyId)
+	}
+
+	tests := []struct {
+		name    string
+		keyring atRestKeyring
+		id      string
+		payload []byte
+		wantErr error
+		anyErr  bool // neither is it opens to payload
+	}{
+		{name: "same row", keyring: a, id: "message", payload: sealed},
+		{name: "another row", keyring: a, id: "another message", payload: sealed, anyErr: true},
+		{name: "moved to another table", keyring: a, id: relaysAtRest.aad("message"), payload: sealed, anyErr: true},
+		{name: "key we don't have", keyring: b, id: "message", payload: sealed, wantErr: ErrUnknownAtRestKey},
+		{name: "tampered with", keyring: a, id: "message", payload: append(bytes.Clone(sealed[:len(sealed)-1]), sealed[len(sealed)-1]^1), anyErr: true},
+		{name: "too short", keyring: a, id: "message", payload: []byte{1, 2, 3}, anyErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := tt.keyring.open(tt.id, tt.payload, keyId, wrappedKey)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got %v, want %v", err, tt.wantErr)
+				}
+			case tt.anyErr:
+				if err == nil {
+					t.Error("opened it")
+				}
+			case err != nil:
+				t.Error(err)
+			case !bytes.Equal(opened, payload):
+				t.Errorf("opened to %q", opened)
+			}
+		})
+	}
+
+	t.Run("off", func(t *testing.T) {
+		stored, keyId, wrappedKey, err := off.seal("message", payload)
+		if err != nil || keyId != nil || wrappedKey != nil || !bytes.Equal(stored, payload) {
+			t.Fatalf("sealed it with no key (key %v, %v)", keyId, err)
+		}
+		opened, err := a.open("message", stored, nil, nil)
+		if err != nil || !bytes.Equal(opened, payload) {
+			t.Errorf("opened to %q, %v", opened, err)
+		}
+	})
+}
+
+func TestAtRestAADPrefixes(t *testing.T) {
+	seen := map[string]string{}
+	for _, table := range atRestTables {
+		aad := table.aad("id")
+		if other, ok := seen[aad]; ok {
+			t.Errorf("%s and %s bind their payloads to the same thing, they could be swapped", table.name, other)
+		}
+		seen[aad] = table.name
+	}
+}
+
+func TestReencryptAtRest(t *testing.T) {
+	ciphertext := []byte("ciphertext")
+	dataType := "json"
+	iv := []byte("iv")
+
+	tests := []struct {
+		name string
+		// the keys it's stored with, then rotated to
+		before string
+		after  string
+	}{
+		{name: "turned on", before: "", after: "b"},
+		{name: "rotated", before: "a", after: "b"},
+		{name: "turned off", before: "a", after: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the memory store doesn't keep anything at rest, so this is only sqlite
+			s := newTestSQLiteStore(t)
+			keys := map[string][]byte{"a": testAtRestKey(1), "b": testAtRestKey(2)}
+			useTestAtRestKeys(t, keys, tt.before)
+
+			now := time.Now()
+			err := s.QueueMessages([]QueuedMessage{
+				{MessageId: "data", CreatedAt: now, Data: map[string]interface{}{"aps": map[string]interface{}{"alert": "hi"}}, RoutingKey: []byte("routing key"), DeviceAddress: "device"},
+				{MessageId: "encrypted", CreatedAt: now, IsEncrypted: true, Ciphertext: &ciphertext, DataType: &dataType, IV: &iv, RoutingKey: []byte("routing key"), DeviceAddress: "device"},
+			}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.QueueRelays([]OutboundRelay{{MessageId: "relay", Destination: "other.example.com", Body: []byte(`{"relay":true}`), NextAttemptAt: now, CreatedAt: now}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.CreateBroadcast(Broadcast{BroadcastId: "broadcast", BundleId: "com.example.app", Body: []byte(`{"broadcast":true}`), CreatedAt: now}); err != nil {
+				t.Fatal(err)
+			}
+
+			useTestAtRestKeys(t, keys, tt.after)
+			var cursor ReencryptCursor
+			moved := 0
+			for done := false; !done; {
+				var n int
+				n, done, err = s.ReencryptAtRest(&cursor, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				moved += n
+			}
+			if moved != 4 {
+				t.Errorf("moved %d rows, want 4", moved)
+			}
+
+			// only the key it's on now is needed to read everything back
+			current := map[string][]byte{}
+			if tt.after != "" {
+				current[tt.after] = keys[tt.after]
+			}
+			useTestAtRestKeys(t, current, tt.after)
+
+			data, err := s.GetQueuedMessage("data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if aps, _ := data.Data["aps"].(map[string]interface{}); aps["alert"] != "hi" {
+				t.Errorf("data is %v", data.Data)
+			}
+			encrypted, err := s.GetQueuedMessage("encrypted")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(*encrypted.Ciphertext, ciphertext) {
+				t.Errorf("ciphertext is %q", *encrypted.Ciphertext)
+			}
+			relay, err := s.GetRelay("relay")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(relay.Body) != `{"relay":true}` {
+				t.Errorf("relay body is %q", relay.Body)
+			}
+			broadcast, err := s.GetBroadcast("broadcast")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(broadcast.Body) != `{"broadcast":true}` {
+				t.Errorf("broadcast body is %q", broadcast.Body)
+			}
+
+			// a second pass has nothing left to do
+			cursor = ReencryptCursor{}
+			for done := false; !done; {
+				var n int
+				n, done, err = s.ReencryptAtRest(&cursor, 10)
+				if err != nil || n != 0 {
+					t.Fatalf("second pass moved %d rows, %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReencryptAtRestSkipsUnreadableRows(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	keys := map[string][]byte{"a": testAtRestKey(1), "b": testAtRestKey(2)}
+	useTestAtRestKeys(t, keys, "a")
+
+	now := time.Now()
+	for _, id := range []string{"bad", "good"} {
+		if err := s.QueueMessages([]QueuedMessage{{MessageId: id, CreatedAt: now, Data: map[string]interface{}{"id": id}, RoutingKey: []byte(id), DeviceAddress: "device"}}, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.db.Exec("UPDATE queued_messages SET wrapped_key = $1 WHERE message_id = 'bad'", []byte("not a wrapped key")); err != nil {
+		t.Fatal(err)
+	}
+
+	useTestAtRestKeys(t, keys, "b")
+	var cursor ReencryptCursor
+	moved := 0
+	for done := false; !done; {
+		n, d, err := s.ReencryptAtRest(&cursor, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		moved, done = moved+n, d
+	}
+	if moved != 1 {
+		t.Errorf("moved %d rows, want 1", moved)
+	}
+
+	var keyId string
+	if err := s.db.QueryRow("SELECT key_id FROM queued_messages WHERE message_id = 'good'").Scan(&keyId); err != nil || keyId != "b" {
+		t.Errorf("good message is on key %q, %v", keyId, err)
+	}
+}
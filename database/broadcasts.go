@@ -0,0 +1,201 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	BroadcastStatusRunning = "running"
+	BroadcastStatusDone    = "done"
+	BroadcastStatusExpired = "expired" // the notification expired before we got to every token
+	BroadcastStatusFailed  = "failed"
+)
+
+type Broadcast struct {
+	BroadcastId string
+	Sender      string
+	BundleId    string
+	Body        []byte
+	Status      string
+	Cursor      []byte
+	TotalTokens int
+	Queued      int
+	Skipped     int
+	Failed      int
+	LastError   *string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+}
+
+// how far a broadcast got with a batch
+type BroadcastProgress struct {
+	Cursor  []byte
+	Queued  int
+	Skipped int
+	Failed  int
+}
+
+const broadcastColumns = "broadcast_id, sender, bundle_id, body, status, cursor, total_tokens, queued, skipped, failed, last_error, created_at, updated_at, finished_at, key_id, wrapped_key"
+
+// broadcastUnreadableError is for a broadcast who's body can't be decrypted, the broadcast is given back with it (without
+// the body)
+type broadcastUnreadableError struct {
+	err error
+}
+
+func (e *broadcastUnreadableError) Error() string {
+	return "broadcast can't be decrypted: " + e.err.Error()
+}
+
+func (e *broadcastUnreadableError) Unwrap() error {
+	return e.err
+}
+
+func scanBroadcast(row interface{ Scan(...interface{}) error }) (*Broadcast, error) {
+	var b Broadcast
+	var keyId *string
+	var wrappedKey []byte
+	if err := row.Scan(&b.BroadcastId, &b.Sender, &b.BundleId, &b.Body, &b.Status, &b.Cursor, &b.TotalTokens, &b.Queued, &b.Skipped, &b.Failed, &b.LastError, &b.CreatedAt, &b.UpdatedAt, &b.FinishedAt, &keyId, &wrappedKey); err != nil {
+		return nil, err
+	}
+	body, err := atRest.open(broadcastsAtRest.aad(b.BroadcastId), b.Body, keyId, wrappedKey)
+	if err != nil {
+		b.Body = nil
+		return &b, &broadcastUnreadableError{err}
+	}
+	b.Body = body
+	return &b, nil
+}
+
+func (s *sqlStore) CreateBroadcast(b Broadcast) (*Broadcast, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM notification_tokens WHERE bundle_id = $1 AND is_valid", b.BundleId).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	body, keyId, wrappedKey, err := atRest.seal(broadcastsAtRest.aad(b.BroadcastId), b.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	row := s.db.QueryRow("INSERT INTO broadcasts (broadcast_id, sender, bundle_id, body, status, total_tokens, created_at, updated_at, key_id, wrapped_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, $9) RETURNING "+broadcastColumns,
+		b.BroadcastId, b.Sender, b.BundleId, body, BroadcastStatusRunning, total, now, keyId, wrappedKey,
+	)
+	return scanBroadcast(row)
+}
+
+func (s *sqlStore) GetBroadcast(broadcastId string) (*Broadcast, error) {
+	return scanBroadcast(s.db.QueryRow("SELECT "+broadcastColumns+" FROM broadcasts WHERE broadcast_id = $1", broadcastId))
+}
+
+func (s *sqlStore) ClaimBroadcast(lease time.Duration) (*Broadcast, error) {
+	now := time.Now()
+	row := s.db.QueryRow(`
+		UPDATE broadcasts SET lease_until = $1
+		WHERE broadcast_id = (
+			SELECT broadcast_id FROM broadcasts
+			WHERE status = $2 AND (lease_until IS NULL OR lease_until <= $3)
+			ORDER BY created_at
+			LIMIT 1
+			`+s.dialect.skipLocked+`
+		)
+		RETURNING `+broadcastColumns,
+		now.Add(lease), BroadcastStatusRunning, now,
+	)
+	b, err := scanBroadcast(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	var unreadable *broadcastUnreadableError
+	if errors.As(err, &unreadable) {
+		// there's nothing to send, so it's failed instead of being claimed again forever
+		lastError := unreadable.Error()
+		if finishErr := s.FinishBroadcast(b.BroadcastId, BroadcastStatusFailed, &lastError); finishErr != nil {
+			return nil, finishErr
+		}
+		return nil, err
+	}
+	return b, err
+}
+
+// Going by routing token means it's a quick index scan each time, and we never hold anything open between batches.
+func (s *sqlStore) GetBroadcastTokens(bundleId string, cursor []byte, limit int) ([]NotificationToken, error) {
+	if cursor == nil {
+		cursor = []byte{}
+	}
+	rows, err := s.db.Query(`
+		SELECT routing_token, device_address, allowed_notification_types
+		FROM notification_tokens
+		WHERE bundle_id = $1 AND is_valid AND routing_token > $2
+		ORDER BY routing_token
+		LIMIT $3`,
+		bundleId, cursor, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []NotificationToken
+	for rows.Next() {
+		token := NotificationToken{AppBundleId: bundleId, IsValid: true}
+		if err := rows.Scan(&token.RoutingToken, &token.DeviceAddress, &token.NotificationType); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *sqlStore) QueueBroadcastBatch(broadcastId string, messages []QueuedMessage, queueDepth int, progress BroadcastProgress, lease time.Duration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range messages {
+		if err := s.queueMessage(tx, m, queueDepth); err != nil {
+			return err
+		}
+	}
+	if err := updateBroadcastProgress(tx, broadcastId, progress, lease); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) UpdateBroadcastProgress(broadcastId string, progress BroadcastProgress, lease time.Duration) error {
+	return updateBroadcastProgress(s.db, broadcastId, progress, lease)
+}
+
+func updateBroadcastProgress(q queryer, broadcastId string, progress BroadcastProgress, lease time.Duration) error {
+	now := time.Now()
+	_, err := q.Exec("UPDATE broadcasts SET cursor = $2, queued = queued + $3, skipped = skipped + $4, failed = failed + $5, lease_until = $6, updated_at = $7 WHERE broadcast_id = $1",
+		broadcastId, progress.Cursor, progress.Queued, progress.Skipped, progress.Failed, now.Add(lease), now,
+	)
+	return err
+}
+
+func (s *sqlStore) FinishBroadcast(broadcastId string, status string, lastError *string) error {
+	now := time.Now()
+	_, err := s.db.Exec("UPDATE broadcasts SET status = $2, last_error = $3, lease_until = NULL, updated_at = $4, finished_at = $4 WHERE broadcast_id = $1",
+		broadcastId, status, lastError, now,
+	)
+	return err
+}
+
+func (s *sqlStore) PurgeOldBroadcasts(olderThan time.Duration) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM broadcasts WHERE status != $1 AND finished_at <= $2", BroadcastStatusRunning, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
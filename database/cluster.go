@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrNotifyUnsupported = errors.New("only postgres can pass messages between servers, DB_TYPE has to be postgres to run a cluster")
+
+// how long to wait before listening again, after losing the connection
+const listenRetryDelay = 5 * time.Second
+
+// Which server each device is connected to, when there's a few of them sharing a database.
+type ClusterStore interface {
+	HeartbeatInstance(instanceId string) error
+	PurgeDeadInstances(olderThan time.Duration) (int64, error)
+	SetConnectionOwner(deviceAddress string, instanceId string, connectedAt time.Time) (previous *string, err error)
+	RemoveConnectionOwner(deviceAddress string, instanceId string) error
+	GetConnectionOwner(deviceAddress string) (string, error)
+}
+
+// a store that can pass messages between servers, only postgres can
+type notifier interface {
+	Notify(channel string, payload string) error
+	Listen(channel string, handle func(payload string)) error
+}
+
+// HeartbeatInstance says we're still around. It has to be called before we own any connections.
+func HeartbeatInstance(instanceId string) error {
+	return store.HeartbeatInstance(instanceId)
+}
+
+// PurgeDeadInstances forgets about servers that haven't checked in for a while, and the connections they had.
+func PurgeDeadInstances(olderThan time.Duration) (int64, error) {
+	return store.PurgeDeadInstances(olderThan)
+}
+
+// SetConnectionOwner records that a device is connected to instanceId. previous is the server it was connected to
+// before, if it was a different one.
+func SetConnectionOwner(deviceAddress string, instanceId string, connectedAt time.Time) (previous *string, err error) {
+	return store.SetConnectionOwner(deviceAddress, instanceId, connectedAt)
+}
+
+// RemoveConnectionOwner forgets a device's connection, if it's still with instanceId.
+func RemoveConnectionOwner(deviceAddress string, instanceId string) error {
+	return store.RemoveConnectionOwner(deviceAddress, instanceId)
+}
+
+// GetConnectionOwner gets the server a device is connected to, sql.ErrNoRows if it isn't connected to any.
+func GetConnectionOwner(deviceAddress string) (string, error) {
+	return store.GetConnectionOwner(deviceAddress)
+}
+
+// Notify sends payload to whoever's listening on channel.
+func Notify(channel string, payload string) error {
+	if n, ok := store.(notifier); ok {
+		return n.Notify(channel, payload)
+	}
+	return ErrNotifyUnsupported
+}
+
+// Listen calls handle with everything sent to channel, until we stop. If the connection drops it listens again,
+// anything sent in between is missed.
+func Listen(channel string, handle func(payload string)) error {
+	if n, ok := store.(notifier); ok {
+		return n.Listen(channel, handle)
+	}
+	return ErrNotifyUnsupported
+}
+
+func (s *sqlStore) HeartbeatInstance(instanceId string) error {
+	_, err := s.db.Exec("INSERT INTO cluster_instances (instance_id, last_seen) VALUES ($1, $2) ON CONFLICT (instance_id) DO UPDATE SET last_seen = excluded.last_seen",
+		instanceId, time.Now(),
+	)
+	return err
+}
+
+func (s *sqlStore) PurgeDeadInstances(olderThan time.Duration) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM cluster_instances WHERE last_seen <= $1", time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) SetConnectionOwner(deviceAddress string, instanceId string, connectedAt time.Time) (*string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous *string
+	if err := tx.QueryRow("SELECT instance_id FROM connection_owners WHERE device_address = $1", deviceAddress).Scan(&previous); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO connection_owners (device_address, instance_id, connected_at) VALUES ($1, $2, $3) ON CONFLICT (device_address) DO UPDATE SET instance_id = excluded.instance_id, connected_at = excluded.connected_at",
+		deviceAddress, instanceId, connectedAt,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if previous != nil && *previous == instanceId {
+		previous = nil
+	}
+	return previous, nil
+}
+
+func (s *sqlStore) RemoveConnectionOwner(deviceAddress string, instanceId string) error {
+	_, err := s.db.Exec("DELETE FROM connection_owners WHERE device_address = $1 AND instance_id = $2", deviceAddress, instanceId)
+	return err
+}
+
+func (s *sqlStore) GetConnectionOwner(deviceAddress string) (string, error) {
+	var instanceId string
+	err := s.db.QueryRow("SELECT instance_id FROM connection_owners WHERE device_address = $1", deviceAddress).Scan(&instanceId)
+	return instanceId, err
+}
+
+func (s *sqlStore) Notify(channel string, payload string) error {
+	if !s.dialect.notify {
+		return ErrNotifyUnsupported
+	}
+	_, err := s.db.Exec("SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
+
+// Listen gets it's own connection, LISTEN holds onto it.
+func (s *sqlStore) Listen(channel string, handle func(payload string)) error {
+	if !s.dialect.notify {
+		return ErrNotifyUnsupported
+	}
+	conn, err := s.listen(channel)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			notification, err := conn.WaitForNotification(context.Background())
+			if err == nil {
+				handle(notification.Payload)
+				continue
+			}
+
+			log.Printf("lost the connection listening on %s, listening again: %v\n", channel, err)
+			conn.Close(context.Background())
+			for {
+				time.Sleep(listenRetryDelay)
+				if conn, err = s.listen(channel); err == nil {
+					break
+				}
+				log.Printf("failed to listen on %s: %v\n", channel, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *sqlStore) listen(channel string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(context.Background(), s.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(context.Background(), "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
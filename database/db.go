@@ -4,24 +4,21 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"database/sql"
-	_ "embed"
 	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"howett.net/plist"
+	_ "modernc.org/sqlite"
 )
 
-//go:embed init.sql
-var initDbSQL string
-
-var db *sql.DB
-
 type QueuedMessage struct {
-	MessageId string
-	CreatedAt time.Time
+	MessageId  string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time // nil never expires
+	CollapseId *string
+	DeliverAt  *time.Time // nil is right away, otherwise it's held back until then
 
 	// mostly copied from DataToSend
 	IsEncrypted bool `json:"is_encrypted,omitempty" plist:"is_encrypted"`
@@ -37,13 +34,25 @@ type QueuedMessage struct {
 	// Routing info
 	RoutingKey    []byte `json:"-" plist:"routing_key"`
 	DeviceAddress string `json:"-" plist:"-"`
+
+	// for the message's status, not kept with the message
+	Sender           string  `json:"-" plist:"-"`
+	StatusCallbackTo *string `json:"-" plist:"-"`
+}
+
+// DroppedMessage is a message that was dropped without ever being queued, like a deliver once message for a device
+// that isn't connected. It only gets a status.
+type DroppedMessage struct {
+	MessageId string
+	Sender    string
+	Reason    string
 }
 
 type NotificationToken struct {
 	RoutingToken            []byte
 	DeviceAddress           string
 	FeedbackProviderAddress *string
-	NotificationType        int    // Notifcation types, I'm not sure of the order yet but None, Badge, Sound, Alert
+	NotificationType        int    // Bitmask of NotificationTypeBadge, NotificationTypeSound & NotificationTypeAlert
 	AppBundleId             string // example: com.atebits.tweetie2
 	IssuedAt                time.Time
 	IsValid                 bool // Unsure if this should be kept
@@ -51,10 +60,18 @@ type NotificationToken struct {
 	LastUsed                *time.Time
 }
 
+// Same as UIRemoteNotificationType on the device
+const (
+	NotificationTypeBadge = 1 << 0
+	NotificationTypeSound = 1 << 1
+	NotificationTypeAlert = 1 << 2
+)
+
 type Device struct {
 	DeviceAddress string
 	PublicKey     *rsa.PublicKey
 	Language      string
+	LastSeen      *time.Time // when it last logged in or acked something
 }
 
 type FeedbackToSend struct {
@@ -64,96 +81,238 @@ type FeedbackToSend struct {
 	Type          int
 	Reason        string
 	CreatedAt     time.Time
+
+	LegacyDeliveredAt *time.Time // when the legacy APNS feedback service gave it to the provider
 }
 
-func ResetDatabase() error {
-	_, err := db.Exec(initDbSQL)
-	return err
+type dialect struct {
+	driverName   string
+	migrations   string // the folder in migrations/
+	maxOpenConns int    // 0 is no limit
+	skipLocked   string // locks the rows being claimed, so servers sharing a database don't both take them
+	limitAll     string // a LIMIT that doesn't limit, for OFFSET on it's own
+
+	lockMigrations string // so only one server migrates at a time, held until the transaction ends
+	tableExists    string // gives back if the table $1 exists
+	notify         bool   // has LISTEN/NOTIFY, for clusters
+}
+
+var postgresDialect = dialect{
+	driverName: "pgx",
+	migrations: "postgres",
+	skipLocked: "FOR UPDATE SKIP LOCKED",
+	limitAll:   "LIMIT ALL",
+
+	lockMigrations: "SELECT pg_advisory_xact_lock(7373)",
+	tableExists:    "SELECT to_regclass($1) IS NOT NULL",
+	notify:         true,
 }
 
-func InitDB(dsn string) {
-	// Initialize the database connection
-	var err error
-	db, err = sql.Open("pgx", dsn)
+// sqlite only gets one connection, so there's never anyone else claiming rows at the same time.
+// Transactions lock the whole file as soon as they start (see sqliteDSN), so migrations don't need their own lock.
+var sqliteDialect = dialect{
+	driverName:   "sqlite",
+	migrations:   "sqlite",
+	maxOpenConns: 1,
+	limitAll:     "LIMIT -1",
 
+	tableExists: "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = $1",
+}
+
+// sqlStore keeps everything in postgres or sqlite. The queries are written so they work on both.
+type sqlStore struct {
+	db      *sql.DB
+	dsn     string
+	dialect dialect
+}
+
+func openSQLStore(d dialect, dsn string) (*sqlStore, error) {
+	conn, err := sql.Open(d.driverName, dsn)
 	if err != nil {
-		log.Fatal(err)
-		panic(err)
+		return nil, err
 	}
+	conn.SetMaxOpenConns(d.maxOpenConns)
+
+	if err := conn.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &sqlStore{db: conn, dsn: dsn, dialect: d}, nil
+}
 
-	pingErr := db.Ping()
-	if pingErr != nil {
-		log.Fatal(pingErr)
-		panic(pingErr)
+// sqliteDSN turns a path into a dsn with what we need set. Times are kept in UTC, in a format that sorts properly
+// as text, as that's how sqlite compares them. Transactions are immediate, so two processes on the same file
+// (like migrate & the server) wait for each other instead of failing half way through.
+func sqliteDSN(path string) string {
+	if path == "" {
+		path = "sgn.db"
 	}
+	return "file:" + path + "?_time_format=sqlite&_timezone=UTC&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
 
-	err = ResetDatabase()
+func (s *sqlStore) AckMessage(message_id string, device_uuid string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// the device has been seen, and the token it was for is still being used
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE notification_tokens SET last_used = $1 WHERE routing_token = (SELECT routing_key FROM queued_messages WHERE message_id = $2 AND device_address = $3)", now, message_id, device_uuid); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE devices SET last_seen = $1 WHERE device_address = $2", now, device_uuid); err != nil {
+		return err
+	}
+
+	acked, err := deleteReturningIds(tx, "DELETE FROM queued_messages WHERE message_id = $1 AND device_address = $2 RETURNING message_id", message_id, device_uuid)
+	if err != nil {
+		return err
+	}
+	if err := setMessageStatus(tx, MessageStatusAcked, nil, acked...); err != nil {
+		return err
 	}
+	return tx.Commit()
 }
 
-func AckMessage(message_id string, device_uuid string) error {
-	_, err := db.Exec("DELETE FROM queued_messages WHERE message_id = $1 AND device_address = $2", message_id, device_uuid)
-	return err
+func (s *sqlStore) QueueMessages(messages []QueuedMessage, queueDepth int) error {
+	return s.QueueAndDropMessages(messages, nil, queueDepth)
 }
 
-func QueueEncryptedMessage(m QueuedMessage) error {
-	db.Exec("DELETE FROM queued_messages WHERE routing_key = $1", m.RoutingKey) // clean out old msgs.
-	_, err := db.Exec("INSERT INTO queued_messages (message_id, created_at, is_encrypted, ciphertext, data_type, iv, device_address, routing_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		m.MessageId, m.CreatedAt, true, *m.Ciphertext, *m.DataType, *m.IV, m.DeviceAddress, m.RoutingKey,
-	)
+func (s *sqlStore) QueueAndDropMessages(messages []QueuedMessage, dropped []DroppedMessage, queueDepth int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	return err
+	for _, m := range messages {
+		if err := s.queueMessage(tx, m, queueDepth); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, d := range dropped {
+		if err := dropUnqueuedMessage(tx, d, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-func QueueUnencryptedMessage(m QueuedMessage) error {
-	out, err := plist.Marshal(m.Data, plist.BinaryFormat)
-	if err != nil {
+func (s *sqlStore) queueMessage(tx *sql.Tx, m QueuedMessage, queueDepth int) error {
+	// a collapse id replaces whatever was queued with the same one
+	if m.CollapseId != nil {
+		replaced, err := deleteReturningIds(tx, "DELETE FROM queued_messages WHERE routing_key = $1 AND collapse_id = $2 RETURNING message_id", m.RoutingKey, *m.CollapseId)
+		if err != nil {
+			return err
+		}
+		reason := "replaced by a newer notification with the same collapse id"
+		if err := setMessageStatus(tx, MessageStatusDropped, &reason, replaced...); err != nil {
+			return err
+		}
+	}
+
+	status := MessageStatusQueued
+	if m.DeliverAt != nil {
+		// scheduled messages aren't pushed out of a full queue, so they get their own limit
+		var scheduled int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM queued_messages WHERE routing_key = $1 AND deliver_at IS NOT NULL", m.RoutingKey).Scan(&scheduled); err != nil {
+			return err
+		}
+		if scheduled >= queueDepth {
+			return ErrScheduleFull
+		}
+		status = MessageStatusScheduled
+	}
+
+	// either way it's encrypted at rest, if that's on
+	if m.IsEncrypted {
+		ciphertext, keyId, wrappedKey, err := atRest.seal(m.MessageId, *m.Ciphertext)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO queued_messages (message_id, created_at, expires_at, collapse_id, deliver_at, is_encrypted, ciphertext, data_type, iv, device_address, routing_key, key_id, wrapped_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT (message_id) DO NOTHING",
+			m.MessageId, m.CreatedAt, m.ExpiresAt, m.CollapseId, m.DeliverAt, true, ciphertext, *m.DataType, *m.IV, m.DeviceAddress, m.RoutingKey, keyId, wrappedKey,
+		)
+		if err != nil {
+			return err
+		}
+	} else {
+		out, err := plist.Marshal(m.Data, plist.BinaryFormat)
+		if err != nil {
+			return err
+		}
+		data, keyId, wrappedKey, err := atRest.seal(m.MessageId, out)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO queued_messages (message_id, created_at, expires_at, collapse_id, deliver_at, is_encrypted, data, device_address, routing_key, key_id, wrapped_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (message_id) DO NOTHING",
+			m.MessageId, m.CreatedAt, m.ExpiresAt, m.CollapseId, m.DeliverAt, false, data, m.DeviceAddress, m.RoutingKey, keyId, wrappedKey,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := createMessageStatus(tx, m.MessageId, m.Sender, m.StatusCallbackTo, status, m.CreatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE notification_tokens SET last_used = $1 WHERE routing_token = $2", time.Now(), m.RoutingKey); err != nil {
 		return err
 	}
 
-	db.Exec("DELETE FROM queued_messages WHERE routing_key = $1", m.RoutingKey) // clean out old msgs.
-	_, err = db.Exec("INSERT INTO queued_messages (message_id, created_at, is_encrypted, data, device_address, routing_key) VALUES ($1, $2, $3, $4, $5, $6)",
-		m.MessageId, m.CreatedAt, false, out, m.DeviceAddress, m.RoutingKey,
+	// keep the queue bounded
+	pushedOut, err := deleteReturningIds(tx, `
+		DELETE FROM queued_messages WHERE message_id IN (
+			SELECT message_id FROM queued_messages
+			WHERE routing_key = $1 AND deliver_at IS NULL
+			ORDER BY created_at DESC, message_id DESC
+			`+s.dialect.limitAll+` OFFSET $2
+		) RETURNING message_id`, m.RoutingKey, queueDepth,
 	)
-
-	return err
+	if err != nil {
+		return err
+	}
+	reason := "the device's queue was full"
+	return setMessageStatus(tx, MessageStatusDropped, &reason, pushedOut...)
 }
 
-func SaveNewUser(device_address string, public_key rsa.PublicKey) error {
+func (s *sqlStore) SaveNewUser(device_address string, public_key rsa.PublicKey) error {
 	encodedPubKey, err := x509.MarshalPKIXPublicKey(&public_key)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO devices (device_address, pub_key, lang) VALUES ($1, $2, $3)", device_address, encodedPubKey, "")
+	_, err = s.db.Exec("INSERT INTO devices (device_address, pub_key, lang, last_seen) VALUES ($1, $2, $3, $4)", device_address, encodedPubKey, "", time.Now())
 	if err != nil {
 		panic(err)
 	}
 	return err
 }
 
-func UpdateLanguage(device_address string, language string) error {
-	_, err := db.Exec("UPDATE devices SET lang = $2 WHERE device_address = $1", language, device_address)
+func (s *sqlStore) UpdateLanguage(device_address string, language string) error {
+	_, err := s.db.Exec("UPDATE devices SET lang = $2 WHERE device_address = $1", device_address, language)
 
 	return err
 }
 
-func SaveNewToken(device_address string, routingToken []byte, bundleId string, notificationType int) error {
-	_, err := db.Exec("INSERT INTO notification_tokens (device_address, bundle_id, routing_token, allowed_notification_types, is_valid, issued_at) VALUES ($1, $2, $3, $4, $5, $6)",
+func (s *sqlStore) SaveNewToken(device_address string, routingToken []byte, bundleId string, notificationType int) error {
+	_, err := s.db.Exec("INSERT INTO notification_tokens (device_address, bundle_id, routing_token, allowed_notification_types, is_valid, issued_at) VALUES ($1, $2, $3, $4, $5, $6)",
 		device_address, bundleId, routingToken, notificationType, true, time.Now(),
 	)
 
 	return err
 }
 
-func GetUser(device_address string) (*Device, error) {
+func (s *sqlStore) GetUser(device_address string) (*Device, error) {
 	device := Device{}
-	row := db.QueryRow("SELECT * FROM devices WHERE device_address = $1", device_address)
+	row := s.db.QueryRow("SELECT device_address, pub_key, lang, last_seen FROM devices WHERE device_address = $1", device_address)
 
 	byteKey := []byte{}
-	if err := row.Scan(&device.DeviceAddress, &byteKey, &device.Language); err != nil {
+	if err := row.Scan(&device.DeviceAddress, &byteKey, &device.Language, &device.LastSeen); err != nil {
 		return nil, err
 	}
 
@@ -173,10 +332,10 @@ func GetUser(device_address string) (*Device, error) {
 	return &device, nil
 }
 
-func GetToken(routing_token []byte) (*NotificationToken, error) {
+func (s *sqlStore) GetToken(routing_token []byte) (*NotificationToken, error) {
 	notificationToken := NotificationToken{}
 
-	row := db.QueryRow("SELECT * FROM notification_tokens WHERE routing_token = $1", routing_token)
+	row := s.db.QueryRow("SELECT * FROM notification_tokens WHERE routing_token = $1", routing_token)
 
 	if err := row.Scan(&notificationToken.RoutingToken, &notificationToken.DeviceAddress, &notificationToken.FeedbackProviderAddress, &notificationToken.NotificationType, &notificationToken.AppBundleId, &notificationToken.IssuedAt, &notificationToken.IsValid, &notificationToken.LastUsed, &notificationToken.MarkedForRemovalAt); err != nil {
 		return nil, err
@@ -184,9 +343,9 @@ func GetToken(routing_token []byte) (*NotificationToken, error) {
 	return &notificationToken, nil
 }
 
-func GetAllTokens(device_address string) (*[]NotificationToken, error) {
+func (s *sqlStore) GetAllTokens(device_address string) (*[]NotificationToken, error) {
 
-	rows, err := db.Query("SELECT * FROM notification_tokens WHERE device_address = $1", device_address)
+	rows, err := s.db.Query("SELECT * FROM notification_tokens WHERE device_address = $1", device_address)
 	if err != nil {
 		return nil, err
 	}
@@ -203,14 +362,56 @@ func GetAllTokens(device_address string) (*[]NotificationToken, error) {
 	return &notificationTokens, nil
 }
 
-func GetUnacknowledgedMessages(device_address string) ([]QueuedMessage, error) {
-	return GetUnacknowledgedMessagesAfterUnixTime(device_address, time.Unix(0, 0))
+const queuedMessageColumns = "created_at, expires_at, is_encrypted, data, ciphertext, data_type, iv, device_address, routing_key, message_id, key_id, wrapped_key"
+
+func scanQueuedMessage(row interface{ Scan(...interface{}) error }) (*QueuedMessage, error) {
+	var message QueuedMessage
+	var data []byte
+	var keyId *string
+	var wrappedKey []byte
+	if err := row.Scan(&message.CreatedAt, &message.ExpiresAt,
+		&message.IsEncrypted, &data, // Unencrypted info
+		&message.Ciphertext, &message.DataType, &message.IV, // Encrypted info
+		&message.DeviceAddress, &message.RoutingKey, &message.MessageId, // Routing info
+		&keyId, &wrappedKey, // At rest encryption
+	); err != nil {
+		return nil, err
+	}
+
+	// undo the at rest encryption, if there's any
+	if message.IsEncrypted {
+		if message.Ciphertext != nil {
+			ciphertext, err := atRest.open(message.MessageId, *message.Ciphertext, keyId, wrappedKey)
+			if err != nil {
+				return nil, err
+			}
+			message.Ciphertext = &ciphertext
+		}
+	} else {
+		data, err := atRest.open(message.MessageId, data, keyId, wrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := plist.Unmarshal(data, &message.Data); err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
+}
+
+func (s *sqlStore) GetQueuedMessage(messageId string) (*QueuedMessage, error) {
+	return scanQueuedMessage(s.db.QueryRow("SELECT "+queuedMessageColumns+" FROM queued_messages WHERE message_id = $1", messageId))
 }
 
-func GetUnacknowledgedMessagesAfterUnixTime(device_address string, time time.Time) ([]QueuedMessage, error) {
+func (s *sqlStore) GetUnacknowledgedMessagesAfterUnixTime(device_address string, after time.Time) ([]QueuedMessage, error) {
 	var messages []QueuedMessage
 
-	rows, err := db.Query("SELECT * FROM queued_messages WHERE device_address = $1 AND created_at > $2", device_address, time)
+	rows, err := s.db.Query(`
+		SELECT `+queuedMessageColumns+`
+		FROM queued_messages
+		WHERE device_address = $1 AND created_at > $2 AND (expires_at IS NULL OR expires_at > $3) AND deliver_at IS NULL`,
+		device_address, after, time.Now(),
+	)
 	if err != nil {
 		return messages, err
 	}
@@ -218,24 +419,11 @@ func GetUnacknowledgedMessagesAfterUnixTime(device_address string, time time.Tim
 	defer rows.Close()
 
 	for rows.Next() {
-		var message QueuedMessage
-		var data []byte
-		if err := rows.Scan(&message.CreatedAt,
-			&message.IsEncrypted, &data, // Unencrypted info
-			&message.Ciphertext, &message.DataType, &message.IV, // Encrypted info
-			&message.DeviceAddress, &message.RoutingKey, &message.MessageId, // Routing info
-		); err != nil {
+		message, err := scanQueuedMessage(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		if !message.IsEncrypted {
-			if _, err := plist.Unmarshal(data, &message.Data); err != nil {
-				return nil, err
-			}
-
-		}
-
-		messages = append(messages, message)
+		messages = append(messages, *message)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -246,21 +434,21 @@ func GetUnacknowledgedMessagesAfterUnixTime(device_address string, time time.Tim
 }
 
 // Feedback
-func SaveNewFeedbackToken(routingToken []byte, server_address string, feedbackSecret []byte) error {
+func (s *sqlStore) SaveNewFeedbackToken(routingToken []byte, server_address string, feedbackSecret []byte) error {
 	if len(server_address) > 16 {
 		return errors.New("server address too big")
 	}
 
-	_, err := db.Exec("INSERT INTO feedback_token (feedback_key, routing_token, routing_domain, last_used) VALUES ($1, $2, $3, $4)",
+	_, err := s.db.Exec("INSERT INTO feedback_token (feedback_key, routing_token, routing_domain, last_used) VALUES ($1, $2, $3, $4)",
 		feedbackSecret, routingToken, server_address, time.Now(),
 	)
 
 	return err
 }
 
-func GetFeedbackWithSecret(feedbackSecret []byte, after *time.Time) ([]FeedbackToSend, error) {
-	var feedbackToSend []FeedbackToSend
+const feedbackColumns = "feedback_key, routing_token, server_address, type, reason, created_at, legacy_delivered_at"
 
+func (s *sqlStore) GetFeedbackWithSecret(feedbackSecret []byte, after *time.Time) ([]FeedbackToSend, error) {
 	latestTime := time.Now().Add(-2 * time.Hour)
 	if after == nil {
 		after = &latestTime
@@ -268,36 +456,30 @@ func GetFeedbackWithSecret(feedbackSecret []byte, after *time.Time) ([]FeedbackT
 		after = &latestTime
 	}
 
-	rows, err := db.Query("SELECT * FROM feedback_to_send WHERE feedback_key = $1 AND created_at >= $2", feedbackSecret, after)
-	if err != nil {
-		return feedbackToSend, err
-	}
+	return s.queryFeedback("SELECT "+feedbackColumns+" FROM feedback_to_send WHERE feedback_key = $1 AND created_at >= $2", feedbackSecret, after)
+}
 
-	defer rows.Close()
+func (s *sqlStore) GetAllFeedback() ([]FeedbackToSend, error) {
+	after := time.Now().Add(2 * time.Hour)
 
-	for rows.Next() {
-		var f FeedbackToSend
-		if err := rows.Scan(
-			&f.FeedbackKey, &f.RoutingToken, &f.ServerAddress, &f.Type, &f.Reason, &f.CreatedAt,
-		); err != nil {
-			return nil, err
-		}
-		feedbackToSend = append(feedbackToSend, f)
-	}
+	return s.queryFeedback("SELECT "+feedbackColumns+" FROM feedback_to_send WHERE created_at < $1", after)
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+func (s *sqlStore) GetUndeliveredLegacyFeedback(feedbackSecret []byte) ([]FeedbackToSend, error) {
+	return s.queryFeedback("SELECT "+feedbackColumns+" FROM feedback_to_send WHERE feedback_key = $1 AND legacy_delivered_at IS NULL ORDER BY created_at", feedbackSecret)
+}
 
-	return feedbackToSend, nil
+func (s *sqlStore) MarkLegacyFeedbackDelivered(feedbackSecret []byte, upTo time.Time) error {
+	_, err := s.db.Exec("UPDATE feedback_to_send SET legacy_delivered_at = $1 WHERE feedback_key = $2 AND legacy_delivered_at IS NULL AND created_at <= $3",
+		time.Now(), feedbackSecret, upTo,
+	)
+	return err
 }
 
-func GetAllFeedback() ([]FeedbackToSend, error) {
+func (s *sqlStore) queryFeedback(query string, args ...any) ([]FeedbackToSend, error) {
 	var feedbackToSend []FeedbackToSend
 
-	after := time.Now().Add(2 * time.Hour)
-
-	rows, err := db.Query("SELECT * FROM feedback_to_send WHERE created_at < $1", after)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return feedbackToSend, err
 	}
@@ -307,7 +489,7 @@ func GetAllFeedback() ([]FeedbackToSend, error) {
 	for rows.Next() {
 		var f FeedbackToSend
 		if err := rows.Scan(
-			&f.FeedbackKey, &f.RoutingToken, &f.Type, &f.Reason, &f.CreatedAt,
+			&f.FeedbackKey, &f.RoutingToken, &f.ServerAddress, &f.Type, &f.Reason, &f.CreatedAt, &f.LegacyDeliveredAt,
 		); err != nil {
 			return nil, err
 		}
@@ -321,10 +503,10 @@ func GetAllFeedback() ([]FeedbackToSend, error) {
 	return feedbackToSend, nil
 }
 
-func GetTokenFeedbackKey(routing_token []byte, serverAddress string) (*[]byte, error) {
+func (s *sqlStore) GetTokenFeedbackKey(routing_token []byte, serverAddress string) (*[]byte, error) {
 	var feedback_key []byte
 
-	row := db.QueryRow("SELECT feedback_key FROM feedback_token WHERE routing_token = $1 AND routing_domain = $2", routing_token, serverAddress)
+	row := s.db.QueryRow("SELECT feedback_key FROM feedback_token WHERE routing_token = $1 AND routing_domain = $2", routing_token, serverAddress)
 
 	if err := row.Scan(&feedback_key); err != nil {
 		return nil, err
@@ -333,37 +515,37 @@ func GetTokenFeedbackKey(routing_token []byte, serverAddress string) (*[]byte, e
 	return &feedback_key, nil
 }
 
-func AddFeedback(routingToken []byte, feedbackSecret []byte, serverAddress string, typeOfFeedback int, reason string) error {
+func (s *sqlStore) AddFeedback(routingToken []byte, feedbackSecret []byte, serverAddress string, typeOfFeedback int, reason string) error {
 	if len(reason) > 64 {
 		return errors.New("reason too big")
 	}
-	_, err := db.Exec("INSERT INTO feedback_to_send (feedback_key, routing_token, server_address, type, reason, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+	_, err := s.db.Exec("INSERT INTO feedback_to_send (feedback_key, routing_token, server_address, type, reason, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
 		feedbackSecret, routingToken, serverAddress, typeOfFeedback, reason, time.Now(),
 	)
 
 	return err
 }
 
-func SetTokenFeedbackProviderAddress(routingToken []byte, feedbackServer string) error {
+func (s *sqlStore) SetTokenFeedbackProviderAddress(routingToken []byte, feedbackServer string) error {
 	if len(feedbackServer) > 16 {
 		return errors.New("feedback server address too big")
 	}
-	_, err := db.Exec("UPDATE notification_tokens SET feedback_provider = $1 WHERE routing_token = $2 AND feedback_provider IS NULL",
+	_, err := s.db.Exec("UPDATE notification_tokens SET feedback_provider = $1 WHERE routing_token = $2 AND feedback_provider IS NULL",
 		feedbackServer, routingToken,
 	)
 
 	return err
 }
 
-func MarkTokenForRemoval(routingToken []byte) error {
-	_, err := db.Exec("UPDATE notification_tokens SET is_valid = false, marked_for_removal_at = $1  WHERE routing_token = $2",
+func (s *sqlStore) MarkTokenForRemoval(routingToken []byte) error {
+	_, err := s.db.Exec("UPDATE notification_tokens SET is_valid = false, marked_for_removal_at = $1  WHERE routing_token = $2",
 		time.Now(), routingToken,
 	)
 	return err
 }
 
-func SyncTokens(removed_tokens [][]byte, createdTokens []NotificationToken, modifiedTokens []NotificationToken) error {
-	tx, err := db.Begin()
+func (s *sqlStore) SyncTokens(removed_tokens [][]byte, createdTokens []NotificationToken, modifiedTokens []NotificationToken) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
@@ -378,7 +560,7 @@ func SyncTokens(removed_tokens [][]byte, createdTokens []NotificationToken, modi
 	}
 
 	for _, created_token := range createdTokens {
-		if _, err = db.Exec("INSERT INTO notification_tokens (device_address, bundle_id, routing_token, allowed_notification_types, is_valid, issued_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		if _, err = tx.Exec("INSERT INTO notification_tokens (device_address, bundle_id, routing_token, allowed_notification_types, is_valid, issued_at) VALUES ($1, $2, $3, $4, $5, $6)",
 			created_token.DeviceAddress, created_token.AppBundleId, created_token.RoutingToken, created_token.NotificationType, true, time.Now(),
 		); err != nil {
 			return err
@@ -386,7 +568,7 @@ func SyncTokens(removed_tokens [][]byte, createdTokens []NotificationToken, modi
 	}
 
 	for _, modified_token := range modifiedTokens {
-		if _, err = db.Exec(`
+		if _, err = tx.Exec(`
 			UPDATE notification_tokens 
 			SET (allowed_notification_types, is_valid, marked_for_removal_at) = ($1, $2, $3) 
 			WHERE routing_token = $4`,
@@ -402,70 +584,80 @@ func SyncTokens(removed_tokens [][]byte, createdTokens []NotificationToken, modi
 	return tx.Commit()
 }
 
-func HideTheTracksOfKilledTokens(ourServer string) error {
+func (s *sqlStore) HideTheTracksOfKilledTokens(ourServer string) error {
 	after := time.Now().Add(-2 * time.Hour)
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	rows, err := tx.Query("SELECT routing_token, feedback_provider FROM notification_tokens WHERE is_valid = false AND marked_for_removal_at <= $1", after)
+	rows, err := s.db.Query("SELECT routing_token FROM notification_tokens WHERE is_valid = false AND marked_for_removal_at <= $1", after)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
+	// got all of them first, so the connection's free to remove them
+	var killed [][]byte
 	for rows.Next() {
-		fmt.Println("hell")
 		var routingToken []byte
-		var feedbackProvider sql.NullString
-		if err := rows.Scan(&routingToken, &feedbackProvider); err != nil {
+		if err := rows.Scan(&routingToken); err != nil {
+			rows.Close()
 			return err
 		}
+		killed = append(killed, routingToken)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-		fmt.Println(routingToken)
-
-		if err := RemoveDeviceToken(routingToken, ourServer, true); err != nil {
+	for _, routingToken := range killed {
+		if err := s.RemoveDeviceToken(routingToken, ourServer, true); err != nil {
 			return err
 		}
-		fmt.Println("OwO")
 	}
+	return nil
+}
 
-	if err := rows.Err(); err != nil {
-		return err
+func (s *sqlStore) PurgeExpiredMessages() (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	return tx.Commit()
+	expired, err := deleteReturningIds(tx, "DELETE FROM queued_messages WHERE expires_at IS NOT NULL AND expires_at <= $1 RETURNING message_id", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if err := setMessageStatus(tx, MessageStatusExpired, nil, expired...); err != nil {
+		return 0, err
+	}
+	return int64(len(expired)), tx.Commit()
 }
 
-func RemoveDeviceToken(routingToken []byte, serverAddress string, isOurToken bool) error {
+func (s *sqlStore) RemoveDeviceToken(routingToken []byte, serverAddress string, isOurToken bool) error {
 	if isOurToken {
 		// clean up the actual token
-		if _, err := db.Exec("DELETE FROM notification_tokens WHERE routing_token = $1",
+		if _, err := s.db.Exec("DELETE FROM notification_tokens WHERE routing_token = $1",
 			routingToken,
 		); err != nil {
-			return nil
+			return err
 		}
 
-		if _, err := db.Exec("DELETE FROM queued_messages WHERE routing_token = $1",
+		if _, err := s.db.Exec("DELETE FROM queued_messages WHERE routing_key = $1",
 			routingToken,
 		); err != nil {
-			return nil
+			return err
 		}
 	}
 
-	if _, err := db.Exec("DELETE FROM feedback_to_send WHERE routing_token = $1 AND server_address = $2",
+	if _, err := s.db.Exec("DELETE FROM feedback_to_send WHERE routing_token = $1 AND server_address = $2",
 		routingToken, serverAddress,
 	); err != nil {
-		return nil
+		return err
 	}
 
-	if _, err := db.Exec("DELETE FROM feedback_token WHERE routing_token = $1 AND routing_domain = $2",
+	if _, err := s.db.Exec("DELETE FROM feedback_token WHERE routing_token = $1 AND routing_domain = $2",
 		routingToken, serverAddress,
 	); err != nil {
-		return nil
+		return err
 	}
 
 	return nil
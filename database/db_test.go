@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testDevice = "device@sgn.example.com"
+
+func queuedIds(t *testing.T, s Store, after time.Time) []string {
+	t.Helper()
+	queued, err := s.GetUnacknowledgedMessagesAfterUnixTime(testDevice, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, msg := range queued {
+		ids = append(ids, msg.MessageId)
+	}
+	slices.Sort(ids) // the order isn't up to the store
+	return ids
+}
+
+func TestQueueMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		start := time.Now().Add(-time.Hour)
+		past := start.Add(-time.Minute)
+		err := s.QueueMessages([]QueuedMessage{
+			{MessageId: "second", CreatedAt: start.Add(2 * time.Second), RoutingKey: []byte("routing key"), DeviceAddress: testDevice, Data: map[string]interface{}{"alert": "second"}},
+			{MessageId: "first", CreatedAt: start.Add(time.Second), RoutingKey: []byte("routing key"), DeviceAddress: testDevice, Data: map[string]interface{}{"alert": "first"}},
+			{MessageId: "expired", CreatedAt: start.Add(time.Second), ExpiresAt: &past, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+			{MessageId: "someone else's", CreatedAt: start.Add(time.Second), RoutingKey: []byte("another key"), DeviceAddress: "another@sgn.example.com"},
+		}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := queuedIds(t, s, start); !slices.Equal(got, []string{"first", "second"}) {
+			t.Fatalf("got %v, want [first second]", got)
+		}
+		queued, err := s.GetUnacknowledgedMessagesAfterUnixTime(testDevice, start.Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queued) != 1 || queued[0].Data["alert"] != "second" || string(queued[0].RoutingKey) != "routing key" {
+			t.Fatalf("after the first, got %+v, want second", queued)
+		}
+
+		if err := s.AckMessage("first", testDevice); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AckMessage("second", "another@sgn.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if got := queuedIds(t, s, start); !slices.Equal(got, []string{"second"}) {
+			t.Errorf("after acking first, got %v, want [second]", got)
+		}
+	})
+}
+
+func TestCollapseId(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		start := time.Now().Add(-time.Hour)
+		score := "score"
+		for i, id := range []string{"old score", "new score"} {
+			err := s.QueueMessages([]QueuedMessage{{MessageId: id, CreatedAt: start.Add(time.Duration(i) * time.Second), CollapseId: &score, RoutingKey: []byte("routing key"), DeviceAddress: testDevice}}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the same collapse id on another token is something else
+		err := s.QueueMessages([]QueuedMessage{{MessageId: "another app's score", CreatedAt: start, CollapseId: &score, RoutingKey: []byte("another key"), DeviceAddress: testDevice}}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := queuedIds(t, s, start.Add(-time.Second)); !slices.Equal(got, []string{"another app's score", "new score"}) {
+			t.Errorf("got %v, want the other app's score and the new score", got)
+		}
+		if status, _ := s.GetMessageStatus("old score"); status == nil || status.Status != MessageStatusDropped {
+			t.Errorf("old score is %+v, want it dropped", status)
+		}
+	})
+}
+
+func TestQueueingSetsStatus(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		deliverAt *time.Time
+		want      string
+	}{
+		{"right away", nil, MessageStatusQueued},
+		{"scheduled", &later, MessageStatusScheduled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				err := s.QueueMessages([]QueuedMessage{{
+					MessageId:  "message",
+					CreatedAt:  time.Now(),
+					DeliverAt:  tt.deliverAt,
+					Data:       map[string]interface{}{},
+					RoutingKey: []byte("routing key"),
+					Sender:     "provider:test",
+				}}, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				status, err := s.GetMessageStatus("message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status.Status != tt.want || status.Sender != "provider:test" {
+					t.Errorf("status is %s from %s, want %s from provider:test", status.Status, status.Sender, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestQueueAndDropMessages(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	scheduled := func(id string) QueuedMessage {
+		return QueuedMessage{MessageId: id, CreatedAt: time.Now(), DeliverAt: &later, RoutingKey: []byte("routing key"), DeviceAddress: testDevice}
+	}
+	dropped := []DroppedMessage{{MessageId: "dropped", Sender: "provider:test", Reason: "not connected"}}
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		// the schedule's full, so none of it goes through, dropped ones included
+		if err := s.QueueMessages([]QueuedMessage{scheduled("first")}, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.QueueAndDropMessages([]QueuedMessage{scheduled("second")}, dropped, 1); !errors.Is(err, ErrScheduleFull) {
+			t.Fatalf("got %v, want %v", err, ErrScheduleFull)
+		}
+		if _, err := s.GetMessageStatus("dropped"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got %v for the dropped message, want it rolled back", err)
+		}
+
+		if err := s.QueueAndDropMessages(nil, dropped, 1); err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.GetMessageStatus("dropped")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != MessageStatusDropped || status.Sender != "provider:test" || status.Reason == nil || *status.Reason != "not connected" {
+			t.Errorf("got %+v, want it dropped", status)
+		}
+	})
+}
+
+func TestFailedQueueChangesNothing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		score := "score"
+		later := time.Now().Add(time.Hour)
+		err := s.QueueMessages([]QueuedMessage{
+			{MessageId: "old score", CreatedAt: time.Now(), CollapseId: &score, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+			{MessageId: "scheduled", CreatedAt: time.Now(), DeliverAt: &later, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+		}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the new score replaces the old one, then the schedule's full, so it all has to be put back
+		err = s.QueueMessages([]QueuedMessage{
+			{MessageId: "new score", CreatedAt: time.Now(), CollapseId: &score, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+			{MessageId: "scheduled again", CreatedAt: time.Now(), DeliverAt: &later, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+		}, 1)
+		if !errors.Is(err, ErrScheduleFull) {
+			t.Fatalf("got %v, want %v", err, ErrScheduleFull)
+		}
+
+		if got := queuedIds(t, s, time.Time{}); !slices.Equal(got, []string{"old score"}) {
+			t.Errorf("got %v queued, want just the old score", got)
+		}
+		status, err := s.GetMessageStatus("old score")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != MessageStatusQueued || len(status.Events) != 1 {
+			t.Errorf("old score is %s with %d events, want it still just queued", status.Status, len(status.Events))
+		}
+		if _, err := s.GetMessageStatus("new score"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("got %v for the new score, want it rolled back", err)
+		}
+	})
+}
+
+func TestFullQueueDropsOldest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		start := time.Now()
+		for i, id := range []string{"first", "second", "third"} {
+			err := s.QueueMessages([]QueuedMessage{{
+				MessageId:     id,
+				CreatedAt:     start.Add(time.Duration(i) * time.Second),
+				RoutingKey:    []byte("routing key"),
+				DeviceAddress: testDevice,
+			}}, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for id, want := range map[string]string{"first": MessageStatusDropped, "second": MessageStatusQueued, "third": MessageStatusQueued} {
+			status, err := s.GetMessageStatus(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != want {
+				t.Errorf("%s is %s, want %s", id, status.Status, want)
+			}
+		}
+	})
+}
+
+func TestPurgeExpiredMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		past := time.Now().Add(-time.Minute)
+		future := time.Now().Add(time.Hour)
+		err := s.QueueMessages([]QueuedMessage{
+			{MessageId: "expired", CreatedAt: time.Now(), ExpiresAt: &past, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+			{MessageId: "expires later", CreatedAt: time.Now(), ExpiresAt: &future, RoutingKey: []byte("routing key"), DeviceAddress: testDevice},
+		}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		purged, err := s.PurgeExpiredMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != 1 {
+			t.Errorf("purged %d, want 1", purged)
+		}
+		if status, _ := s.GetMessageStatus("expired"); status == nil || status.Status != MessageStatusExpired {
+			t.Errorf("expired message is %+v, want it expired", status)
+		}
+	})
+}
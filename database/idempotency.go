@@ -0,0 +1,65 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type IdempotencyKey struct {
+	Scope       string
+	Key         string
+	RequestHash []byte
+	Result      []byte // nil while the request is still being handled
+	CreatedAt   time.Time
+	ExpiresAt   time.Time // while it's being handled, when whoever has it loses it
+}
+
+func (s *sqlStore) ClaimIdempotencyKey(scope string, key string, requestHash []byte, lease time.Duration) (claimed bool, existing *IdempotencyKey, err error) {
+	now := time.Now()
+
+	// an expired key can be used again, or one whose lease ran out before it was finished
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2 AND expires_at <= $3", scope, key, now); err != nil {
+		return false, nil, err
+	}
+
+	res, err := s.db.Exec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (scope, idempotency_key) DO NOTHING",
+		scope, key, requestHash, now, now.Add(lease),
+	)
+	if err != nil {
+		return false, nil, err
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return false, nil, err
+	} else if inserted == 1 {
+		return true, nil, nil
+	}
+
+	var k IdempotencyKey
+	row := s.db.QueryRow("SELECT scope, idempotency_key, request_hash, result, created_at, expires_at FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2", scope, key)
+	if err := row.Scan(&k.Scope, &k.Key, &k.RequestHash, &k.Result, &k.CreatedAt, &k.ExpiresAt); errors.Is(err, sql.ErrNoRows) {
+		// it expired between the insert and now, just try again
+		return s.ClaimIdempotencyKey(scope, key, requestHash, lease)
+	} else if err != nil {
+		return false, nil, err
+	}
+	return false, &k, nil
+}
+
+func (s *sqlStore) FinishIdempotencyKey(scope string, key string, result []byte, window time.Duration) error {
+	_, err := s.db.Exec("UPDATE idempotency_keys SET result = $3, expires_at = $4 WHERE scope = $1 AND idempotency_key = $2", scope, key, result, time.Now().Add(window))
+	return err
+}
+
+func (s *sqlStore) ReleaseIdempotencyKey(scope string, key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2", scope, key)
+	return err
+}
+
+func (s *sqlStore) PurgeExpiredIdempotencyKeys() (int64, error) {
+	res, err := s.db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
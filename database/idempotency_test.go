@@ -0,0 +1,74 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name string
+		// what happens to the first claim before the second
+		finish      bool
+		release     bool
+		lease       time.Duration
+		window      time.Duration
+		wantClaimed bool
+		wantResult  []byte
+	}{
+		{name: "still being handled", lease: time.Minute, wantClaimed: false},
+		{name: "finished", finish: true, lease: time.Minute, window: time.Hour, wantClaimed: false, wantResult: []byte("result")},
+		{name: "released", release: true, lease: time.Minute, wantClaimed: true},
+		{name: "lease ran out", lease: time.Millisecond, wantClaimed: true},
+		{name: "finish outlives the lease", finish: true, lease: time.Millisecond, window: time.Hour, wantClaimed: false, wantResult: []byte("result")},
+		{name: "window passed", finish: true, lease: time.Minute, window: time.Millisecond, wantClaimed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				claimed, _, err := s.ClaimIdempotencyKey("provider:test", "key", []byte("hash"), tt.lease)
+				if err != nil || !claimed {
+					t.Fatalf("first claim: claimed %v, %v", claimed, err)
+				}
+				if tt.finish {
+					if err := s.FinishIdempotencyKey("provider:test", "key", []byte("result"), tt.window); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if tt.release {
+					if err := s.ReleaseIdempotencyKey("provider:test", "key"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+
+				claimed, existing, err := s.ClaimIdempotencyKey("provider:test", "key", []byte("hash"), tt.lease)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if claimed != tt.wantClaimed {
+					t.Fatalf("claimed %v, want %v", claimed, tt.wantClaimed)
+				}
+				if claimed {
+					return
+				}
+				if !bytes.Equal(existing.RequestHash, []byte("hash")) || !bytes.Equal(existing.Result, tt.wantResult) {
+					t.Errorf("existing key is %+v", existing)
+				}
+			})
+		})
+	}
+}
+
+func TestIdempotencyKeysAreScoped(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if claimed, _, _ := s.ClaimIdempotencyKey("provider:one", "key", []byte("hash"), time.Minute); !claimed {
+			t.Fatal("first sender couldn't claim the key")
+		}
+		if claimed, _, _ := s.ClaimIdempotencyKey("provider:two", "key", []byte("hash"), time.Minute); !claimed {
+			t.Error("second sender couldn't claim the same key")
+		}
+	})
+}
@@ -0,0 +1,1247 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in memory, and it's all gone when we stop. It's meant for tests, and trying things out,
+// it behaves the same as the sql store does (not found is sql.ErrNoRows, and so on).
+type memoryStore struct {
+	mu sync.Mutex
+	memoryState
+	undo []func() // how to put back what's been changed, while in inTx
+}
+
+type memoryState struct {
+	messages        map[string]QueuedMessage
+	devices         map[string]Device
+	tokens          map[string]NotificationToken   // by routing token
+	feedbackTokens  map[string]memoryFeedbackToken // by routing token
+	feedback        []FeedbackToSend
+	relays          map[string]OutboundRelay
+	statuses        map[string]memoryStatus
+	callbacks       map[int64]StatusCallback
+	lastCallbackId  int64
+	idempotencyKeys map[idempotencyKeyId]IdempotencyKey
+	broadcasts      map[string]memoryBroadcast
+	instances       map[string]time.Time // last seen
+	owners          map[string]memoryOwner
+}
+
+type memoryFeedbackToken struct {
+	feedbackKey   []byte
+	routingDomain string
+	lastUsed      time.Time
+}
+
+type memoryStatus struct {
+	MessageStatus
+	callbackTo *string
+}
+
+type idempotencyKeyId struct {
+	scope string
+	key   string
+}
+
+type memoryOwner struct {
+	instanceId  string
+	connectedAt time.Time
+}
+
+type memoryBroadcast struct {
+	Broadcast
+	leaseUntil *time.Time
+}
+
+var (
+	errDeviceExists = errors.New("device already exists")
+	errTokenExists  = errors.New("token already exists")
+)
+
+func NewMemoryStore() Store {
+	return &memoryStore{memoryState: memoryState{
+		messages:        map[string]QueuedMessage{},
+		devices:         map[string]Device{},
+		tokens:          map[string]NotificationToken{},
+		feedbackTokens:  map[string]memoryFeedbackToken{},
+		relays:          map[string]OutboundRelay{},
+		statuses:        map[string]memoryStatus{},
+		callbacks:       map[int64]StatusCallback{},
+		idempotencyKeys: map[idempotencyKeyId]IdempotencyKey{},
+		broadcasts:      map[string]memoryBroadcast{},
+		instances:       map[string]time.Time{},
+		owners:          map[string]memoryOwner{},
+	}}
+}
+
+// inTx runs fn, and puts back everything it changed if it fails, like a transaction would. Everything that can run in
+// a transaction has to change the state with setIn & deleteFrom, so it can be undone. m.mu has to be held.
+func (m *memoryStore) inTx(fn func() error) error {
+	m.undo = []func(){}
+	lastCallbackId := m.lastCallbackId
+	err := fn()
+	if err != nil {
+		for i := len(m.undo) - 1; i >= 0; i-- {
+			m.undo[i]()
+		}
+		m.lastCallbackId = lastCallbackId
+	}
+	m.undo = nil
+	return err
+}
+
+// remember how key was in a map, if we're in a transaction
+func remember[K comparable, V any](m *memoryStore, in map[K]V, key K) {
+	if m.undo == nil {
+		return
+	}
+	old, existed := in[key]
+	m.undo = append(m.undo, func() {
+		if existed {
+			in[key] = old
+		} else {
+			delete(in, key)
+		}
+	})
+}
+
+func setIn[K comparable, V any](m *memoryStore, in map[K]V, key K, value V) {
+	remember(m, in, key)
+	in[key] = value
+}
+
+func deleteFrom[K comparable, V any](m *memoryStore, in map[K]V, key K) {
+	remember(m, in, key)
+	delete(in, key)
+}
+
+// queue
+
+func (m *memoryStore) QueueMessages(messages []QueuedMessage, queueDepth int) error {
+	return m.QueueAndDropMessages(messages, nil, queueDepth)
+}
+
+func (m *memoryStore) QueueAndDropMessages(messages []QueuedMessage, dropped []DroppedMessage, queueDepth int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.inTx(func() error {
+		for _, msg := range messages {
+			if err := m.queueMessage(msg, queueDepth); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		for _, d := range dropped {
+			m.dropUnqueuedMessage(d, now)
+		}
+		return nil
+	})
+}
+
+func (m *memoryStore) queueMessage(msg QueuedMessage, queueDepth int) error {
+	if msg.CollapseId != nil {
+		var replaced []string
+		for id, queued := range m.messages {
+			if bytes.Equal(queued.RoutingKey, msg.RoutingKey) && queued.CollapseId != nil && *queued.CollapseId == *msg.CollapseId {
+				deleteFrom(m, m.messages, id)
+				replaced = append(replaced, id)
+			}
+		}
+		reason := "replaced by a newer notification with the same collapse id"
+		m.setMessageStatus(MessageStatusDropped, &reason, replaced...)
+	}
+
+	status := MessageStatusQueued
+	if msg.DeliverAt != nil {
+		scheduled := 0
+		for _, queued := range m.messages {
+			if bytes.Equal(queued.RoutingKey, msg.RoutingKey) && queued.DeliverAt != nil {
+				scheduled++
+			}
+		}
+		if scheduled >= queueDepth {
+			return ErrScheduleFull
+		}
+		status = MessageStatusScheduled
+	}
+
+	if _, exists := m.messages[msg.MessageId]; !exists {
+		if msg.IsEncrypted {
+			msg.Data = nil
+		} else {
+			msg.Ciphertext, msg.DataType, msg.IV = nil, nil, nil
+		}
+		sender, callbackTo := msg.Sender, msg.StatusCallbackTo
+		msg.Sender, msg.StatusCallbackTo = "", nil
+		setIn(m, m.messages, msg.MessageId, msg)
+		m.createMessageStatus(msg.MessageId, sender, callbackTo, status, msg.CreatedAt)
+	}
+	m.touchToken(msg.RoutingKey, time.Now())
+
+	// keep the queue bounded
+	var queue []QueuedMessage
+	for _, queued := range m.messages {
+		if bytes.Equal(queued.RoutingKey, msg.RoutingKey) && queued.DeliverAt == nil {
+			queue = append(queue, queued)
+		}
+	}
+	if len(queue) <= queueDepth {
+		return nil
+	}
+	slices.SortFunc(queue, func(a, b QueuedMessage) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		if a.MessageId > b.MessageId {
+			return -1
+		}
+		return 1
+	})
+	var pushedOut []string
+	for _, queued := range queue[queueDepth:] {
+		deleteFrom(m, m.messages, queued.MessageId)
+		pushedOut = append(pushedOut, queued.MessageId)
+	}
+	reason := "the device's queue was full"
+	m.setMessageStatus(MessageStatusDropped, &reason, pushedOut...)
+	return nil
+}
+
+func (m *memoryStore) AckMessage(messageId string, deviceAddress string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if msg, ok := m.messages[messageId]; ok && msg.DeviceAddress == deviceAddress {
+		m.touchToken(msg.RoutingKey, now)
+		delete(m.messages, messageId)
+		m.setMessageStatus(MessageStatusAcked, nil, messageId)
+	}
+	m.touchDevice(deviceAddress, now)
+	return nil
+}
+
+func (m *memoryStore) GetUnacknowledgedMessagesAfterUnixTime(deviceAddress string, after time.Time) ([]QueuedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var messages []QueuedMessage
+	for _, msg := range m.messages {
+		if msg.DeviceAddress == deviceAddress && msg.CreatedAt.After(after) && !isExpired(msg.ExpiresAt, now) && msg.DeliverAt == nil {
+			messages = append(messages, msg)
+		}
+	}
+	slices.SortFunc(messages, func(a, b QueuedMessage) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return messages, nil
+}
+
+func isExpired(expiresAt *time.Time, now time.Time) bool {
+	return expiresAt != nil && !expiresAt.After(now)
+}
+
+func (m *memoryStore) PurgeExpiredMessages() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var expired []string
+	for id, msg := range m.messages {
+		if isExpired(msg.ExpiresAt, now) {
+			delete(m.messages, id)
+			expired = append(expired, id)
+		}
+	}
+	m.setMessageStatus(MessageStatusExpired, nil, expired...)
+	return int64(len(expired)), nil
+}
+
+func (m *memoryStore) GetQueuedMessage(messageId string) (*QueuedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[messageId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &msg, nil
+}
+
+func (m *memoryStore) ReleaseDueMessages(limit int) ([]QueuedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []QueuedMessage
+	for _, msg := range m.messages {
+		if msg.DeliverAt != nil && !msg.DeliverAt.After(now) && !isExpired(msg.ExpiresAt, now) {
+			due = append(due, msg)
+		}
+	}
+	slices.SortFunc(due, func(a, b QueuedMessage) int { return a.DeliverAt.Compare(*b.DeliverAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	var ids []string
+	for i := range due {
+		due[i].CreatedAt = now
+		due[i].DeliverAt = nil
+		m.messages[due[i].MessageId] = due[i]
+		ids = append(ids, due[i].MessageId)
+	}
+	m.setMessageStatus(MessageStatusQueued, nil, ids...)
+	return due, nil
+}
+
+func (m *memoryStore) CancelScheduledMessage(messageId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[messageId]
+	if !ok || msg.DeliverAt == nil {
+		return false, nil
+	}
+	delete(m.messages, messageId)
+	reason := "cancelled by the sender"
+	m.setMessageStatus(MessageStatusDropped, &reason, messageId)
+	return true, nil
+}
+
+// devices
+
+func (m *memoryStore) SaveNewUser(deviceAddress string, publicKey rsa.PublicKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.devices[deviceAddress]; exists {
+		return errDeviceExists
+	}
+	now := time.Now()
+	m.devices[deviceAddress] = Device{DeviceAddress: deviceAddress, PublicKey: &publicKey, LastSeen: &now}
+	return nil
+}
+
+func (m *memoryStore) UpdateLanguage(deviceAddress string, language string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if device, ok := m.devices[deviceAddress]; ok {
+		device.Language = language
+		m.devices[deviceAddress] = device
+	}
+	return nil
+}
+
+func (m *memoryStore) GetUser(deviceAddress string) (*Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[deviceAddress]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &device, nil
+}
+
+// tokens
+
+func (m *memoryStore) SaveNewToken(deviceAddress string, routingToken []byte, bundleId string, notificationType int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.saveNewToken(deviceAddress, routingToken, bundleId, notificationType)
+}
+
+func (m *memoryStore) saveNewToken(deviceAddress string, routingToken []byte, bundleId string, notificationType int) error {
+	if _, exists := m.tokens[string(routingToken)]; exists {
+		return errTokenExists
+	}
+	setIn(m, m.tokens, string(routingToken), NotificationToken{
+		RoutingToken:     routingToken,
+		DeviceAddress:    deviceAddress,
+		NotificationType: notificationType,
+		AppBundleId:      bundleId,
+		IssuedAt:         time.Now(),
+		IsValid:          true,
+	})
+	return nil
+}
+
+func (m *memoryStore) GetToken(routingToken []byte) (*NotificationToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[string(routingToken)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &token, nil
+}
+
+func (m *memoryStore) GetAllTokens(deviceAddress string) (*[]NotificationToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tokens := []NotificationToken{}
+	for _, token := range m.tokens {
+		if token.DeviceAddress == deviceAddress {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b NotificationToken) int { return bytes.Compare(a.RoutingToken, b.RoutingToken) })
+	return &tokens, nil
+}
+
+func (m *memoryStore) SetTokenFeedbackProviderAddress(routingToken []byte, feedbackServer string) error {
+	if len(feedbackServer) > 16 {
+		return errors.New("feedback server address too big")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if token, ok := m.tokens[string(routingToken)]; ok && token.FeedbackProviderAddress == nil {
+		token.FeedbackProviderAddress = &feedbackServer
+		m.tokens[string(routingToken)] = token
+	}
+	return nil
+}
+
+func (m *memoryStore) MarkTokenForRemoval(routingToken []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.markTokenForRemoval(routingToken, time.Now())
+	return nil
+}
+
+func (m *memoryStore) markTokenForRemoval(routingToken []byte, at time.Time) {
+	if token, ok := m.tokens[string(routingToken)]; ok {
+		token.IsValid = false
+		token.MarkedForRemovalAt = &at
+		setIn(m, m.tokens, string(routingToken), token)
+	}
+}
+
+func (m *memoryStore) SyncTokens(removedTokens [][]byte, createdTokens []NotificationToken, modifiedTokens []NotificationToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.inTx(func() error {
+		now := time.Now()
+		for _, removed := range removedTokens {
+			m.markTokenForRemoval(removed, now)
+		}
+		for _, created := range createdTokens {
+			if err := m.saveNewToken(created.DeviceAddress, created.RoutingToken, created.AppBundleId, created.NotificationType); err != nil {
+				return err
+			}
+		}
+		for _, modified := range modifiedTokens {
+			if token, ok := m.tokens[string(modified.RoutingToken)]; ok {
+				token.NotificationType = modified.NotificationType
+				token.IsValid = modified.IsValid
+				token.MarkedForRemovalAt = modified.MarkedForRemovalAt
+				setIn(m, m.tokens, string(modified.RoutingToken), token)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *memoryStore) HideTheTracksOfKilledTokens(ourServer string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	after := time.Now().Add(-2 * time.Hour)
+	for _, token := range m.tokens {
+		if !token.IsValid && token.MarkedForRemovalAt != nil && !token.MarkedForRemovalAt.After(after) {
+			m.removeDeviceToken(token.RoutingToken, ourServer, true)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RemoveDeviceToken(routingToken []byte, serverAddress string, isOurToken bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeDeviceToken(routingToken, serverAddress, isOurToken)
+	return nil
+}
+
+func (m *memoryStore) removeDeviceToken(routingToken []byte, serverAddress string, isOurToken bool) {
+	if isOurToken {
+		delete(m.tokens, string(routingToken))
+		for id, msg := range m.messages {
+			if bytes.Equal(msg.RoutingKey, routingToken) {
+				delete(m.messages, id)
+			}
+		}
+	}
+
+	m.feedback = slices.DeleteFunc(m.feedback, func(f FeedbackToSend) bool {
+		return bytes.Equal(f.RoutingToken, routingToken) && f.ServerAddress == serverAddress
+	})
+	if ft, ok := m.feedbackTokens[string(routingToken)]; ok && ft.routingDomain == serverAddress {
+		delete(m.feedbackTokens, string(routingToken))
+	}
+}
+
+// feedback
+
+func (m *memoryStore) SaveNewFeedbackToken(routingToken []byte, serverAddress string, feedbackSecret []byte) error {
+	if len(serverAddress) > 16 {
+		return errors.New("server address too big")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.feedbackTokens[string(routingToken)]; exists {
+		return errTokenExists
+	}
+	m.feedbackTokens[string(routingToken)] = memoryFeedbackToken{feedbackKey: feedbackSecret, routingDomain: serverAddress, lastUsed: time.Now()}
+	return nil
+}
+
+func (m *memoryStore) GetFeedbackWithSecret(feedbackSecret []byte, after *time.Time) ([]FeedbackToSend, error) {
+	latestTime := time.Now().Add(-2 * time.Hour)
+	if after == nil || after.Before(latestTime) {
+		after = &latestTime
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var feedbackToSend []FeedbackToSend
+	for _, f := range m.feedback {
+		if bytes.Equal(f.FeedbackKey, feedbackSecret) && !f.CreatedAt.Before(*after) {
+			feedbackToSend = append(feedbackToSend, f)
+		}
+	}
+	return feedbackToSend, nil
+}
+
+func (m *memoryStore) GetAllFeedback() ([]FeedbackToSend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before := time.Now().Add(2 * time.Hour)
+	var feedbackToSend []FeedbackToSend
+	for _, f := range m.feedback {
+		if f.CreatedAt.Before(before) {
+			feedbackToSend = append(feedbackToSend, f)
+		}
+	}
+	return feedbackToSend, nil
+}
+
+func (m *memoryStore) GetTokenFeedbackKey(routingToken []byte, serverAddress string) (*[]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ft, ok := m.feedbackTokens[string(routingToken)]
+	if !ok || ft.routingDomain != serverAddress {
+		return nil, sql.ErrNoRows
+	}
+	return &ft.feedbackKey, nil
+}
+
+func (m *memoryStore) AddFeedback(routingToken []byte, feedbackSecret []byte, serverAddress string, typeOfFeedback int, reason string) error {
+	if len(reason) > 64 {
+		return errors.New("reason too big")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.feedback = append(m.feedback, FeedbackToSend{
+		FeedbackKey:   feedbackSecret,
+		RoutingToken:  routingToken,
+		ServerAddress: serverAddress,
+		Type:          typeOfFeedback,
+		Reason:        reason,
+		CreatedAt:     time.Now(),
+	})
+	return nil
+}
+
+func (m *memoryStore) GetUndeliveredLegacyFeedback(feedbackSecret []byte) ([]FeedbackToSend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var feedbackToSend []FeedbackToSend
+	for _, f := range m.feedback {
+		if bytes.Equal(f.FeedbackKey, feedbackSecret) && f.LegacyDeliveredAt == nil {
+			feedbackToSend = append(feedbackToSend, f)
+		}
+	}
+	slices.SortStableFunc(feedbackToSend, func(a, b FeedbackToSend) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return feedbackToSend, nil
+}
+
+func (m *memoryStore) MarkLegacyFeedbackDelivered(feedbackSecret []byte, upTo time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i, f := range m.feedback {
+		if bytes.Equal(f.FeedbackKey, feedbackSecret) && f.LegacyDeliveredAt == nil && !f.CreatedAt.After(upTo) {
+			m.feedback[i].LegacyDeliveredAt = &now
+		}
+	}
+	return nil
+}
+
+// relays
+
+func (m *memoryStore) QueueRelays(relays []OutboundRelay) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.inTx(func() error {
+		for _, r := range relays {
+			if _, exists := m.relays[r.MessageId]; exists {
+				continue
+			}
+			sender, callbackTo := r.Sender, r.StatusCallbackTo
+			r.Sender, r.StatusCallbackTo = "", nil
+			r.Status = RelayStatusPending
+			r.Attempts = 0
+			r.UpdatedAt = r.CreatedAt
+			setIn(m, m.relays, r.MessageId, r)
+			m.createMessageStatus(r.MessageId, sender, callbackTo, MessageStatusAccepted, r.CreatedAt)
+		}
+		return nil
+	})
+}
+
+func (m *memoryStore) ClaimDueRelays(limit int, lease time.Duration) ([]OutboundRelay, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []OutboundRelay
+	for _, r := range m.relays {
+		if r.Status == RelayStatusPending && !r.NextAttemptAt.After(now) {
+			due = append(due, r)
+		}
+	}
+	slices.SortFunc(due, func(a, b OutboundRelay) int { return a.NextAttemptAt.Compare(b.NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].NextAttemptAt = now.Add(lease)
+		m.relays[due[i].MessageId] = due[i]
+	}
+	return due, nil
+}
+
+func (m *memoryStore) RetryRelayAt(messageId string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.relays[messageId]; ok {
+		r.Attempts = attempts
+		r.NextAttemptAt = nextAttemptAt
+		r.LastError = &lastError
+		r.UpdatedAt = time.Now()
+		m.relays[messageId] = r
+	}
+	return nil
+}
+
+func (m *memoryStore) FinishRelay(messageId string, status string, attempts int, lastError *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.relays[messageId]
+	if !ok || r.Status != RelayStatusPending {
+		return nil
+	}
+	r.Status = status
+	r.Attempts = attempts
+	r.LastError = lastError
+	r.UpdatedAt = time.Now()
+	m.relays[messageId] = r
+
+	messageStatus := MessageStatusDropped
+	switch status {
+	case RelayStatusDelivered:
+		messageStatus = MessageStatusRelayed
+	case RelayStatusExpired:
+		messageStatus = MessageStatusExpired
+	}
+	m.setMessageStatus(messageStatus, lastError, messageId)
+	return nil
+}
+
+func (m *memoryStore) CancelPendingRelay(messageId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.relays[messageId]
+	if !ok || r.Status != RelayStatusPending {
+		return false, nil
+	}
+	reason := "cancelled by the sender"
+	r.Status = RelayStatusCancelled
+	r.LastError = &reason
+	r.UpdatedAt = time.Now()
+	m.relays[messageId] = r
+	m.setMessageStatus(MessageStatusDropped, &reason, messageId)
+	return true, nil
+}
+
+func (m *memoryStore) GetRelay(messageId string) (*OutboundRelay, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.relays[messageId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &r, nil
+}
+
+func (m *memoryStore) RecordRelayResponse(messageId string, remoteStatus *string, remoteReason *string, remoteMessageId *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.relays[messageId]; ok {
+		r.RemoteStatus, r.RemoteReason, r.RemoteMessageId = remoteStatus, remoteReason, remoteMessageId
+		m.relays[messageId] = r
+	}
+	return nil
+}
+
+// message statuses
+
+func (m *memoryStore) createMessageStatus(messageId string, sender string, callbackTo *string, status string, at time.Time) {
+	if _, exists := m.statuses[messageId]; exists {
+		return
+	}
+	setIn(m, m.statuses, messageId, memoryStatus{
+		MessageStatus: MessageStatus{
+			MessageId: messageId,
+			Sender:    sender,
+			Status:    status,
+			CreatedAt: at,
+			UpdatedAt: at,
+			Events:    []MessageStatusEvent{{Status: status, At: at}},
+		},
+		callbackTo: callbackTo,
+	})
+}
+
+func (m *memoryStore) setMessageStatus(status string, reason *string, messageIds ...string) {
+	now := time.Now()
+	for _, id := range messageIds {
+		s, ok := m.statuses[id]
+		if !ok || !slices.Contains(messageStatusFrom[status], s.Status) {
+			continue
+		}
+		s.Status = status
+		s.Reason = reason
+		s.UpdatedAt = now
+		s.Events = append(slices.Clip(s.Events), MessageStatusEvent{Status: status, Reason: reason, At: now})
+		setIn(m, m.statuses, id, s)
+
+		if s.callbackTo != nil && slices.Contains(callbackStatuses, status) {
+			m.lastCallbackId++
+			setIn(m, m.callbacks, m.lastCallbackId, StatusCallback{
+				Id:            m.lastCallbackId,
+				MessageId:     id,
+				Destination:   *s.callbackTo,
+				Status:        status,
+				Reason:        reason,
+				At:            now,
+				NextAttemptAt: now,
+			})
+		}
+	}
+}
+
+func (m *memoryStore) SetMessageStatus(messageId string, status string, reason *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setMessageStatus(status, reason, messageId)
+	return nil
+}
+
+// m.mu has to be held
+func (m *memoryStore) dropUnqueuedMessage(d DroppedMessage, now time.Time) {
+	if _, exists := m.statuses[d.MessageId]; exists {
+		return
+	}
+	reason := d.Reason
+	setIn(m, m.statuses, d.MessageId, memoryStatus{MessageStatus: MessageStatus{
+		MessageId: d.MessageId,
+		Sender:    d.Sender,
+		Status:    MessageStatusDropped,
+		Reason:    &reason,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Events:    []MessageStatusEvent{{Status: MessageStatusDropped, Reason: &reason, At: now}},
+	}})
+}
+
+func (m *memoryStore) GetMessageStatus(messageId string) (*MessageStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.statuses[messageId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	status := s.MessageStatus
+	status.Events = slices.Clone(s.Events)
+	return &status, nil
+}
+
+func (m *memoryStore) PurgeOldMessageStatuses(olderThan time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var purged int64
+	for id, s := range m.statuses {
+		if !s.UpdatedAt.After(cutoff) {
+			delete(m.statuses, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *memoryStore) ClaimDueStatusCallbacks(limit int, lease time.Duration) ([]StatusCallback, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []StatusCallback
+	for _, cb := range m.callbacks {
+		if !cb.NextAttemptAt.After(now) {
+			due = append(due, cb)
+		}
+	}
+	slices.SortFunc(due, func(a, b StatusCallback) int { return a.NextAttemptAt.Compare(b.NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].NextAttemptAt = now.Add(lease)
+		m.callbacks[due[i].Id] = due[i]
+	}
+	return due, nil
+}
+
+func (m *memoryStore) RetryStatusCallbackAt(id int64, attempts int, nextAttemptAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cb, ok := m.callbacks[id]; ok {
+		cb.Attempts = attempts
+		cb.NextAttemptAt = nextAttemptAt
+		m.callbacks[id] = cb
+	}
+	return nil
+}
+
+func (m *memoryStore) FinishStatusCallback(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.callbacks, id)
+	return nil
+}
+
+// idempotency keys
+
+func (m *memoryStore) ClaimIdempotencyKey(scope string, key string, requestHash []byte, lease time.Duration) (bool, *IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	id := idempotencyKeyId{scope, key}
+	if k, ok := m.idempotencyKeys[id]; ok && k.ExpiresAt.After(now) {
+		return false, &k, nil
+	}
+	m.idempotencyKeys[id] = IdempotencyKey{Scope: scope, Key: key, RequestHash: requestHash, CreatedAt: now, ExpiresAt: now.Add(lease)}
+	return true, nil, nil
+}
+
+func (m *memoryStore) FinishIdempotencyKey(scope string, key string, result []byte, window time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := idempotencyKeyId{scope, key}
+	if k, ok := m.idempotencyKeys[id]; ok {
+		k.Result = result
+		k.ExpiresAt = time.Now().Add(window)
+		m.idempotencyKeys[id] = k
+	}
+	return nil
+}
+
+func (m *memoryStore) ReleaseIdempotencyKey(scope string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.idempotencyKeys, idempotencyKeyId{scope, key})
+	return nil
+}
+
+func (m *memoryStore) PurgeExpiredIdempotencyKeys() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var purged int64
+	for id, k := range m.idempotencyKeys {
+		if !k.ExpiresAt.After(now) {
+			delete(m.idempotencyKeys, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// broadcasts
+
+func (m *memoryStore) CreateBroadcast(b Broadcast) (*Broadcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0
+	for _, token := range m.tokens {
+		if token.AppBundleId == b.BundleId && token.IsValid {
+			total++
+		}
+	}
+
+	now := time.Now()
+	created := Broadcast{
+		BroadcastId: b.BroadcastId,
+		Sender:      b.Sender,
+		BundleId:    b.BundleId,
+		Body:        b.Body,
+		Status:      BroadcastStatusRunning,
+		TotalTokens: total,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	m.broadcasts[b.BroadcastId] = memoryBroadcast{Broadcast: created}
+	return &created, nil
+}
+
+func (m *memoryStore) GetBroadcast(broadcastId string) (*Broadcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.broadcasts[broadcastId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &b.Broadcast, nil
+}
+
+func (m *memoryStore) ClaimBroadcast(lease time.Duration) (*Broadcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var claimed *memoryBroadcast
+	for _, b := range m.broadcasts {
+		if b.Status != BroadcastStatusRunning || (b.leaseUntil != nil && b.leaseUntil.After(now)) {
+			continue
+		}
+		if claimed == nil || b.CreatedAt.Before(claimed.CreatedAt) {
+			claimed = &b
+		}
+	}
+	if claimed == nil {
+		return nil, nil
+	}
+	leaseUntil := now.Add(lease)
+	claimed.leaseUntil = &leaseUntil
+	m.broadcasts[claimed.BroadcastId] = *claimed
+	return &claimed.Broadcast, nil
+}
+
+func (m *memoryStore) GetBroadcastTokens(bundleId string, cursor []byte, limit int) ([]NotificationToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tokens []NotificationToken
+	for _, token := range m.tokens {
+		if token.AppBundleId == bundleId && token.IsValid && bytes.Compare(token.RoutingToken, cursor) > 0 {
+			tokens = append(tokens, NotificationToken{
+				RoutingToken:     token.RoutingToken,
+				DeviceAddress:    token.DeviceAddress,
+				NotificationType: token.NotificationType,
+				AppBundleId:      bundleId,
+				IsValid:          true,
+			})
+		}
+	}
+	slices.SortFunc(tokens, func(a, b NotificationToken) int { return bytes.Compare(a.RoutingToken, b.RoutingToken) })
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+	return tokens, nil
+}
+
+func (m *memoryStore) QueueBroadcastBatch(broadcastId string, messages []QueuedMessage, queueDepth int, progress BroadcastProgress, lease time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.inTx(func() error {
+		for _, msg := range messages {
+			if err := m.queueMessage(msg, queueDepth); err != nil {
+				return err
+			}
+		}
+		m.updateBroadcastProgress(broadcastId, progress, lease)
+		return nil
+	})
+}
+
+func (m *memoryStore) UpdateBroadcastProgress(broadcastId string, progress BroadcastProgress, lease time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.updateBroadcastProgress(broadcastId, progress, lease)
+	return nil
+}
+
+func (m *memoryStore) updateBroadcastProgress(broadcastId string, progress BroadcastProgress, lease time.Duration) {
+	b, ok := m.broadcasts[broadcastId]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	leaseUntil := now.Add(lease)
+	b.Cursor = progress.Cursor
+	b.Queued += progress.Queued
+	b.Skipped += progress.Skipped
+	b.Failed += progress.Failed
+	b.leaseUntil = &leaseUntil
+	b.UpdatedAt = now
+	setIn(m, m.broadcasts, broadcastId, b)
+}
+
+func (m *memoryStore) FinishBroadcast(broadcastId string, status string, lastError *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.broadcasts[broadcastId]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	b.Status = status
+	b.LastError = lastError
+	b.leaseUntil = nil
+	b.UpdatedAt = now
+	b.FinishedAt = &now
+	m.broadcasts[broadcastId] = b
+	return nil
+}
+
+func (m *memoryStore) PurgeOldBroadcasts(olderThan time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var purged int64
+	for id, b := range m.broadcasts {
+		if b.Status != BroadcastStatusRunning && b.FinishedAt != nil && !b.FinishedAt.After(cutoff) {
+			delete(m.broadcasts, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// cluster, there's only ever one server with a memory store, but it still keeps track
+
+func (m *memoryStore) HeartbeatInstance(instanceId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.instances[instanceId] = time.Now()
+	return nil
+}
+
+func (m *memoryStore) PurgeDeadInstances(olderThan time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var purged int64
+	for instanceId, lastSeen := range m.instances {
+		if lastSeen.After(cutoff) {
+			continue
+		}
+		delete(m.instances, instanceId)
+		purged++
+		for deviceAddress, owner := range m.owners {
+			if owner.instanceId == instanceId {
+				delete(m.owners, deviceAddress)
+			}
+		}
+	}
+	return purged, nil
+}
+
+func (m *memoryStore) SetConnectionOwner(deviceAddress string, instanceId string, connectedAt time.Time) (*string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.instances[instanceId]; !ok {
+		return nil, errors.New("instance has to check in before it owns connections")
+	}
+	owner, ok := m.owners[deviceAddress]
+	m.owners[deviceAddress] = memoryOwner{instanceId: instanceId, connectedAt: connectedAt}
+	if !ok || owner.instanceId == instanceId {
+		return nil, nil
+	}
+	return &owner.instanceId, nil
+}
+
+func (m *memoryStore) RemoveConnectionOwner(deviceAddress string, instanceId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if owner, ok := m.owners[deviceAddress]; ok && owner.instanceId == instanceId {
+		delete(m.owners, deviceAddress)
+	}
+	return nil
+}
+
+func (m *memoryStore) GetConnectionOwner(deviceAddress string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owner, ok := m.owners[deviceAddress]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return owner.instanceId, nil
+}
+
+// retention
+
+func (m *memoryStore) TouchDevice(deviceAddress string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.touchDevice(deviceAddress, time.Now())
+	return nil
+}
+
+func (m *memoryStore) touchDevice(deviceAddress string, at time.Time) {
+	if device, ok := m.devices[deviceAddress]; ok {
+		device.LastSeen = &at
+		m.devices[deviceAddress] = device
+	}
+}
+
+func (m *memoryStore) touchToken(routingToken []byte, at time.Time) {
+	if token, ok := m.tokens[string(routingToken)]; ok {
+		token.LastUsed = &at
+		setIn(m, m.tokens, string(routingToken), token)
+	}
+}
+
+func (m *memoryStore) GetIdleTokens(idleFor time.Duration, limit int) ([]NotificationToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-idleFor)
+	return m.findTokens(limit, func(token NotificationToken) bool {
+		lastUsed := token.IssuedAt
+		if token.LastUsed != nil {
+			lastUsed = *token.LastUsed
+		}
+		return !lastUsed.After(cutoff)
+	}), nil
+}
+
+func (m *memoryStore) GetDormantDeviceTokens(dormantFor time.Duration, limit int) ([]NotificationToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-dormantFor)
+	return m.findTokens(limit, func(token NotificationToken) bool {
+		device, ok := m.devices[token.DeviceAddress]
+		return ok && device.LastSeen != nil && !device.LastSeen.After(cutoff)
+	}), nil
+}
+
+// findTokens gets up to limit valid tokens that match, in routing token order like the sql store.
+func (m *memoryStore) findTokens(limit int, match func(NotificationToken) bool) []NotificationToken {
+	var tokens []NotificationToken
+	for _, token := range m.tokens {
+		if token.IsValid && match(token) {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b NotificationToken) int { return bytes.Compare(a.RoutingToken, b.RoutingToken) })
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+	return tokens
+}
+
+func (m *memoryStore) PurgeDormantDevices(dormantFor time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-dormantFor)
+	var purged int64
+	for deviceAddress, device := range m.devices {
+		if device.LastSeen == nil || device.LastSeen.After(cutoff) {
+			continue
+		}
+		hasTokens := false
+		for _, token := range m.tokens {
+			if token.DeviceAddress == deviceAddress {
+				hasTokens = true
+				break
+			}
+		}
+		if hasTokens {
+			continue
+		}
+		delete(m.devices, deviceAddress)
+		purged++
+	}
+	return purged, nil
+}
+
+func (m *memoryStore) DropOldQueuedMessages(olderThan time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var dropped []string
+	for id, msg := range m.messages {
+		if msg.DeliverAt == nil && !msg.CreatedAt.After(cutoff) {
+			delete(m.messages, id)
+			dropped = append(dropped, id)
+		}
+	}
+	m.setMessageStatus(MessageStatusDropped, &droppedForAgeReason, dropped...)
+	return int64(len(dropped)), nil
+}
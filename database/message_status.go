@@ -0,0 +1,205 @@
+package db
+
+import (
+	"database/sql"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where a message is at. They only go forward, once a message is acked, expired or dropped it stays that way.
+const (
+	MessageStatusAccepted  = "accepted"  // we took it, and it's waiting to be relayed to the token's server
+	MessageStatusRelayed   = "relayed"   // the token's server took it
+	MessageStatusScheduled = "scheduled" // held back until it's deliver_at
+	MessageStatusQueued    = "queued"    // waiting for the device to connect
+	MessageStatusDelivered = "delivered" // written to the device's connection
+	MessageStatusAcked     = "acked"     // the device said it got it
+	MessageStatusExpired   = "expired"
+	MessageStatusDropped   = "dropped" // replaced, pushed out of a full queue, cancelled, or the relay failed
+)
+
+// what a message has to be in to move to each status
+var messageStatusFrom = map[string][]string{
+	MessageStatusRelayed: {MessageStatusAccepted},
+	MessageStatusQueued:  {MessageStatusScheduled},
+	// relays can skip ahead, if the other server tells us it was delivered before we've marked it as relayed
+	MessageStatusDelivered: {MessageStatusAccepted, MessageStatusRelayed, MessageStatusQueued},
+	MessageStatusAcked:     {MessageStatusAccepted, MessageStatusRelayed, MessageStatusQueued, MessageStatusDelivered},
+	MessageStatusExpired:   {MessageStatusAccepted, MessageStatusRelayed, MessageStatusScheduled, MessageStatusQueued, MessageStatusDelivered},
+	MessageStatusDropped:   {MessageStatusAccepted, MessageStatusRelayed, MessageStatusScheduled, MessageStatusQueued, MessageStatusDelivered},
+}
+
+// the statuses reported back to the server that relayed a message to us, the rest don't mean anything to them
+var callbackStatuses = []string{MessageStatusDelivered, MessageStatusAcked, MessageStatusExpired, MessageStatusDropped}
+
+type MessageStatus struct {
+	MessageId string
+	Sender    string
+	Status    string
+	Reason    *string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Events    []MessageStatusEvent
+}
+
+type MessageStatusEvent struct {
+	Status string
+	Reason *string
+	At     time.Time
+}
+
+// so the status can be changed in the same transaction as whatever changed it
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// callbackTo is the server to report changes to, if it asked
+func createMessageStatus(q queryer, messageId string, sender string, callbackTo *string, status string, at time.Time) error {
+	res, err := q.Exec("INSERT INTO message_status (message_id, sender, callback_to, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $5) ON CONFLICT (message_id) DO NOTHING",
+		messageId, sender, callbackTo, status, at,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	_, err = q.Exec("INSERT INTO message_status_events (message_id, status, at) VALUES ($1, $2, $3)", messageId, status, at)
+	return err
+}
+
+// setMessageStatus moves messages to status, if they're somewhere they can move to it from.
+// If the server that relayed it to us asked, it's queued up to be reported back to them.
+func setMessageStatus(q queryer, status string, reason *string, messageIds ...string) error {
+	if len(messageIds) == 0 {
+		return nil
+	}
+	from := messageStatusFrom[status]
+	if len(from) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	args := []interface{}{status, reason, now}
+	rows, err := q.Query(`
+		UPDATE message_status SET status = $1, reason = $2, updated_at = $3
+		WHERE message_id IN (`+inList(&args, messageIds)+`) AND status IN (`+inList(&args, from)+`)
+		RETURNING message_id, callback_to`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	type updatedStatus struct {
+		messageId  string
+		callbackTo *string
+	}
+	var updated []updatedStatus
+	for rows.Next() {
+		var u updatedStatus
+		if err := rows.Scan(&u.messageId, &u.callbackTo); err != nil {
+			rows.Close()
+			return err
+		}
+		updated = append(updated, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	callback := slices.Contains(callbackStatuses, status)
+	for _, u := range updated {
+		if _, err := q.Exec("INSERT INTO message_status_events (message_id, status, reason, at) VALUES ($1, $2, $3, $4)", u.messageId, status, reason, now); err != nil {
+			return err
+		}
+		if callback && u.callbackTo != nil {
+			if _, err := q.Exec("INSERT INTO status_callbacks (message_id, destination, status, reason, at, next_attempt_at) VALUES ($1, $2, $3, $4, $5, $5)",
+				u.messageId, *u.callbackTo, status, reason, now,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inList adds values to args, and gives back the placeholders for them, for an IN (...).
+func inList(args *[]interface{}, values []string) string {
+	placeholders := make([]string, len(values))
+	for i, v := range values {
+		*args = append(*args, v)
+		placeholders[i] = "$" + strconv.Itoa(len(*args))
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// deleteReturningIds runs a DELETE ... RETURNING message_id, and gives back the ids.
+func deleteReturningIds(q queryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func dropUnqueuedMessage(q queryer, d DroppedMessage, now time.Time) error {
+	res, err := q.Exec("INSERT INTO message_status (message_id, sender, status, reason, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $5) ON CONFLICT (message_id) DO NOTHING",
+		d.MessageId, d.Sender, MessageStatusDropped, d.Reason, now,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	_, err = q.Exec("INSERT INTO message_status_events (message_id, status, reason, at) VALUES ($1, $2, $3, $4)", d.MessageId, MessageStatusDropped, d.Reason, now)
+	return err
+}
+
+func (s *sqlStore) SetMessageStatus(messageId string, status string, reason *string) error {
+	return setMessageStatus(s.db, status, reason, messageId)
+}
+
+func (s *sqlStore) GetMessageStatus(messageId string) (*MessageStatus, error) {
+	var status MessageStatus
+	row := s.db.QueryRow("SELECT message_id, sender, status, reason, created_at, updated_at FROM message_status WHERE message_id = $1", messageId)
+	if err := row.Scan(&status.MessageId, &status.Sender, &status.Status, &status.Reason, &status.CreatedAt, &status.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT status, reason, at FROM message_status_events WHERE message_id = $1 ORDER BY at", messageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e MessageStatusEvent
+		if err := rows.Scan(&e.Status, &e.Reason, &e.At); err != nil {
+			return nil, err
+		}
+		status.Events = append(status.Events, e)
+	}
+	return &status, rows.Err()
+}
+
+func (s *sqlStore) PurgeOldMessageStatuses(olderThan time.Duration) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM message_status WHERE updated_at <= $1", time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
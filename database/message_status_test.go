@@ -0,0 +1,121 @@
+package db
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMessageStatusesOnlyMoveForward(t *testing.T) {
+	final := []string{MessageStatusAcked, MessageStatusExpired, MessageStatusDropped}
+	for to, from := range messageStatusFrom {
+		for _, status := range from {
+			if slices.Contains(final, status) {
+				t.Errorf("%s can move from %s, which is final", to, status)
+			}
+			if status == to {
+				t.Errorf("%s can move to itself", to)
+			}
+		}
+	}
+}
+
+func TestSetMessageStatus(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want string
+	}{
+		{MessageStatusAccepted, MessageStatusRelayed, MessageStatusRelayed},
+		{MessageStatusAccepted, MessageStatusDelivered, MessageStatusDelivered}, // the other server got there first
+		{MessageStatusAccepted, MessageStatusQueued, MessageStatusAccepted},
+		{MessageStatusRelayed, MessageStatusAccepted, MessageStatusRelayed},
+		{MessageStatusScheduled, MessageStatusQueued, MessageStatusQueued},
+		{MessageStatusScheduled, MessageStatusDelivered, MessageStatusScheduled},
+		{MessageStatusScheduled, MessageStatusDropped, MessageStatusDropped},
+		{MessageStatusQueued, MessageStatusScheduled, MessageStatusQueued},
+		{MessageStatusQueued, MessageStatusDelivered, MessageStatusDelivered},
+		{MessageStatusQueued, MessageStatusAcked, MessageStatusAcked},
+		{MessageStatusDelivered, MessageStatusQueued, MessageStatusDelivered},
+		{MessageStatusDelivered, MessageStatusAcked, MessageStatusAcked},
+		{MessageStatusDelivered, MessageStatusExpired, MessageStatusExpired},
+		{MessageStatusAcked, MessageStatusExpired, MessageStatusAcked},
+		{MessageStatusAcked, MessageStatusDropped, MessageStatusAcked},
+		{MessageStatusExpired, MessageStatusDelivered, MessageStatusExpired},
+		{MessageStatusDropped, MessageStatusAcked, MessageStatusDropped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				createTestMessageStatus(t, s, "message", "provider:test", nil, tt.from)
+
+				if err := s.SetMessageStatus("message", tt.to, nil); err != nil {
+					t.Fatal(err)
+				}
+				status, err := s.GetMessageStatus("message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status.Status != tt.want {
+					t.Errorf("status is %s, want %s", status.Status, tt.want)
+				}
+
+				wantEvents := 1
+				if tt.want != tt.from {
+					wantEvents = 2
+				}
+				if len(status.Events) != wantEvents {
+					t.Errorf("got %d events, want %d", len(status.Events), wantEvents)
+				}
+			})
+		})
+	}
+}
+
+func TestMessageStatusCallbacks(t *testing.T) {
+	callbackTo := "relaying.example.com"
+	tests := []struct {
+		status       string
+		wantCallback bool
+	}{
+		{MessageStatusDelivered, true},
+		{MessageStatusAcked, true},
+		{MessageStatusExpired, true},
+		{MessageStatusDropped, true},
+		{MessageStatusRelayed, false}, // means nothing to the server that relayed it
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				createTestMessageStatus(t, s, "message", "server:relaying.example.com", &callbackTo, MessageStatusAccepted)
+				if err := s.SetMessageStatus("message", tt.status, nil); err != nil {
+					t.Fatal(err)
+				}
+
+				callbacks, err := s.ClaimDueStatusCallbacks(10, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := len(callbacks) == 1; got != tt.wantCallback {
+					t.Fatalf("got %d callbacks, want a callback: %v", len(callbacks), tt.wantCallback)
+				}
+				if !tt.wantCallback {
+					return
+				}
+				if callbacks[0].Destination != callbackTo || callbacks[0].Status != tt.status {
+					t.Errorf("callback is %+v", callbacks[0])
+				}
+
+				// it's leased out, so no one else gets it until it's finished or the lease is up
+				if again, _ := s.ClaimDueStatusCallbacks(10, time.Minute); len(again) != 0 {
+					t.Errorf("claimed it twice")
+				}
+				if err := s.FinishStatusCallback(callbacks[0].Id); err != nil {
+					t.Fatal(err)
+				}
+			})
+		})
+	}
+}
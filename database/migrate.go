@@ -0,0 +1,233 @@
+package db
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are in migrations/<dialect>/, named like 0002_add_something.sql. They're applied in order, each in it's
+// own transaction, and only ever forward. Once one's been released, don't change it, add another one.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	sql     string
+}
+
+// where a migration's at on the database we're connected to
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time // nil if it hasn't been yet
+}
+
+var ErrDatabaseTooNew = errors.New("the database has been migrated by a newer version of the server")
+
+// the first table made, if it's there without a schema_version we're on a database from before migrations
+const legacyTable = "queued_messages"
+
+const createSchemaVersion = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version integer NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL,
+		PRIMARY KEY ("version")
+	)`
+
+// a store with a schema to keep up to date, the memory store doesn't have one
+type migrator interface {
+	Migrate() ([]Migration, error)
+	MigrationStatus() ([]MigrationState, error)
+}
+
+// Migrate applies every migration that hasn't been yet, and gives back the ones it applied.
+func Migrate() ([]Migration, error) {
+	if m, ok := store.(migrator); ok {
+		return m.Migrate()
+	}
+	return nil, nil
+}
+
+// MigrationStatus gives back every migration we know about, and if it's been applied.
+func MigrationStatus() ([]MigrationState, error) {
+	if m, ok := store.(migrator); ok {
+		return m.MigrationStatus()
+	}
+	return nil, nil
+}
+
+func PendingMigrations() ([]Migration, error) {
+	states, err := MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, state := range states {
+		if state.AppliedAt == nil {
+			pending = append(pending, state.Migration)
+		}
+	}
+	return pending, nil
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+func loadMigrations(dir string) ([]Migration, error) {
+	dir = "migrations/" + dir
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		versionStr, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || !strings.HasSuffix(entry.Name(), ".sql") {
+			return nil, fmt.Errorf("migration %s isn't named like 0001_name.sql", entry.Name())
+		}
+		sql, err := fs.ReadFile(migrationFiles, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, sql: string(sql)})
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of order, expected version %d", m, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+func (s *sqlStore) Migrate() ([]Migration, error) {
+	// this also checks the database isn't newer than us
+	states, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, state := range states {
+		if state.AppliedAt != nil {
+			continue
+		}
+		ran, err := s.applyMigration(state.Migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s failed: %w", state.Migration, err)
+		}
+		if ran {
+			applied = append(applied, state.Migration)
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration applies m in a transaction, holding the migration lock. ran is false if someone else got to it first.
+func (s *sqlStore) applyMigration(m Migration) (ran bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if s.dialect.lockMigrations != "" {
+		if _, err := tx.Exec(s.dialect.lockMigrations); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec(createSchemaVersion); err != nil {
+		return false, err
+	}
+
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := applied[m.Version]; ok {
+		return false, nil
+	}
+
+	if len(applied) == 0 {
+		var legacy bool
+		if err := tx.QueryRow(s.dialect.tableExists, legacyTable).Scan(&legacy); err != nil {
+			return false, err
+		}
+		if legacy {
+			log.Printf("found a database from before migrations, baselining it with %s\n", m)
+		}
+	}
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) MigrationStatus() ([]MigrationState, error) {
+	migrations, err := loadMigrations(s.dialect.migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]time.Time{}
+	var exists bool
+	if err := s.db.QueryRow(s.dialect.tableExists, "schema_version").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		if applied, err = appliedMigrations(s.db); err != nil {
+			return nil, err
+		}
+	}
+
+	for version := range applied {
+		if version > len(migrations) {
+			return nil, fmt.Errorf("%w (it's at version %d, we only know up to %d)", ErrDatabaseTooNew, version, len(migrations))
+		}
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].Migration = m
+		if at, ok := applied[m.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+func appliedMigrations(q queryer) (map[int]time.Time, error) {
+	rows, err := q.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,15 @@
+-- servers sharing this database, they check in every so often so we know which ones are still around
+CREATE TABLE IF NOT EXISTS cluster_instances (
+  instance_id VARCHAR(32) NOT NULL,
+  last_seen TIMESTAMP NOT NULL,
+  PRIMARY KEY ("instance_id")
+);
+
+-- which server each device is connected to
+CREATE TABLE IF NOT EXISTS connection_owners (
+  device_address VARCHAR(64) NOT NULL,
+  instance_id VARCHAR(32) NOT NULL REFERENCES cluster_instances (instance_id) ON DELETE CASCADE,
+  connected_at TIMESTAMP NOT NULL,
+  PRIMARY KEY ("device_address")
+);
+CREATE INDEX IF NOT EXISTS connection_owners_instance_id_idx ON connection_owners (instance_id);
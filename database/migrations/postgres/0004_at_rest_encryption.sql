@@ -0,0 +1,4 @@
+-- queued messages encrypted at rest. key_id is the key encryption key the message's data key is wrapped with
+-- (NULL isn't encrypted), and wrapped_key is that data key.
+ALTER TABLE queued_messages ADD COLUMN IF NOT EXISTS key_id VARCHAR(32);
+ALTER TABLE queued_messages ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
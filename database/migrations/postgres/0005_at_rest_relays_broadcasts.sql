@@ -0,0 +1,5 @@
+-- relay & broadcast bodies encrypted at rest, the same way as queued messages
+ALTER TABLE outbound_relays ADD COLUMN IF NOT EXISTS key_id VARCHAR(32);
+ALTER TABLE outbound_relays ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS key_id VARCHAR(32);
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
@@ -0,0 +1,152 @@
+-- the same as postgres/0001_init.sql, for sqlite. Keep the columns in the same order, some queries use SELECT *.
+-- Every migration needs one for postgres and one for sqlite, with the same version.
+
+CREATE TABLE IF NOT EXISTS queued_messages (
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP, -- NULL never expires
+  collapse_id VARCHAR(64), -- replaces queued messages with the same id
+  deliver_at TIMESTAMP, -- held back until then, NULL is right away
+
+  is_encrypted BOOLEAN NOT NULL,
+
+  -- unencrypted msg data
+  data BLOB, -- in plist
+
+  -- encrypted message data
+  ciphertext BLOB,
+  data_type VARCHAR(8),
+  iv BLOB,
+  
+  -- routing info
+  device_address VARCHAR(64) NOT NULL,
+  routing_key BLOB NOT NULL,
+  message_id VARCHAR(36) NOT NULL,
+  PRIMARY KEY ("message_id")
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+  device_address VARCHAR(64) NOT NULL,
+  pub_key BLOB NOT NULL,
+  lang VARCHAR(8) NOT NULL,
+  PRIMARY KEY ("device_address")
+);
+
+CREATE TABLE IF NOT EXISTS notification_tokens (
+  routing_token BLOB NOT NULL,
+  device_address VARCHAR(64) NOT NULL,
+  feedback_provider VARCHAR(16),
+  allowed_notification_types integer NOT NULL,
+  bundle_id VARCHAR(64) NOT NULL,
+  issued_at TIMESTAMP NOT NULL,
+  is_valid BOOLEAN NOT NULL,
+  last_used TIMESTAMP,
+  marked_for_removal_at TIMESTAMP,
+  PRIMARY KEY ("routing_token")
+);
+
+-- other server's (& ours) feedback relation to the token
+CREATE TABLE IF NOT EXISTS feedback_token (
+  feedback_key BLOB NOT NULL,
+  routing_token BLOB NOT NULL,
+  routing_domain VARCHAR(16) NOT NULL,
+  last_used TIMESTAMP NOT NULL,
+  PRIMARY KEY ("routing_token")
+);
+
+-- feedback on service's trusted server
+CREATE TABLE IF NOT EXISTS feedback_to_send (
+  feedback_key BLOB NOT NULL,
+  routing_token BLOB NOT NULL,
+  server_address VARCHAR(16) NOT NULL,
+  type integer NOT NULL, -- 1 = token deleted
+  reason VARCHAR(64),
+  created_at TIMESTAMP NOT NULL
+);
+
+-- messages waiting to be relayed to other servers
+CREATE TABLE IF NOT EXISTS outbound_relays (
+  message_id VARCHAR(36) NOT NULL,
+  destination VARCHAR(16) NOT NULL,
+  body BLOB NOT NULL, -- json sent to the destination's /send
+  status VARCHAR(16) NOT NULL, -- pending, delivered, failed, dead, expired, cancelled
+  attempts integer NOT NULL,
+  next_attempt_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP,
+  last_error TEXT,
+  remote_status VARCHAR(16), -- what the destination replied with
+  remote_reason VARCHAR(64),
+  remote_message_id VARCHAR(36),
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  PRIMARY KEY ("message_id")
+);
+CREATE INDEX IF NOT EXISTS outbound_relays_due_idx ON outbound_relays (status, next_attempt_at);
+
+-- what happened to requests sent with an idempotency key, so retries get the same answer
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  scope VARCHAR(255) NOT NULL, -- who sent it, keys from different senders don't clash
+  idempotency_key VARCHAR(255) NOT NULL,
+  request_hash BLOB NOT NULL,
+  result BLOB, -- json, null while it's still being routed
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  PRIMARY KEY ("scope", "idempotency_key")
+);
+
+-- where each message is at, for senders to check on
+CREATE TABLE IF NOT EXISTS message_status (
+  message_id VARCHAR(36) NOT NULL,
+  sender VARCHAR(255) NOT NULL, -- only they can see it
+  status VARCHAR(16) NOT NULL, -- accepted, relayed, scheduled, queued, delivered, acked, expired, dropped
+  reason TEXT,
+  callback_to VARCHAR(16), -- the server that relayed it to us, and wants to know how it went
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  PRIMARY KEY ("message_id")
+);
+CREATE INDEX IF NOT EXISTS message_status_updated_at_idx ON message_status (updated_at);
+
+CREATE TABLE IF NOT EXISTS message_status_events (
+  message_id VARCHAR(36) NOT NULL REFERENCES message_status (message_id) ON DELETE CASCADE,
+  status VARCHAR(16) NOT NULL,
+  reason TEXT,
+  at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS message_status_events_message_id_idx ON message_status_events (message_id, at);
+
+-- status changes waiting to be reported back to the server that relayed the message to us
+CREATE TABLE IF NOT EXISTS status_callbacks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  message_id VARCHAR(36) NOT NULL,
+  destination VARCHAR(16) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  reason TEXT,
+  at TIMESTAMP NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS status_callbacks_due_idx ON status_callbacks (next_attempt_at);
+
+-- a notification going to every token for an app, queued a batch at a time
+CREATE TABLE IF NOT EXISTS broadcasts (
+  broadcast_id VARCHAR(36) NOT NULL,
+  sender VARCHAR(255) NOT NULL, -- only they can see it
+  bundle_id VARCHAR(64) NOT NULL,
+  body BLOB NOT NULL, -- the notification, in json
+  status VARCHAR(16) NOT NULL, -- running, done, expired, failed
+  cursor BLOB, -- the last routing token we queued for, they're gone through in order
+  total_tokens integer NOT NULL, -- how many there were when it started
+  queued integer NOT NULL DEFAULT 0,
+  skipped integer NOT NULL DEFAULT 0, -- the user turned off everything in it
+  failed integer NOT NULL DEFAULT 0,
+  last_error TEXT,
+  lease_until TIMESTAMP, -- whoever's working on it has it until then
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  finished_at TIMESTAMP,
+  PRIMARY KEY ("broadcast_id")
+);
+CREATE INDEX IF NOT EXISTS broadcasts_running_idx ON broadcasts (lease_until) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS queued_messages_deliver_at_idx ON queued_messages (deliver_at) WHERE deliver_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS queued_messages_routing_key_idx ON queued_messages (routing_key, created_at);
+CREATE INDEX IF NOT EXISTS notification_tokens_bundle_id_idx ON notification_tokens (bundle_id, routing_token);
@@ -0,0 +1,8 @@
+-- when a device last logged in or acked something. Devices from before this count as being seen now, so they
+-- aren't all purged as soon as a retention policy is turned on.
+ALTER TABLE devices ADD COLUMN last_seen TIMESTAMP;
+UPDATE devices SET last_seen = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE last_seen IS NULL;
+
+CREATE INDEX IF NOT EXISTS devices_last_seen_idx ON devices (last_seen);
+CREATE INDEX IF NOT EXISTS notification_tokens_device_address_idx ON notification_tokens (device_address);
+CREATE INDEX IF NOT EXISTS queued_messages_created_at_idx ON queued_messages (created_at);
@@ -0,0 +1,5 @@
+-- relay & broadcast bodies encrypted at rest, the same way as queued messages
+ALTER TABLE outbound_relays ADD COLUMN key_id VARCHAR(32);
+ALTER TABLE outbound_relays ADD COLUMN wrapped_key BLOB;
+ALTER TABLE broadcasts ADD COLUMN key_id VARCHAR(32);
+ALTER TABLE broadcasts ADD COLUMN wrapped_key BLOB;
@@ -0,0 +1,2 @@
+-- when the legacy APNS feedback service handed feedback to the provider, so it isn't given to them again
+ALTER TABLE feedback_to_send ADD COLUMN legacy_delivered_at TIMESTAMP;
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// Messages waiting to be relayed to other SGN servers
+const (
+	RelayStatusPending   = "pending"
+	RelayStatusDelivered = "delivered"
+	RelayStatusFailed    = "failed"    // the other server rejected it
+	RelayStatusDead      = "dead"      // ran out of attempts
+	RelayStatusExpired   = "expired"   // the message expired before we got it there
+	RelayStatusCancelled = "cancelled" // the sender cancelled it before we got it there
+)
+
+type OutboundRelay struct {
+	MessageId     string
+	Destination   string
+	Body          []byte // the json we post to the other server's /send
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	ExpiresAt     *time.Time
+	LastError     *string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+
+	// what the destination replied with
+	RemoteStatus    *string
+	RemoteReason    *string
+	RemoteMessageId *string
+
+	// for the message's status, not kept with the relay
+	Sender           string
+	StatusCallbackTo *string
+}
+
+// a relay that's already queued (the same message relayed to us twice) is left as is
+func (s *sqlStore) QueueRelays(relays []OutboundRelay) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range relays {
+		body, keyId, wrappedKey, err := atRest.seal(relaysAtRest.aad(r.MessageId), r.Body)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO outbound_relays (message_id, destination, body, status, attempts, next_attempt_at, expires_at, created_at, updated_at, key_id, wrapped_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (message_id) DO NOTHING",
+			r.MessageId, r.Destination, body, RelayStatusPending, 0, r.NextAttemptAt, r.ExpiresAt, r.CreatedAt, r.CreatedAt, keyId, wrappedKey,
+		)
+		if err != nil {
+			return err
+		}
+		if err := createMessageStatus(tx, r.MessageId, r.Sender, r.StatusCallbackTo, MessageStatusAccepted, r.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) ClaimDueRelays(limit int, lease time.Duration) ([]OutboundRelay, error) {
+	now := time.Now()
+	rows, err := s.db.Query(`
+		UPDATE outbound_relays SET next_attempt_at = $1
+		WHERE message_id IN (
+			SELECT message_id FROM outbound_relays
+			WHERE status = $2 AND next_attempt_at <= $3
+			ORDER BY next_attempt_at
+			LIMIT $4
+			`+s.dialect.skipLocked+`
+		)
+		RETURNING message_id, destination, body, status, attempts, next_attempt_at, expires_at, last_error, created_at, updated_at, key_id, wrapped_key`,
+		now.Add(lease), RelayStatusPending, now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var relays []OutboundRelay
+	var unreadable []OutboundRelay
+	for rows.Next() {
+		var r OutboundRelay
+		var keyId *string
+		var wrappedKey []byte
+		if err := rows.Scan(&r.MessageId, &r.Destination, &r.Body, &r.Status, &r.Attempts, &r.NextAttemptAt, &r.ExpiresAt, &r.LastError, &r.CreatedAt, &r.UpdatedAt, &keyId, &wrappedKey); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if r.Body, err = atRest.open(relaysAtRest.aad(r.MessageId), r.Body, keyId, wrappedKey); err != nil {
+			log.Printf("relay %s can't be decrypted: %v\n", r.MessageId, err)
+			unreadable = append(unreadable, r)
+			continue
+		}
+		relays = append(relays, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// there's nothing to send, so they're given up on instead of being claimed again forever
+	lastError := "it couldn't be decrypted"
+	for _, r := range unreadable {
+		if err := s.FinishRelay(r.MessageId, RelayStatusDead, r.Attempts, &lastError); err != nil {
+			return nil, err
+		}
+	}
+	return relays, nil
+}
+
+func (s *sqlStore) RetryRelayAt(messageId string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	_, err := s.db.Exec("UPDATE outbound_relays SET attempts = $2, next_attempt_at = $3, last_error = $4, updated_at = $5 WHERE message_id = $1",
+		messageId, attempts, nextAttemptAt, lastError, time.Now(),
+	)
+	return err
+}
+
+func (s *sqlStore) FinishRelay(messageId string, status string, attempts int, lastError *string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// it might've been cancelled while we were trying it
+	res, err := tx.Exec("UPDATE outbound_relays SET status = $2, attempts = $3, last_error = $4, updated_at = $5 WHERE message_id = $1 AND status = $6",
+		messageId, status, attempts, lastError, time.Now(), RelayStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		return err
+	}
+
+	messageStatus := MessageStatusDropped
+	switch status {
+	case RelayStatusDelivered:
+		messageStatus = MessageStatusRelayed
+	case RelayStatusExpired:
+		messageStatus = MessageStatusExpired
+	}
+	if err := setMessageStatus(tx, messageStatus, lastError, messageId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CancelPendingRelay(messageId string) (cancelled bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	reason := "cancelled by the sender"
+	res, err := tx.Exec("UPDATE outbound_relays SET status = $2, last_error = $3, updated_at = $4 WHERE message_id = $1 AND status = $5",
+		messageId, RelayStatusCancelled, reason, time.Now(), RelayStatusPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		return false, err
+	}
+	if err := setMessageStatus(tx, MessageStatusDropped, &reason, messageId); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) GetRelay(messageId string) (*OutboundRelay, error) {
+	var r OutboundRelay
+	var keyId *string
+	var wrappedKey []byte
+	row := s.db.QueryRow("SELECT message_id, destination, body, status, attempts, next_attempt_at, expires_at, last_error, remote_status, remote_reason, remote_message_id, created_at, updated_at, key_id, wrapped_key FROM outbound_relays WHERE message_id = $1", messageId)
+	if err := row.Scan(&r.MessageId, &r.Destination, &r.Body, &r.Status, &r.Attempts, &r.NextAttemptAt, &r.ExpiresAt, &r.LastError, &r.RemoteStatus, &r.RemoteReason, &r.RemoteMessageId, &r.CreatedAt, &r.UpdatedAt, &keyId, &wrappedKey); err != nil {
+		return nil, err
+	}
+	var err error
+	if r.Body, err = atRest.open(relaysAtRest.aad(r.MessageId), r.Body, keyId, wrappedKey); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *sqlStore) RecordRelayResponse(messageId string, remoteStatus *string, remoteReason *string, remoteMessageId *string) error {
+	_, err := s.db.Exec("UPDATE outbound_relays SET remote_status = $2, remote_reason = $3, remote_message_id = $4 WHERE message_id = $1",
+		messageId, remoteStatus, remoteReason, remoteMessageId,
+	)
+	return err
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func queueTestRelay(t *testing.T, s Store, messageId string, nextAttemptAt time.Time) {
+	t.Helper()
+	err := s.QueueRelays([]OutboundRelay{{
+		MessageId:     messageId,
+		Destination:   "other.example.com",
+		Body:          []byte(`{"data":{}}`),
+		NextAttemptAt: nextAttemptAt,
+		CreatedAt:     time.Now(),
+		Sender:        "provider:test",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimDueRelays(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		now := time.Now()
+		queueTestRelay(t, s, "later", now.Add(time.Hour))
+		queueTestRelay(t, s, "second", now.Add(-time.Minute))
+		queueTestRelay(t, s, "first", now.Add(-time.Hour))
+
+		status, err := s.GetMessageStatus("first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != MessageStatusAccepted || status.Sender != "provider:test" {
+			t.Errorf("status is %s from %s, want %s from provider:test", status.Status, status.Sender, MessageStatusAccepted)
+		}
+
+		claimed, err := s.ClaimDueRelays(1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 1 || claimed[0].MessageId != "first" || string(claimed[0].Body) != `{"data":{}}` {
+			t.Fatalf("claimed %+v, want first", claimed)
+		}
+
+		// first is leased out, so it's second next, and then nothing until the lease is up
+		claimed, err = s.ClaimDueRelays(10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 1 || claimed[0].MessageId != "second" {
+			t.Fatalf("claimed %+v, want second", claimed)
+		}
+		if claimed, _ := s.ClaimDueRelays(10, time.Minute); len(claimed) != 0 {
+			t.Errorf("claimed %+v while they were leased out", claimed)
+		}
+
+		// retrying puts it back
+		if err := s.RetryRelayAt("second", 1, now.Add(-time.Second), "connection refused"); err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = s.ClaimDueRelays(10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 1 || claimed[0].Attempts != 1 || claimed[0].LastError == nil || *claimed[0].LastError != "connection refused" {
+			t.Errorf("claimed %+v, want second's retry", claimed)
+		}
+	})
+}
+
+func TestFinishRelay(t *testing.T) {
+	reason := "no such token"
+	tests := []struct {
+		relayStatus string
+		want        string
+	}{
+		{RelayStatusDelivered, MessageStatusRelayed},
+		{RelayStatusFailed, MessageStatusDropped},
+		{RelayStatusDead, MessageStatusDropped},
+		{RelayStatusExpired, MessageStatusExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.relayStatus, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				queueTestRelay(t, s, "message", time.Now())
+				if err := s.FinishRelay("message", tt.relayStatus, 1, &reason); err != nil {
+					t.Fatal(err)
+				}
+
+				relay, err := s.GetRelay("message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if relay.Status != tt.relayStatus || relay.Attempts != 1 {
+					t.Errorf("relay is %s after %d attempts, want %s after 1", relay.Status, relay.Attempts, tt.relayStatus)
+				}
+				status, err := s.GetMessageStatus("message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status.Status != tt.want {
+					t.Errorf("status is %s, want %s", status.Status, tt.want)
+				}
+
+				// finished relays aren't tried again, or cancelled
+				if claimed, _ := s.ClaimDueRelays(10, time.Minute); len(claimed) != 0 {
+					t.Errorf("claimed %+v after it was finished", claimed)
+				}
+				if cancelled, _ := s.CancelPendingRelay("message"); cancelled {
+					t.Errorf("cancelled it after it was finished")
+				}
+			})
+		})
+	}
+}
+
+func TestCancelPendingRelay(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		queueTestRelay(t, s, "message", time.Now().Add(time.Hour))
+
+		cancelled, err := s.CancelPendingRelay("message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cancelled {
+			t.Fatal("didn't cancel it")
+		}
+		if relay, _ := s.GetRelay("message"); relay == nil || relay.Status != RelayStatusCancelled {
+			t.Errorf("relay is %+v, want it cancelled", relay)
+		}
+		if status, _ := s.GetMessageStatus("message"); status == nil || status.Status != MessageStatusDropped {
+			t.Errorf("status is %+v, want it dropped", status)
+		}
+
+		// a worker that was part way through it doesn't get to finish it
+		if err := s.FinishRelay("message", RelayStatusDelivered, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if relay, _ := s.GetRelay("message"); relay == nil || relay.Status != RelayStatusCancelled {
+			t.Errorf("relay is %+v after finishing, want it still cancelled", relay)
+		}
+	})
+}
+
+func TestQueueRelaysTwice(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		queueTestRelay(t, s, "message", time.Now().Add(time.Hour))
+		if err := s.FinishRelay("message", RelayStatusDelivered, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// the same message relayed to us again is ignored, it's not sent twice
+		err := s.QueueRelays([]OutboundRelay{{MessageId: "message", Destination: "third.example.com", Body: []byte(`{}`), NextAttemptAt: time.Now(), CreatedAt: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay, err := s.GetRelay("message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if relay.Status != RelayStatusDelivered || relay.Destination != "other.example.com" {
+			t.Errorf("relay is %s to %s, want it left delivered to other.example.com", relay.Status, relay.Destination)
+		}
+		if claimed, _ := s.ClaimDueRelays(10, time.Minute); len(claimed) != 0 {
+			t.Errorf("claimed %+v, want nothing to do", claimed)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"time"
+)
+
+// Finding what's gone unused for too long, so it doesn't stay around forever.
+// Tokens are expired by whoever calls this (so the provider gets feedback), the rest is removed here.
+type RetentionStore interface {
+	TouchDevice(deviceAddress string) error
+	GetIdleTokens(idleFor time.Duration, limit int) ([]NotificationToken, error)
+	GetDormantDeviceTokens(dormantFor time.Duration, limit int) ([]NotificationToken, error)
+	PurgeDormantDevices(dormantFor time.Duration) (int64, error)
+	DropOldQueuedMessages(olderThan time.Duration) (int64, error)
+}
+
+// TouchDevice records that a device was just seen, e.g. it logged in, or is still connected.
+// Acking a message does this too, and queueing or acking one marks the token as used.
+func TouchDevice(deviceAddress string) error {
+	return store.TouchDevice(deviceAddress)
+}
+
+// GetIdleTokens gets up to limit valid tokens that haven't been sent to or acked in idleFor.
+// Tokens that have never been used go by when they were issued.
+func GetIdleTokens(idleFor time.Duration, limit int) ([]NotificationToken, error) {
+	return store.GetIdleTokens(idleFor, limit)
+}
+
+// GetDormantDeviceTokens gets up to limit valid tokens on devices that haven't been seen in dormantFor.
+func GetDormantDeviceTokens(dormantFor time.Duration, limit int) ([]NotificationToken, error) {
+	return store.GetDormantDeviceTokens(dormantFor, limit)
+}
+
+// PurgeDormantDevices removes devices that haven't been seen in dormantFor, once they don't have any tokens left.
+// A device with tokens waits for them to be removed first, so their feedback is sent.
+func PurgeDormantDevices(dormantFor time.Duration) (int64, error) {
+	return store.PurgeDormantDevices(dormantFor)
+}
+
+// DropOldQueuedMessages drops messages that have been queued for longer than olderThan, even if they'd expire later.
+// Scheduled messages aren't counted until they're released.
+func DropOldQueuedMessages(olderThan time.Duration) (int64, error) {
+	return store.DropOldQueuedMessages(olderThan)
+}
+
+// the reason old queued messages get in their status
+var droppedForAgeReason = "it was queued for longer than the server keeps messages"
+
+func (s *sqlStore) TouchDevice(deviceAddress string) error {
+	_, err := s.db.Exec("UPDATE devices SET last_seen = $1 WHERE device_address = $2", time.Now(), deviceAddress)
+	return err
+}
+
+func (s *sqlStore) GetIdleTokens(idleFor time.Duration, limit int) ([]NotificationToken, error) {
+	return s.queryTokens(`
+		SELECT routing_token, device_address, feedback_provider, allowed_notification_types, bundle_id, issued_at, is_valid, last_used, marked_for_removal_at
+		FROM notification_tokens
+		WHERE is_valid AND COALESCE(last_used, issued_at) <= $1
+		ORDER BY routing_token
+		LIMIT $2`,
+		time.Now().Add(-idleFor), limit,
+	)
+}
+
+func (s *sqlStore) GetDormantDeviceTokens(dormantFor time.Duration, limit int) ([]NotificationToken, error) {
+	return s.queryTokens(`
+		SELECT t.routing_token, t.device_address, t.feedback_provider, t.allowed_notification_types, t.bundle_id, t.issued_at, t.is_valid, t.last_used, t.marked_for_removal_at
+		FROM notification_tokens t
+		JOIN devices d ON d.device_address = t.device_address
+		WHERE t.is_valid AND d.last_seen <= $1
+		ORDER BY t.routing_token
+		LIMIT $2`,
+		time.Now().Add(-dormantFor), limit,
+	)
+}
+
+func (s *sqlStore) queryTokens(query string, args ...interface{}) ([]NotificationToken, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []NotificationToken
+	for rows.Next() {
+		var t NotificationToken
+		if err := rows.Scan(&t.RoutingToken, &t.DeviceAddress, &t.FeedbackProviderAddress, &t.NotificationType, &t.AppBundleId, &t.IssuedAt, &t.IsValid, &t.LastUsed, &t.MarkedForRemovalAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *sqlStore) PurgeDormantDevices(dormantFor time.Duration) (int64, error) {
+	res, err := s.db.Exec(`
+		DELETE FROM devices
+		WHERE last_seen <= $1 AND NOT EXISTS (SELECT 1 FROM notification_tokens t WHERE t.device_address = devices.device_address)`,
+		time.Now().Add(-dormantFor),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) DropOldQueuedMessages(olderThan time.Duration) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	dropped, err := deleteReturningIds(tx, "DELETE FROM queued_messages WHERE created_at <= $1 AND deliver_at IS NULL RETURNING message_id", time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	if err := setMessageStatus(tx, MessageStatusDropped, &droppedForAgeReason, dropped...); err != nil {
+		return 0, err
+	}
+	return int64(len(dropped)), tx.Commit()
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrScheduleFull = errors.New("too many scheduled messages for this token")
+
+// Claimed with SKIP LOCKED, so a message is only released once even with a few servers on the same database.
+func (s *sqlStore) ReleaseDueMessages(limit int) ([]QueuedMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query(`
+		UPDATE queued_messages SET created_at = $1, deliver_at = NULL
+		WHERE message_id IN (
+			SELECT message_id FROM queued_messages
+			WHERE deliver_at IS NOT NULL AND deliver_at <= $1 AND (expires_at IS NULL OR expires_at > $1)
+			ORDER BY deliver_at
+			LIMIT $2
+			`+s.dialect.skipLocked+`
+		)
+		RETURNING `+queuedMessageColumns,
+		now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []QueuedMessage
+	var ids []string
+	for rows.Next() {
+		message, err := scanQueuedMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, *message)
+		ids = append(ids, message.MessageId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := setMessageStatus(tx, MessageStatusQueued, nil, ids...); err != nil {
+		return nil, err
+	}
+	return messages, tx.Commit()
+}
+
+func (s *sqlStore) CancelScheduledMessage(messageId string) (cancelled bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	removed, err := deleteReturningIds(tx, "DELETE FROM queued_messages WHERE message_id = $1 AND deliver_at IS NOT NULL RETURNING message_id", messageId)
+	if err != nil || len(removed) == 0 {
+		return false, err
+	}
+	reason := "cancelled by the sender"
+	if err := setMessageStatus(tx, MessageStatusDropped, &reason, removed...); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReleaseDueMessages(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		deliverAt   *time.Time
+		expiresAt   *time.Time
+		wantRelease bool
+	}{
+		{name: "due", deliverAt: &past, wantRelease: true},
+		{name: "not due", deliverAt: &future},
+		{name: "due but expired", deliverAt: &past, expiresAt: &past},
+		{name: "due, expires later", deliverAt: &past, expiresAt: &future, wantRelease: true},
+		{name: "not scheduled", deliverAt: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				err := s.QueueMessages([]QueuedMessage{{
+					MessageId:     "message",
+					CreatedAt:     now.Add(-time.Hour),
+					DeliverAt:     tt.deliverAt,
+					ExpiresAt:     tt.expiresAt,
+					RoutingKey:    []byte("routing key"),
+					DeviceAddress: testDevice,
+				}}, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				releasedAt := time.Now()
+				released, err := s.ReleaseDueMessages(10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := len(released) == 1; got != tt.wantRelease {
+					t.Fatalf("released %d messages, want it released: %v", len(released), tt.wantRelease)
+				}
+				if !tt.wantRelease {
+					return
+				}
+
+				msg := released[0]
+				if msg.DeliverAt != nil {
+					t.Error("released message still has a deliver_at")
+				}
+				// polls go by created_at, so it has to look new even if the device polled after deliver_at
+				if msg.CreatedAt.Before(releasedAt) {
+					t.Errorf("created_at is %v, want the release time (after %v)", msg.CreatedAt, releasedAt)
+				}
+				if polled := queuedIds(t, s, releasedAt.Add(-time.Second)); len(polled) != 1 {
+					t.Errorf("a device that polled just before it was released got %v", polled)
+				}
+				status, err := s.GetMessageStatus("message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status.Status != MessageStatusQueued {
+					t.Errorf("status is %s, want %s", status.Status, MessageStatusQueued)
+				}
+
+				if again, _ := s.ReleaseDueMessages(10); len(again) != 0 {
+					t.Errorf("released it again")
+				}
+			})
+		})
+	}
+}
+
+func TestReleaseDueMessagesLimit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		now := time.Now()
+		// queued out of order, they're released by deliver_at
+		for _, scheduled := range []struct {
+			id  string
+			ago time.Duration
+		}{{"second", 2 * time.Minute}, {"first", time.Hour}, {"third", time.Minute}} {
+			deliverAt := now.Add(-scheduled.ago)
+			err := s.QueueMessages([]QueuedMessage{{MessageId: scheduled.id, CreatedAt: now, DeliverAt: &deliverAt, RoutingKey: []byte(scheduled.id), DeviceAddress: testDevice}}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var batches [][]string
+		for {
+			released, err := s.ReleaseDueMessages(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, msg := range released {
+				ids = append(ids, msg.MessageId)
+			}
+			slices.Sort(ids) // the order in a batch isn't up to the store
+			batches = append(batches, ids)
+			if len(released) < 2 {
+				break
+			}
+		}
+		want := [][]string{{"first", "second"}, {"third"}}
+		if !slices.EqualFunc(batches, want, slices.Equal) {
+			t.Errorf("released %v, want %v", batches, want)
+		}
+	})
+}
+
+func TestScheduleFull(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		later := time.Now().Add(time.Hour)
+		for _, id := range []string{"a", "b"} {
+			err := s.QueueMessages([]QueuedMessage{{MessageId: id, CreatedAt: time.Now(), DeliverAt: &later, RoutingKey: []byte("routing key"), DeviceAddress: testDevice}}, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := s.QueueMessages([]QueuedMessage{{MessageId: "c", CreatedAt: time.Now(), DeliverAt: &later, RoutingKey: []byte("routing key"), DeviceAddress: testDevice}}, 2)
+		if err != ErrScheduleFull {
+			t.Errorf("got %v, want ErrScheduleFull", err)
+		}
+	})
+}
+
+func TestCancelScheduledMessage(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name          string
+		deliverAt     *time.Time
+		wantCancelled bool
+		wantStatus    string
+	}{
+		{"scheduled", &later, true, MessageStatusDropped},
+		{"already queued", nil, false, MessageStatusQueued},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				err := s.QueueMessages([]QueuedMessage{{MessageId: "message", CreatedAt: time.Now(), DeliverAt: tt.deliverAt, RoutingKey: []byte("routing key"), DeviceAddress: testDevice}}, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cancelled, err := s.CancelScheduledMessage("message")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cancelled != tt.wantCancelled {
+					t.Errorf("cancelled %v, want %v", cancelled, tt.wantCancelled)
+				}
+				status, _ := s.GetMessageStatus("message")
+				if status == nil || status.Status != tt.wantStatus {
+					t.Errorf("status is %+v, want %s", status, tt.wantStatus)
+				}
+			})
+		})
+	}
+}
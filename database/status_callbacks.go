@@ -0,0 +1,60 @@
+package db
+
+import (
+	"time"
+)
+
+// A status change to report back to the server that relayed the message to us.
+type StatusCallback struct {
+	Id            int64
+	MessageId     string
+	Destination   string
+	Status        string
+	Reason        *string
+	At            time.Time
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+func (s *sqlStore) ClaimDueStatusCallbacks(limit int, lease time.Duration) ([]StatusCallback, error) {
+	now := time.Now()
+	rows, err := s.db.Query(`
+		UPDATE status_callbacks SET next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM status_callbacks
+			WHERE next_attempt_at <= $2
+			ORDER BY next_attempt_at
+			LIMIT $3
+			`+s.dialect.skipLocked+`
+		)
+		RETURNING id, message_id, destination, status, reason, at, attempts, next_attempt_at`,
+		now.Add(lease), now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var callbacks []StatusCallback
+	for rows.Next() {
+		var cb StatusCallback
+		if err := rows.Scan(&cb.Id, &cb.MessageId, &cb.Destination, &cb.Status, &cb.Reason, &cb.At, &cb.Attempts, &cb.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, cb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return callbacks, nil
+}
+
+func (s *sqlStore) RetryStatusCallbackAt(id int64, attempts int, nextAttemptAt time.Time) error {
+	_, err := s.db.Exec("UPDATE status_callbacks SET attempts = $2, next_attempt_at = $3 WHERE id = $1", id, attempts, nextAttemptAt)
+	return err
+}
+
+func (s *sqlStore) FinishStatusCallback(id int64) error {
+	_, err := s.db.Exec("DELETE FROM status_callbacks WHERE id = $1", id)
+	return err
+}
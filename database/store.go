@@ -0,0 +1,401 @@
+package db
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"time"
+)
+
+// Store is everything we keep, so it can live somewhere other than postgres.
+// The functions in this package use whichever one InitDB (or UseStore) set up.
+type Store interface {
+	QueueStore
+	DeviceStore
+	TokenStore
+	FeedbackStore
+	RelayStore
+	MessageStatusStore
+	IdempotencyStore
+	BroadcastStore
+	ClusterStore
+	RetentionStore
+}
+
+// Messages waiting for a device. Queueing, acking & expiring a message also change it's status, in the same go.
+type QueueStore interface {
+	QueueMessages(messages []QueuedMessage, queueDepth int) error
+	QueueAndDropMessages(messages []QueuedMessage, dropped []DroppedMessage, queueDepth int) error
+	AckMessage(messageId string, deviceAddress string) error
+	GetUnacknowledgedMessagesAfterUnixTime(deviceAddress string, after time.Time) ([]QueuedMessage, error)
+	PurgeExpiredMessages() (int64, error)
+	ReleaseDueMessages(limit int) ([]QueuedMessage, error)
+	CancelScheduledMessage(messageId string) (bool, error)
+	GetQueuedMessage(messageId string) (*QueuedMessage, error)
+}
+
+type DeviceStore interface {
+	SaveNewUser(deviceAddress string, publicKey rsa.PublicKey) error
+	UpdateLanguage(deviceAddress string, language string) error
+	GetUser(deviceAddress string) (*Device, error)
+}
+
+type TokenStore interface {
+	SaveNewToken(deviceAddress string, routingToken []byte, bundleId string, notificationType int) error
+	GetToken(routingToken []byte) (*NotificationToken, error)
+	GetAllTokens(deviceAddress string) (*[]NotificationToken, error)
+	SetTokenFeedbackProviderAddress(routingToken []byte, feedbackServer string) error
+	MarkTokenForRemoval(routingToken []byte) error
+	SyncTokens(removedTokens [][]byte, createdTokens []NotificationToken, modifiedTokens []NotificationToken) error
+	HideTheTracksOfKilledTokens(ourServer string) error
+	RemoveDeviceToken(routingToken []byte, serverAddress string, isOurToken bool) error
+}
+
+type FeedbackStore interface {
+	SaveNewFeedbackToken(routingToken []byte, serverAddress string, feedbackSecret []byte) error
+	GetFeedbackWithSecret(feedbackSecret []byte, after *time.Time) ([]FeedbackToSend, error)
+	GetAllFeedback() ([]FeedbackToSend, error)
+	GetTokenFeedbackKey(routingToken []byte, serverAddress string) (*[]byte, error)
+	AddFeedback(routingToken []byte, feedbackSecret []byte, serverAddress string, typeOfFeedback int, reason string) error
+	GetUndeliveredLegacyFeedback(feedbackSecret []byte) ([]FeedbackToSend, error)
+	MarkLegacyFeedbackDelivered(feedbackSecret []byte, upTo time.Time) error
+}
+
+type RelayStore interface {
+	QueueRelays(relays []OutboundRelay) error
+	ClaimDueRelays(limit int, lease time.Duration) ([]OutboundRelay, error)
+	RetryRelayAt(messageId string, attempts int, nextAttemptAt time.Time, lastError string) error
+	FinishRelay(messageId string, status string, attempts int, lastError *string) error
+	CancelPendingRelay(messageId string) (bool, error)
+	GetRelay(messageId string) (*OutboundRelay, error)
+	RecordRelayResponse(messageId string, remoteStatus *string, remoteReason *string, remoteMessageId *string) error
+}
+
+type MessageStatusStore interface {
+	SetMessageStatus(messageId string, status string, reason *string) error
+	GetMessageStatus(messageId string) (*MessageStatus, error)
+	PurgeOldMessageStatuses(olderThan time.Duration) (int64, error)
+	ClaimDueStatusCallbacks(limit int, lease time.Duration) ([]StatusCallback, error)
+	RetryStatusCallbackAt(id int64, attempts int, nextAttemptAt time.Time) error
+	FinishStatusCallback(id int64) error
+}
+
+type IdempotencyStore interface {
+	ClaimIdempotencyKey(scope string, key string, requestHash []byte, lease time.Duration) (bool, *IdempotencyKey, error)
+	FinishIdempotencyKey(scope string, key string, result []byte, window time.Duration) error
+	ReleaseIdempotencyKey(scope string, key string) error
+	PurgeExpiredIdempotencyKeys() (int64, error)
+}
+
+type BroadcastStore interface {
+	CreateBroadcast(b Broadcast) (*Broadcast, error)
+	GetBroadcast(broadcastId string) (*Broadcast, error)
+	ClaimBroadcast(lease time.Duration) (*Broadcast, error)
+	GetBroadcastTokens(bundleId string, cursor []byte, limit int) ([]NotificationToken, error)
+	QueueBroadcastBatch(broadcastId string, messages []QueuedMessage, queueDepth int, progress BroadcastProgress, lease time.Duration) error
+	UpdateBroadcastProgress(broadcastId string, progress BroadcastProgress, lease time.Duration) error
+	FinishBroadcast(broadcastId string, status string, lastError *string) error
+	PurgeOldBroadcasts(olderThan time.Duration) (int64, error)
+}
+
+var store Store
+
+// InitDB opens the store. dbType is postgres, sqlite or memory. For postgres the dsn is a connection string,
+// for sqlite it's the path to the database file, and memory doesn't need one (everything's gone when we stop).
+func InitDB(dbType string, dsn string) {
+	var err error
+	switch dbType {
+	case "", "postgres":
+		store, err = openSQLStore(postgresDialect, dsn)
+	case "sqlite":
+		store, err = openSQLStore(sqliteDialect, sqliteDSN(dsn))
+	case "memory":
+		store = NewMemoryStore()
+	default:
+		err = fmt.Errorf("unknown DB_TYPE %q, it should be postgres, sqlite or memory", dbType)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// UseStore swaps the store out, e.g. for a memory store in tests.
+func UseStore(s Store) {
+	store = s
+}
+
+// queue
+
+// queueDepth is how many messages we keep per token, the oldest ones get dropped first.
+func QueueEncryptedMessage(m QueuedMessage, queueDepth int) error {
+	m.IsEncrypted = true
+	return QueueMessages([]QueuedMessage{m}, queueDepth)
+}
+
+func QueueUnencryptedMessage(m QueuedMessage, queueDepth int) error {
+	m.IsEncrypted = false
+	return QueueMessages([]QueuedMessage{m}, queueDepth)
+}
+
+// QueueMessages queues a batch of messages in one transaction, either all of them are queued or none are.
+// A message id we already have is ignored, relayed messages keep their id so the same one can come in twice.
+func QueueMessages(messages []QueuedMessage, queueDepth int) error {
+	return store.QueueMessages(messages, queueDepth)
+}
+
+// QueueAndDropMessages is QueueMessages, with the dropped messages getting their status in the same transaction.
+func QueueAndDropMessages(messages []QueuedMessage, dropped []DroppedMessage, queueDepth int) error {
+	return store.QueueAndDropMessages(messages, dropped, queueDepth)
+}
+
+func AckMessage(messageId string, deviceAddress string) error {
+	return store.AckMessage(messageId, deviceAddress)
+}
+
+func GetUnacknowledgedMessages(deviceAddress string) ([]QueuedMessage, error) {
+	return GetUnacknowledgedMessagesAfterUnixTime(deviceAddress, time.Unix(0, 0))
+}
+
+// Scheduled messages aren't given back until they're released.
+func GetUnacknowledgedMessagesAfterUnixTime(deviceAddress string, after time.Time) ([]QueuedMessage, error) {
+	return store.GetUnacknowledgedMessagesAfterUnixTime(deviceAddress, after)
+}
+
+func PurgeExpiredMessages() (int64, error) {
+	return store.PurgeExpiredMessages()
+}
+
+// GetQueuedMessage gets a message that's still queued, sql.ErrNoRows if it isn't (it was acked, expired, ...).
+func GetQueuedMessage(messageId string) (*QueuedMessage, error) {
+	return store.GetQueuedMessage(messageId)
+}
+
+// ReleaseDueMessages stops holding back scheduled messages that are due, up to limit of them, and gives them back so
+// they can be sent to anyone connected. They get when they were released as their created_at, so polls see them as new,
+// even if the device polled between their deliver_at and now.
+func ReleaseDueMessages(limit int) ([]QueuedMessage, error) {
+	return store.ReleaseDueMessages(limit)
+}
+
+// CancelScheduledMessage removes a message that hasn't been released yet. cancelled is false if there wasn't one
+// (it was already released, or never scheduled).
+func CancelScheduledMessage(messageId string) (cancelled bool, err error) {
+	return store.CancelScheduledMessage(messageId)
+}
+
+// devices
+
+func SaveNewUser(deviceAddress string, publicKey rsa.PublicKey) error {
+	return store.SaveNewUser(deviceAddress, publicKey)
+}
+
+func UpdateLanguage(deviceAddress string, language string) error {
+	return store.UpdateLanguage(deviceAddress, language)
+}
+
+func GetUser(deviceAddress string) (*Device, error) {
+	return store.GetUser(deviceAddress)
+}
+
+// tokens
+
+func SaveNewToken(deviceAddress string, routingToken []byte, bundleId string, notificationType int) error {
+	return store.SaveNewToken(deviceAddress, routingToken, bundleId, notificationType)
+}
+
+func GetToken(routingToken []byte) (*NotificationToken, error) {
+	return store.GetToken(routingToken)
+}
+
+func GetAllTokens(deviceAddress string) (*[]NotificationToken, error) {
+	return store.GetAllTokens(deviceAddress)
+}
+
+func SetTokenFeedbackProviderAddress(routingToken []byte, feedbackServer string) error {
+	return store.SetTokenFeedbackProviderAddress(routingToken, feedbackServer)
+}
+
+func MarkTokenForRemoval(routingToken []byte) error {
+	return store.MarkTokenForRemoval(routingToken)
+}
+
+func SyncTokens(removedTokens [][]byte, createdTokens []NotificationToken, modifiedTokens []NotificationToken) error {
+	return store.SyncTokens(removedTokens, createdTokens, modifiedTokens)
+}
+
+func HideTheTracksOfKilledTokens(ourServer string) error {
+	return store.HideTheTracksOfKilledTokens(ourServer)
+}
+
+func RemoveDeviceToken(routingToken []byte, serverAddress string, isOurToken bool) error {
+	return store.RemoveDeviceToken(routingToken, serverAddress, isOurToken)
+}
+
+// feedback
+
+func SaveNewFeedbackToken(routingToken []byte, serverAddress string, feedbackSecret []byte) error {
+	return store.SaveNewFeedbackToken(routingToken, serverAddress, feedbackSecret)
+}
+
+func GetFeedbackWithSecret(feedbackSecret []byte, after *time.Time) ([]FeedbackToSend, error) {
+	return store.GetFeedbackWithSecret(feedbackSecret, after)
+}
+
+func GetAllFeedback() ([]FeedbackToSend, error) {
+	return store.GetAllFeedback()
+}
+
+func GetTokenFeedbackKey(routingToken []byte, serverAddress string) (*[]byte, error) {
+	return store.GetTokenFeedbackKey(routingToken, serverAddress)
+}
+
+func AddFeedback(routingToken []byte, feedbackSecret []byte, serverAddress string, typeOfFeedback int, reason string) error {
+	return store.AddFeedback(routingToken, feedbackSecret, serverAddress, typeOfFeedback, reason)
+}
+
+// GetUndeliveredLegacyFeedback gets the feedback for a key that the legacy APNS feedback service hasn't given out yet, oldest first.
+func GetUndeliveredLegacyFeedback(feedbackSecret []byte) ([]FeedbackToSend, error) {
+	return store.GetUndeliveredLegacyFeedback(feedbackSecret)
+}
+
+// MarkLegacyFeedbackDelivered records that the legacy APNS feedback service gave out a key's feedback, up to (and
+// including) what was created at upTo.
+func MarkLegacyFeedbackDelivered(feedbackSecret []byte, upTo time.Time) error {
+	return store.MarkLegacyFeedbackDelivered(feedbackSecret, upTo)
+}
+
+// relays
+
+func QueueRelay(r OutboundRelay) error {
+	return QueueRelays([]OutboundRelay{r})
+}
+
+// QueueRelays queues a batch of relays in one transaction, either all of them are queued or none are.
+func QueueRelays(relays []OutboundRelay) error {
+	return store.QueueRelays(relays)
+}
+
+// ClaimDueRelays takes up to limit relays that are due, and pushes their next attempt back by lease,
+// so if we die halfway through someone else picks them up later.
+func ClaimDueRelays(limit int, lease time.Duration) ([]OutboundRelay, error) {
+	return store.ClaimDueRelays(limit, lease)
+}
+
+func RetryRelayAt(messageId string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	return store.RetryRelayAt(messageId, attempts, nextAttemptAt, lastError)
+}
+
+// FinishRelay records the final outcome, we won't try it again after this.
+func FinishRelay(messageId string, status string, attempts int, lastError *string) error {
+	return store.FinishRelay(messageId, status, attempts, lastError)
+}
+
+// CancelPendingRelay stops a relay we haven't delivered yet. cancelled is false if it isn't pending.
+func CancelPendingRelay(messageId string) (cancelled bool, err error) {
+	return store.CancelPendingRelay(messageId)
+}
+
+func GetRelay(messageId string) (*OutboundRelay, error) {
+	return store.GetRelay(messageId)
+}
+
+// RecordRelayResponse keeps what the destination replied with, for the sender to look at.
+func RecordRelayResponse(messageId string, remoteStatus *string, remoteReason *string, remoteMessageId *string) error {
+	return store.RecordRelayResponse(messageId, remoteStatus, remoteReason, remoteMessageId)
+}
+
+// message statuses
+
+func SetMessageStatus(messageId string, status string, reason *string) error {
+	return store.SetMessageStatus(messageId, status, reason)
+}
+
+// DropUnqueuedMessage records a message that was dropped without ever being queued, like a deliver once message for
+// a device that isn't connected.
+func DropUnqueuedMessage(messageId string, sender string, reason string) error {
+	return store.QueueAndDropMessages(nil, []DroppedMessage{{MessageId: messageId, Sender: sender, Reason: reason}}, 0)
+}
+
+func GetMessageStatus(messageId string) (*MessageStatus, error) {
+	return store.GetMessageStatus(messageId)
+}
+
+// PurgeOldMessageStatuses forgets about messages that haven't changed in a while.
+func PurgeOldMessageStatuses(olderThan time.Duration) (int64, error) {
+	return store.PurgeOldMessageStatuses(olderThan)
+}
+
+// ClaimDueStatusCallbacks is ClaimDueRelays, but for status callbacks.
+func ClaimDueStatusCallbacks(limit int, lease time.Duration) ([]StatusCallback, error) {
+	return store.ClaimDueStatusCallbacks(limit, lease)
+}
+
+func RetryStatusCallbackAt(id int64, attempts int, nextAttemptAt time.Time) error {
+	return store.RetryStatusCallbackAt(id, attempts, nextAttemptAt)
+}
+
+// FinishStatusCallback is for when it was delivered, or we gave up on it.
+func FinishStatusCallback(id int64) error {
+	return store.FinishStatusCallback(id)
+}
+
+// idempotency keys
+
+// ClaimIdempotencyKey takes a key for a request, for lease. If it isn't finished by then (whoever had it crashed or
+// hung), the next request with the key takes it over. If someone already has it, it gives back theirs instead.
+func ClaimIdempotencyKey(scope string, key string, requestHash []byte, lease time.Duration) (claimed bool, existing *IdempotencyKey, err error) {
+	return store.ClaimIdempotencyKey(scope, key, requestHash, lease)
+}
+
+// FinishIdempotencyKey saves what happened to the request, and keeps the key for window from now.
+func FinishIdempotencyKey(scope string, key string, result []byte, window time.Duration) error {
+	return store.FinishIdempotencyKey(scope, key, result, window)
+}
+
+// ReleaseIdempotencyKey lets a key be used again, for when the request failed in a way that's worth retrying.
+func ReleaseIdempotencyKey(scope string, key string) error {
+	return store.ReleaseIdempotencyKey(scope, key)
+}
+
+func PurgeExpiredIdempotencyKeys() (int64, error) {
+	return store.PurgeExpiredIdempotencyKeys()
+}
+
+// broadcasts
+
+// CreateBroadcast saves a broadcast for the broadcast worker to pick up, with how many tokens it's going to.
+func CreateBroadcast(b Broadcast) (*Broadcast, error) {
+	return store.CreateBroadcast(b)
+}
+
+func GetBroadcast(broadcastId string) (*Broadcast, error) {
+	return store.GetBroadcast(broadcastId)
+}
+
+// ClaimBroadcast takes a running broadcast nobody else is working on, for lease. nil if there aren't any.
+func ClaimBroadcast(lease time.Duration) (*Broadcast, error) {
+	return store.ClaimBroadcast(lease)
+}
+
+// GetBroadcastTokens gets the next batch of valid tokens for an app, after the token at cursor (nil to start).
+func GetBroadcastTokens(bundleId string, cursor []byte, limit int) ([]NotificationToken, error) {
+	return store.GetBroadcastTokens(bundleId, cursor, limit)
+}
+
+// QueueBroadcastBatch queues a batch of a broadcast's messages, and saves how far it got, in one transaction.
+// If we stop half way through, it picks up after the last batch without sending anything twice.
+func QueueBroadcastBatch(broadcastId string, messages []QueuedMessage, queueDepth int, progress BroadcastProgress, lease time.Duration) error {
+	return store.QueueBroadcastBatch(broadcastId, messages, queueDepth, progress, lease)
+}
+
+// UpdateBroadcastProgress saves how far a broadcast got, for when the batch was queued some other way.
+func UpdateBroadcastProgress(broadcastId string, progress BroadcastProgress, lease time.Duration) error {
+	return store.UpdateBroadcastProgress(broadcastId, progress, lease)
+}
+
+func FinishBroadcast(broadcastId string, status string, lastError *string) error {
+	return store.FinishBroadcast(broadcastId, status, lastError)
+}
+
+func PurgeOldBroadcasts(olderThan time.Duration) (int64, error) {
+	return store.PurgeOldBroadcasts(olderThan)
+}
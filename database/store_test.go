@@ -0,0 +1,43 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// forEachStore runs a test on a fresh memory store and a fresh sqlite store, as they should behave the same.
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) { test(t, newTestSQLiteStore(t)) })
+}
+
+func newTestSQLiteStore(t *testing.T) *sqlStore {
+	t.Helper()
+	s, err := openSQLStore(sqliteDialect, sqliteDSN(filepath.Join(t.TempDir(), "sgn.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	if _, err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// createTestMessageStatus starts a message off at any status, where the stores only start them at a few.
+func createTestMessageStatus(t *testing.T, s Store, messageId string, sender string, callbackTo *string, status string) {
+	t.Helper()
+	switch s := s.(type) {
+	case *memoryStore:
+		s.mu.Lock()
+		s.createMessageStatus(messageId, sender, callbackTo, status, time.Now())
+		s.mu.Unlock()
+	case *sqlStore:
+		if err := createMessageStatus(s.db, messageId, sender, callbackTo, status, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("don't know how to make a status in a %T", s)
+	}
+}
@@ -0,0 +1,193 @@
+// Finding other SGN servers from their server address, through the _sgn TXT record.
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+)
+
+var ErrServerNotFound = errors.New("server could not be found")
+
+type ServerTXT struct {
+	TCPAddress  string
+	TCPPort     int
+	HTTPAddress string
+}
+
+// Resolver finds where a server lives. Swap it out with SetResolver for tests.
+type Resolver interface {
+	Resolve(server string) (ServerTXT, error)
+}
+
+var (
+	resolver   Resolver = DNSResolver{}
+	resolverMu sync.RWMutex
+)
+
+// Init sets up the default resolver from the config: static peers, then cached DNS.
+func Init(c configPkg.Config) {
+	static := StaticResolver{}
+	for server, peer := range c.StaticPeers {
+		static[strings.ToLower(server)] = ServerTXT{
+			TCPAddress:  peer.TCPAddress,
+			TCPPort:     peer.TCPPort,
+			HTTPAddress: peer.HTTPAddress,
+		}
+	}
+
+	SetResolver(NewCachingResolver(
+		chainResolver{static, DNSResolver{}},
+		c.DiscoveryCacheTTL,
+		c.DiscoveryNegativeCacheTTL,
+	))
+}
+
+func SetResolver(r Resolver) {
+	resolverMu.Lock()
+	resolver = r
+	resolverMu.Unlock()
+}
+
+// Lookup finds a server with the current resolver.
+func Lookup(server string) (ServerTXT, error) {
+	resolverMu.RLock()
+	r := resolver
+	resolverMu.RUnlock()
+	return r.Resolve(strings.ToLower(server))
+}
+
+// DNSResolver looks up _sgn.{server}
+type DNSResolver struct{}
+
+func (DNSResolver) Resolve(server string) (ServerTXT, error) {
+	txts, err := net.LookupTXT(fmt.Sprintf("_sgn.%s", server))
+	if err != nil {
+		return ServerTXT{}, fmt.Errorf("failed to lookup txt record: %w", err)
+	}
+
+	for _, txt := range txts {
+		serverData, err := ParseServerTXT(txt)
+		if err == nil && serverData.HTTPAddress != "" {
+			return serverData, nil
+		}
+	}
+	return ServerTXT{}, ErrServerNotFound
+}
+
+// StaticResolver is a fixed list of servers, for private or test deployments.
+type StaticResolver map[string]ServerTXT
+
+func (s StaticResolver) Resolve(server string) (ServerTXT, error) {
+	if serverData, ok := s[server]; ok {
+		return serverData, nil
+	}
+	return ServerTXT{}, ErrServerNotFound
+}
+
+// chainResolver tries each resolver until one finds the server.
+type chainResolver []Resolver
+
+func (c chainResolver) Resolve(server string) (ServerTXT, error) {
+	err := ErrServerNotFound
+	for _, r := range c {
+		var serverData ServerTXT
+		if serverData, err = r.Resolve(server); err == nil {
+			return serverData, nil
+		}
+	}
+	return ServerTXT{}, err
+}
+
+type cacheEntry struct {
+	serverData ServerTXT
+	err        error
+	expiresAt  time.Time
+}
+
+// CachingResolver remembers what the resolver under it found, and what it didn't.
+type CachingResolver struct {
+	next        Resolver
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+
+	cache   map[string]cacheEntry
+	cacheMu sync.Mutex
+}
+
+func NewCachingResolver(next Resolver, positiveTTL time.Duration, negativeTTL time.Duration) *CachingResolver {
+	return &CachingResolver{
+		next:        next,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		cache:       map[string]cacheEntry{},
+	}
+}
+
+func (c *CachingResolver) Resolve(server string) (ServerTXT, error) {
+	c.cacheMu.Lock()
+	entry, ok := c.cache[server]
+	c.cacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.serverData, entry.err
+	}
+
+	serverData, err := c.next.Resolve(server)
+
+	ttl := c.positiveTTL
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl > 0 {
+		c.cacheMu.Lock()
+		c.cache[server] = cacheEntry{serverData: serverData, err: err, expiresAt: time.Now().Add(ttl)}
+		c.cacheMu.Unlock()
+	}
+	return serverData, err
+}
+
+func ParseServerTXT(input string) (ServerTXT, error) {
+	var result ServerTXT
+
+	// Split the input by spaces to get key-value pairs
+	parts := strings.Fields(input)
+
+	for _, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return result, fmt.Errorf("invalid format in part: %s", part)
+		}
+
+		key := kv[0]
+		value := kv[1]
+
+		switch key {
+		case "tcp_addr":
+			// we never connect to this ourselves, it's only handed to devices
+			result.TCPAddress = value
+		case "tcp_port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return result, fmt.Errorf("invalid TCP port: %v", err)
+			}
+			result.TCPPort = port
+		case "http_addr":
+			// what it resolves to is checked by the egress policy in federation, when we connect
+			u, err := url.Parse(value)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+				return result, fmt.Errorf("invalid HTTP address: %s", value)
+			}
+			result.HTTPAddress = strings.TrimSuffix(value, "/")
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,249 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+)
+
+// Every request we make to another server goes through here. The addresses come from DNS records anyone can publish,
+// so without this someone could point their _sgn record at our loopback, LAN or cloud metadata service.
+
+var (
+	ErrInsecureScheme    = errors.New("other servers must be reached over https")
+	ErrBadDestination    = errors.New("destination url is invalid")
+	ErrBlockedAddress    = errors.New("destination address is not allowed")
+	ErrResponseTooLarge  = errors.New("response from other server is too large")
+	ErrRedirectsDisabled = errors.New("other servers can't redirect us")
+)
+
+// always blocked unless they're in FEDERATION_ALLOWED_NETWORKS
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier grade nat, also alibaba's metadata service
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local, also most clouds' metadata service
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // ietf protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved, and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // nat64, can reach any ipv4 address
+	"100::/64",        // discard
+	"2001:db8::/32",   // documentation
+	"fc00::/7",        // unique local, also aws' ipv6 metadata service
+	"fe80::/10",       // link local
+	"ff00::/8",        // multicast
+)
+
+type egressPolicy struct {
+	allowHTTP       bool
+	allowed         []*net.IPNet
+	maxResponseSize int64
+}
+
+var (
+	policy = egressPolicy{maxResponseSize: 64 * 1024}
+	client = newEgressClient(10 * time.Second)
+)
+
+func initEgress(c configPkg.Config) error {
+	allowed, err := parseCIDRs(c.FederationAllowedNetworks)
+	if err != nil {
+		return fmt.Errorf("invalid FEDERATION_ALLOWED_NETWORKS: %w", err)
+	}
+	policy = egressPolicy{
+		allowHTTP:       c.FederationAllowHTTP,
+		allowed:         allowed,
+		maxResponseSize: c.FederationMaxResponseSize,
+	}
+	client = newEgressClient(c.FederationTimeout)
+	return nil
+}
+
+func newEgressClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// checked again on the address we actually connect to, in case anything got past dialVetted
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isAllowedIP(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil, // a proxy would do the dns lookup for us, and we couldn't check it
+			DialContext:           dialVetted(dialer),
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return ErrRedirectsDisabled
+		},
+	}
+}
+
+// dialVetted resolves the host itself, and connects to an address that passed the policy.
+// We dial the ip directly, so a second dns lookup can't swap it for something else (dns rebinding).
+func dialVetted(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error = fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+		for _, ip := range ips {
+			if !isAllowedIP(ip.IP) {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+func isAllowedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range policy.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPolicyError reports if a request failed because the egress policy wouldn't let it through.
+func IsPolicyError(err error) bool {
+	return errors.Is(err, ErrInsecureScheme) || errors.Is(err, ErrBadDestination) || errors.Is(err, ErrBlockedAddress)
+}
+
+// checkDestination makes sure a url is somewhere we're willing to send a request to, before we resolve it.
+func checkDestination(u *url.URL) error {
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !policy.allowHTTP {
+			return ErrInsecureScheme
+		}
+	default:
+		return ErrBadDestination
+	}
+	if u.Hostname() == "" || u.User != nil {
+		return ErrBadDestination
+	}
+	return nil
+}
+
+// do sends a request to another server with the egress policy applied.
+func do(req *http.Request) (*http.Response, error) {
+	if err := checkDestination(req.URL); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if policy.maxResponseSize > 0 {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: policy.maxResponseSize}
+	}
+	return resp, nil
+}
+
+// limitedBody is like io.LimitReader, but it's an error to go over the limit instead of a short read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// see if there's anything past the limit
+		var probe [1]byte
+		if n, _ := b.ReadCloser.Read(probe[:]); n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// let people put in single addresses
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, err
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
@@ -0,0 +1,285 @@
+// Signing & verifying requests between SGN servers, so they can't be spoofed.
+//
+// Requests are signed with the server's TLS key, and carry these headers:
+//   X-SGN-Origin: the server address of the sender
+//   X-SGN-Timestamp: unix time the request was signed at
+//   X-SGN-Signature: base64 signature of signedData()
+// The signature covers the server it's going to, so a request signed for one server can't be sent to another.
+// The receiver verifies it with the cert the origin serves at /snd/server_cert.pem, found through it's _sgn TXT record,
+// if it's peer policy lets them talk to us. A signed request is only accepted once, see replay.go.
+//
+// V2 added the destination. V1 signatures aren't accepted, since they could be sent to any server, so servers signing
+// the old way have their signed requests rejected until they update.
+
+package federation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/peerpolicy"
+)
+
+const (
+	HeaderOrigin    = "X-SGN-Origin"
+	HeaderTimestamp = "X-SGN-Timestamp"
+	HeaderSignature = "X-SGN-Signature"
+
+	maxClockSkew = 5 * time.Minute
+	certCacheTTL = time.Hour
+	// a bad signature can mean the origin rotated it's key, but we only go get it's cert again this often, or
+	// anyone could make us fetch it on every request. Failed fetches are remembered for this long too.
+	certRefetchInterval = time.Minute
+	// the origin header can say anything, so the cache is bounded. Past this, the cert fetched longest ago is dropped
+	maxCachedCerts = 1024
+)
+
+var (
+	ErrNotSigned         = errors.New("request is not signed")
+	ErrBadTimestamp      = errors.New("request timestamp is too far off")
+	ErrBadSignature      = errors.New("request signature is invalid")
+	ErrOriginCertMissing = errors.New("could not get the origin's certificate")
+	ErrReplayed          = errors.New("request has already been seen")
+	ErrOriginDenied      = fmt.Errorf("origin isn't allowed to federate with us: %w", peerpolicy.ErrDenied)
+)
+
+var (
+	serverAddress string
+	signer        crypto.Signer
+
+	certCache   = map[string]cachedCert{}
+	certCacheMu sync.Mutex
+)
+
+type cachedCert struct {
+	cert      *x509.Certificate
+	err       error // the fetch failed
+	fetchedAt time.Time
+}
+
+func Init(keys configPkg.CryptoKeys, c configPkg.Config) error {
+	serverAddress = c.ServerAddress
+
+	var ok bool
+	signer, ok = keys.ServerTLSCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("server private key can't be used for signing")
+	}
+	return initEgress(c)
+}
+
+func signedData(origin string, destination string, timestamp string, method string, path string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("SGN-FED-V2\n%s\n%s\n%s\n%s %s\n%s", origin, strings.ToLower(destination), timestamp, method, path, hex.EncodeToString(bodyHash[:])))
+}
+
+// SignRequest adds our signature headers to a request going to destination, the other server's address.
+func SignRequest(req *http.Request, destination string, body []byte) error {
+	if signer == nil {
+		return errors.New("federation signing isn't initialized")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := sha256.Sum256(signedData(serverAddress, destination, timestamp, req.Method, req.URL.Path, body))
+
+	var opts crypto.SignerOpts = crypto.SHA256
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	case ed25519.PublicKey:
+		return errors.New("ed25519 keys aren't supported for federation")
+	}
+
+	signature, err := signer.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HeaderOrigin, serverAddress)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// Post is http.Post, but signed for destination, and only to places the egress policy allows.
+func Post(destination string, url string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if err := SignRequest(req, destination, body); err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+// Delete is a signed DELETE, with the same rules as Post.
+func Delete(destination string, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := SignRequest(req, destination, nil); err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+// IsSigned reports if the request claims to be signed at all.
+func IsSigned(getHeader func(string) string) bool {
+	return getHeader(HeaderSignature) != "" || getHeader(HeaderOrigin) != ""
+}
+
+// VerifyRequest checks the signature on a request from another server, and returns the origin it was signed by.
+func VerifyRequest(method string, path string, getHeader func(string) string, body []byte) (string, error) {
+	origin := getHeader(HeaderOrigin)
+	timestampStr := getHeader(HeaderTimestamp)
+	signatureStr := getHeader(HeaderSignature)
+	if origin == "" || timestampStr == "" || signatureStr == "" {
+		return "", ErrNotSigned
+	}
+
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return "", ErrBadTimestamp
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if time.Since(signedAt) > maxClockSkew || time.Until(signedAt) > maxClockSkew {
+		return "", ErrBadTimestamp
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signatureStr)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+
+	// don't go fetching certs for servers that couldn't get in anyway
+	if peerpolicy.For(origin).Action == peerpolicy.ActionDeny {
+		return "", ErrOriginDenied
+	}
+
+	cert, err := getOriginCert(origin, false)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOriginCertMissing, err)
+	}
+
+	// it has to have been signed for us
+	digest := sha256.Sum256(signedData(origin, serverAddress, timestampStr, method, path, body))
+	if !verifySignature(cert.PublicKey, digest[:], signature) {
+		// they might have rotated their key, so try again with a fresh cert before giving up
+		cert, err = getOriginCert(origin, true)
+		if err != nil || !verifySignature(cert.PublicKey, digest[:], signature) {
+			return "", ErrBadSignature
+		}
+	}
+
+	// the signature's good until the timestamp is too old, so it can only be used once until then
+	if !rememberSignedRequest(digest, signedAt.Add(maxClockSkew)) {
+		return "", ErrReplayed
+	}
+
+	return origin, nil
+}
+
+func verifySignature(publicKey interface{}, digest []byte, signature []byte) bool {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(key, crypto.SHA256, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest, signature)
+	default:
+		return false
+	}
+}
+
+// getOriginCert gets the cert origin signs with. refresh fetches it again, unless that was done in the last
+// certRefetchInterval.
+func getOriginCert(origin string, refresh bool) (*x509.Certificate, error) {
+	origin = strings.ToLower(origin)
+	certCacheMu.Lock()
+	cached, ok := certCache[origin]
+	certCacheMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < certRefetchInterval {
+		return cached.cert, cached.err
+	}
+	if ok && !refresh && cached.err == nil && time.Since(cached.fetchedAt) < certCacheTTL {
+		return cached.cert, nil
+	}
+
+	cert, err := fetchOriginCert(origin)
+	cached = cachedCert{cert: cert, err: err, fetchedAt: time.Now()}
+
+	certCacheMu.Lock()
+	cacheCert(origin, cached)
+	certCacheMu.Unlock()
+	return cached.cert, cached.err
+}
+
+// cacheCert adds a cert to the cache, making room for it if it's full. certCacheMu has to be held.
+func cacheCert(origin string, cached cachedCert) {
+	if _, ok := certCache[origin]; !ok && len(certCache) >= maxCachedCerts {
+		oldest := ""
+		for cachedOrigin, c := range certCache {
+			if time.Since(c.fetchedAt) >= certCacheTTL {
+				// it'd be fetched again anyway
+				delete(certCache, cachedOrigin)
+			} else if oldest == "" || c.fetchedAt.Before(certCache[oldest].fetchedAt) {
+				oldest = cachedOrigin
+			}
+		}
+		if len(certCache) >= maxCachedCerts {
+			delete(certCache, oldest)
+		}
+	}
+	certCache[origin] = cached
+}
+
+func fetchOriginCert(origin string) (*x509.Certificate, error) {
+	serverData, err := discovery.Lookup(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/snd/server_cert.pem", serverData.HTTPAddress), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching certificate", resp.StatusCode)
+	}
+	pemBytes, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("server cert is not a PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
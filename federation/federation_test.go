@@ -0,0 +1,119 @@
+package federation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Preloading/SkyglowNotificationServer/peerpolicy"
+)
+
+// useTestSigner signs as origin.example.com with a new key, with it's cert already cached so nothing's fetched.
+// Everything's put back after.
+func useTestSigner(t *testing.T) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "origin.example.com"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedSigner, savedAddress := signer, serverAddress
+	certCacheMu.Lock()
+	savedCache := certCache
+	certCache = map[string]cachedCert{"origin.example.com": {cert: cert, fetchedAt: time.Now()}}
+	certCacheMu.Unlock()
+	signer, serverAddress = key, "origin.example.com"
+
+	t.Cleanup(func() {
+		signer, serverAddress = savedSigner, savedAddress
+		certCacheMu.Lock()
+		certCache = savedCache
+		certCacheMu.Unlock()
+		peerpolicy.Use(map[string]peerpolicy.Policy{})
+	})
+}
+
+func TestVerifyRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string // who it's signed for
+		receiver    string // who's checking it
+		policies    map[string]peerpolicy.Policy
+		want        error
+	}{
+		{name: "signed for us", destination: "sgn.example.com", receiver: "sgn.example.com"},
+		{name: "any case", destination: "SGN.example.com", receiver: "sgn.example.com"},
+		{name: "signed for someone else", destination: "third.example.com", receiver: "sgn.example.com", want: ErrBadSignature},
+		{name: "origin denied", destination: "sgn.example.com", receiver: "sgn.example.com", policies: map[string]peerpolicy.Policy{"origin.example.com": {Action: peerpolicy.ActionDeny}}, want: ErrOriginDenied},
+		{name: "everyone denied", destination: "sgn.example.com", receiver: "sgn.example.com", policies: map[string]peerpolicy.Policy{"*": {Action: peerpolicy.ActionDeny}}, want: peerpolicy.ErrDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestSigner(t)
+			peerpolicy.Use(tt.policies)
+
+			body := []byte(tt.name) // so it isn't a replay of another test's
+			req, err := http.NewRequest(http.MethodPost, "https://sgn.example.com/send", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := SignRequest(req, tt.destination, body); err != nil {
+				t.Fatal(err)
+			}
+
+			serverAddress = tt.receiver
+			origin, err := VerifyRequest(http.MethodPost, "/send", req.Header.Get, body)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && origin != "origin.example.com" {
+				t.Errorf("signed by %s, want origin.example.com", origin)
+			}
+		})
+	}
+}
+
+func TestCertCacheIsBounded(t *testing.T) {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+	saved := certCache
+	defer func() { certCache = saved }()
+
+	certCache = map[string]cachedCert{}
+	start := time.Now()
+	for i := 0; i < maxCachedCerts; i++ {
+		cacheCert(fmt.Sprintf("server%d.example.com", i), cachedCert{fetchedAt: start.Add(time.Duration(i) * time.Millisecond)})
+	}
+
+	cacheCert("another.example.com", cachedCert{fetchedAt: start.Add(time.Hour)})
+	if len(certCache) != maxCachedCerts {
+		t.Fatalf("%d certs cached, want %d", len(certCache), maxCachedCerts)
+	}
+	if _, ok := certCache["server0.example.com"]; ok {
+		t.Error("the cert fetched longest ago wasn't dropped")
+	}
+
+	// fetching one again doesn't push anything out
+	cacheCert("server1.example.com", cachedCert{fetchedAt: start.Add(time.Hour)})
+	if _, ok := certCache["server2.example.com"]; !ok || len(certCache) != maxCachedCerts {
+		t.Error("refreshing a cached cert dropped another")
+	}
+}
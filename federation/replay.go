@@ -0,0 +1,39 @@
+package federation
+
+import (
+	"sync"
+	"time"
+)
+
+// Signed requests are remembered until their timestamp is too old to be accepted, so one that was captured can't be
+// sent again. Only verified requests are remembered, so nobody else can fill this up.
+
+const replaySweepInterval = time.Minute
+
+var (
+	seenRequests   = map[[32]byte]time.Time{} // signed data digest -> when it's timestamp is too old
+	seenRequestsMu sync.Mutex
+	lastSweep      time.Time
+)
+
+// rememberSignedRequest is false if the request has already been seen.
+func rememberSignedRequest(digest [32]byte, until time.Time) bool {
+	seenRequestsMu.Lock()
+	defer seenRequestsMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(lastSweep) > replaySweepInterval {
+		for seen, expiresAt := range seenRequests {
+			if now.After(expiresAt) {
+				delete(seenRequests, seen)
+			}
+		}
+		lastSweep = now
+	}
+
+	if expiresAt, seen := seenRequests[digest]; seen && now.Before(expiresAt) {
+		return false
+	}
+	seenRequests[digest] = until
+	return true
+}
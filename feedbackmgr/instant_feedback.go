@@ -1,15 +1,13 @@
 package feedbackmgr
 
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"net"
-	"net/http"
 
 	db "github.com/Preloading/SkyglowNotificationServer/database"
-	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
 )
 
 // only for this server
@@ -36,7 +34,7 @@ func RemoveToken(typeOfFeedback int, reasonForFeedback string, routingToken []by
 			SaveFeedbackWhenProviderIsUs(typeOfFeedback, reasonForFeedback, routingToken, our_address)
 		} else {
 			type RelayFeedback struct {
-				DeviceTokenStr string `json:"device_token"`
+				DeviceTokenStr string `json:"routing_key"`
 				ServerAddress  string `json:"server_address"`
 				Type           int    `json:"type"`
 				Reason         string `json:"reason"`
@@ -54,22 +52,12 @@ func RemoveToken(typeOfFeedback int, reasonForFeedback string, routingToken []by
 				return err
 			}
 
-			txts, err := net.LookupTXT(fmt.Sprintf("_sgn.%s", *feedbackAddress))
+			serverData, err := discovery.Lookup(*feedbackAddress)
 			if err != nil {
 				return err
 			}
-			var serverData router.ServerTXT
-
-			found := false
-			for _, txt := range txts {
-				serverData, err = router.ParseServerTXT(txt)
-				if err == nil {
-					found = true
-					break
-				}
-			}
-			if found {
-				http.Post(fmt.Sprintf("%s/relay_feedback", serverData.HTTPAddress), "application/json", bytes.NewBuffer(setTokenFeedbackProviderJson))
+			if resp, err := federation.Post(*feedbackAddress, fmt.Sprintf("%s/relay_feedback", serverData.HTTPAddress), "application/json", setTokenFeedbackProviderJson); err == nil {
+				resp.Body.Close()
 			}
 		}
 	}
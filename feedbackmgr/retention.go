@@ -0,0 +1,116 @@
+package feedbackmgr
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+// tokens are expired this many at a time, and only so many times a run so one run can't go on forever.
+// Anything left over is picked up next time.
+const (
+	retentionBatchSize  = 500
+	retentionMaxBatches = 20
+)
+
+var retentionTicker *time.Ticker
+
+// RetentionReport is what a retention run did.
+type RetentionReport struct {
+	IdleTokensExpired    int   // not sent to or acked in TOKEN_IDLE_RETENTION
+	DormantTokensExpired int   // on devices that haven't been seen in DEVICE_DORMANT_RETENTION
+	FeedbackFailed       int   // expired, but the provider's server couldn't be told
+	DevicesPurged        int64 // dormant devices with no tokens left
+	MessagesDropped      int64 // queued for longer than QUEUED_MESSAGE_RETENTION
+	Errors               int   // policies that didn't finish, they're tried again next run
+	Took                 time.Duration
+}
+
+func (r RetentionReport) String() string {
+	return fmt.Sprintf("expired %d idle tokens & %d tokens on dormant devices (%d couldn't be sent feedback), purged %d dormant devices, dropped %d old queued messages, %d errors, took %s",
+		r.IdleTokensExpired, r.DormantTokensExpired, r.FeedbackFailed, r.DevicesPurged, r.MessagesDropped, r.Errors, r.Took.Round(time.Millisecond))
+}
+
+// StartRetention runs the retention policies every RETENTION_INTERVAL. Each one is off if it's set to 0.
+func StartRetention(_config configPkg.Config) {
+	Config = _config
+	if Config.RetentionInterval <= 0 || (Config.TokenIdleRetention <= 0 && Config.DeviceDormantRetention <= 0 && Config.QueuedMessageRetention <= 0) {
+		return
+	}
+
+	retentionTicker = time.NewTicker(Config.RetentionInterval)
+
+	go func() {
+		for range retentionTicker.C {
+			report := RunRetention()
+			log.Printf("retention run: %s\n", report)
+		}
+	}()
+}
+
+// RunRetention expires idle tokens & tokens on dormant devices (sending feedback for them, like the device had
+// removed them), purges dormant devices once their tokens are gone, and drops old queued messages.
+func RunRetention() RetentionReport {
+	var report RetentionReport
+	start := time.Now()
+
+	if Config.TokenIdleRetention > 0 {
+		report.IdleTokensExpired = expireTokens(&report, "token idle", func() ([]db.NotificationToken, error) {
+			return db.GetIdleTokens(Config.TokenIdleRetention, retentionBatchSize)
+		})
+	}
+
+	if Config.DeviceDormantRetention > 0 {
+		report.DormantTokensExpired = expireTokens(&report, "device inactive", func() ([]db.NotificationToken, error) {
+			return db.GetDormantDeviceTokens(Config.DeviceDormantRetention, retentionBatchSize)
+		})
+
+		// their tokens are removed by the feedback cycle a while after being expired, the device goes after that
+		purged, err := db.PurgeDormantDevices(Config.DeviceDormantRetention)
+		if err != nil {
+			log.Printf("failed to purge dormant devices: %v\n", err)
+			report.Errors++
+		}
+		report.DevicesPurged = purged
+	}
+
+	if Config.QueuedMessageRetention > 0 {
+		dropped, err := db.DropOldQueuedMessages(Config.QueuedMessageRetention)
+		if err != nil {
+			log.Printf("failed to drop old queued messages: %v\n", err)
+			report.Errors++
+		}
+		report.MessagesDropped = dropped
+	}
+
+	report.Took = time.Since(start)
+	return report
+}
+
+// expireTokens removes every token next gives back, with reason as the feedback, until there's none left.
+func expireTokens(report *RetentionReport, reason string, next func() ([]db.NotificationToken, error)) (expired int) {
+	for i := 0; i < retentionMaxBatches; i++ {
+		tokens, err := next()
+		if err != nil {
+			log.Printf("failed to get tokens to expire (%s): %v\n", reason, err)
+			report.Errors++
+			return expired
+		}
+
+		for _, token := range tokens {
+			if err := RemoveToken(0, reason, token.RoutingToken, Config.ServerAddress, token.FeedbackProviderAddress); err != nil {
+				log.Printf("couldn't send feedback for an expired token to %s: %v\n", *token.FeedbackProviderAddress, err)
+				report.FeedbackFailed++
+			}
+			expired++
+		}
+
+		if len(tokens) < retentionBatchSize {
+			return expired
+		}
+	}
+	return expired
+}
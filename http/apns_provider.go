@@ -0,0 +1,238 @@
+package http
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/google/uuid"
+)
+
+// This mirrors APNS's provider API (https://developer.apple.com/documentation/usernotifications/sending-notification-requests-to-apns)
+// so that existing APNS libraries can just have their base URL swapped out.
+
+const (
+	apnsMaxPayloadSize = 4096
+
+	APNSReasonBadDeviceToken      = "BadDeviceToken"
+	APNSReasonBadExpirationDate   = "BadExpirationDate"
+	APNSReasonBadMessageId        = "BadMessageId"
+	APNSReasonBadPriority         = "BadPriority"
+	APNSReasonBadCollapseId       = "BadCollapseId"
+	APNSReasonPayloadEmpty        = "PayloadEmpty"
+	APNSReasonPayloadTooLarge     = "PayloadTooLarge"
+	APNSReasonTopicDisallowed     = "TopicDisallowed"
+	APNSReasonUnregistered        = "Unregistered"
+	APNSReasonInternalServerError = "InternalServerError"
+	APNSReasonServiceUnavailable  = "ServiceUnavailable"
+	APNSReasonMissingTopic        = "MissingTopic"
+	APNSReasonTooManyRequests     = "TooManyRequests"
+
+	APNSReasonMissingProviderToken = "MissingProviderToken"
+	APNSReasonInvalidProviderToken = "InvalidProviderToken"
+	APNSReasonExpiredProviderToken = "ExpiredProviderToken"
+	APNSReasonForbidden            = "Forbidden"
+
+	// not one of APNS's, for requests that are wrong in a way APNS doesn't have a reason for
+	APNSReasonBadRequest = "BadRequest"
+)
+
+type APNSErrorResponse struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp,omitempty"` // only for Unregistered
+}
+
+func sendAPNSError(c *fiber.Ctx, status int, reason string) error {
+	return c.Status(status).JSON(APNSErrorResponse{
+		Reason: reason,
+	})
+}
+
+// APNSProviderSend handles POST /3/device/{token}
+func APNSProviderSend(c *fiber.Ctx) error {
+	// apns-id, we make one if they didn't. It's only echoed back like APNS does, the message gets it's own id (see
+	// apns-unique-id below) so two senders picking the same apns-id can't run into each other
+	apnsId := uuid.New()
+	if apnsIdStr := c.Get("apns-id"); apnsIdStr != "" {
+		var err error
+		if apnsId, err = uuid.Parse(apnsIdStr); err != nil {
+			return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonBadMessageId)
+		}
+	}
+	c.Set("apns-id", apnsId.String())
+
+	expirationStr := c.Get("apns-expiration")
+	expiration := int64(0)
+	if expirationStr != "" {
+		var err error
+		if expiration, err = strconv.ParseInt(expirationStr, 10, 64); err != nil || expiration < 0 {
+			return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonBadExpirationDate)
+		}
+	}
+
+	// we don't have a concept of priority, but we should still reject what APNS would reject
+	switch c.Get("apns-priority") {
+	case "", "1", "5", "10":
+	default:
+		return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonBadPriority)
+	}
+
+	if len(c.Get("apns-collapse-id")) > 64 {
+		return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonBadCollapseId)
+	}
+
+	var provider *providerauth.Provider
+	if c.Get("authorization") != "" {
+		var err error
+		if provider, err = providerauth.Authenticate(c.Get("authorization")); err == providerauth.ErrExpiredToken {
+			return sendAPNSError(c, fiber.StatusForbidden, APNSReasonExpiredProviderToken)
+		} else if err != nil {
+			return sendAPNSError(c, fiber.StatusForbidden, APNSReasonInvalidProviderToken)
+		}
+	}
+
+	// token
+	deviceToken, err := hex.DecodeString(c.Params("token"))
+	if err != nil {
+		return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonBadDeviceToken)
+	}
+	serverAddress, routingKey, err := router.SplitDeviceToken(deviceToken)
+	if err != nil {
+		return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonBadDeviceToken)
+	}
+
+	// payload
+	body := c.Body()
+	if len(body) > apnsMaxPayloadSize {
+		return sendAPNSError(c, fiber.StatusRequestEntityTooLarge, APNSReasonPayloadTooLarge)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || len(payload) == 0 {
+		return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonPayloadEmpty)
+	}
+	if _, ok := payload["aps"].(map[string]interface{}); !ok {
+		return sendAPNSError(c, fiber.StatusBadRequest, APNSReasonPayloadEmpty)
+	}
+
+	msg := router.DataToSend{
+		Data:          payload,
+		RoutingKeyStr: hex.EncodeToString(routingKey),
+		ServerAddress: serverAddress,
+		Topic:         c.Get("apns-topic"),
+		CollapseId:    c.Get("apns-collapse-id"),
+		Provider:      provider,
+	}
+	router.ApplyAPNSExpiration(&msg, expiration, expirationStr != "")
+
+	// a deliver once message that got dropped is still a 200, same as APNS
+	result, err := router.SendMessageToRouter(msg)
+	if result.MessageId != "" {
+		// APNS gives this back in development for looking up what happened to it, which is what /message/{id} is for
+		c.Set("apns-unique-id", result.MessageId)
+	}
+
+	if err == nil {
+		return c.SendStatus(fiber.StatusOK)
+	}
+
+	switch status, reason := apnsErrorFor(err); reason {
+	case "":
+		// APNS would've just accepted it and have the device not show it
+		return c.SendStatus(fiber.StatusOK)
+	case APNSReasonUnregistered:
+		return c.Status(status).JSON(APNSErrorResponse{
+			Reason:    reason,
+			Timestamp: time.Now().UnixMilli(),
+		})
+	case APNSReasonInternalServerError:
+		log.Printf("apns provider send failed: %v\n", err)
+		return sendAPNSError(c, status, reason)
+	default:
+		return sendAPNSError(c, status, reason)
+	}
+}
+
+// apnsErrorFor maps an error from the router to the status code & reason APNS would've replied with. The reason is
+// "" when APNS would've said it went through.
+func apnsErrorFor(err error) (int, string) {
+	switch router.ReasonOf(err) {
+	case router.ReasonBadRequest:
+		// BadRequest covers a lot, APNS is more specific
+		switch {
+		case errors.Is(err, router.ErrTopicRequired):
+			return fiber.StatusBadRequest, APNSReasonMissingTopic
+		case errors.Is(err, router.ErrCollapseIdTooLong):
+			return fiber.StatusBadRequest, APNSReasonBadCollapseId
+		case errors.Is(err, router.ErrServerAddressEmpty):
+			return fiber.StatusBadRequest, APNSReasonBadDeviceToken
+		case errors.Is(err, router.ErrDeliverAtAfterExpiration):
+			return fiber.StatusBadRequest, APNSReasonBadExpirationDate
+		default:
+			return fiber.StatusBadRequest, APNSReasonBadRequest
+		}
+	case router.ReasonBadRoutingKey, router.ReasonUnknownToken:
+		return fiber.StatusBadRequest, APNSReasonBadDeviceToken
+	case router.ReasonTokenMarkedForRemoval, router.ReasonTokenInvalid:
+		return fiber.StatusGone, APNSReasonUnregistered
+	case router.ReasonTopicMismatch, router.ReasonProviderNotAllowed, router.ReasonPeerNotAllowed:
+		return fiber.StatusBadRequest, APNSReasonTopicDisallowed
+	case router.ReasonRelayNotAccepted:
+		return fiber.StatusForbidden, APNSReasonForbidden
+	case router.ReasonUnauthorized:
+		return fiber.StatusForbidden, APNSReasonMissingProviderToken
+	case router.ReasonPayloadTooLarge:
+		return fiber.StatusRequestEntityTooLarge, APNSReasonPayloadTooLarge
+	case router.ReasonNotificationTypesOff:
+		return fiber.StatusOK, ""
+	case router.ReasonMessageExpired:
+		return fiber.StatusBadRequest, APNSReasonBadExpirationDate
+	case router.ReasonIdempotencyKeyReused:
+		return fiber.StatusBadRequest, APNSReasonBadMessageId
+	case router.ReasonRateLimited, router.ReasonScheduleFull, router.ReasonIdempotencyKeyInUse:
+		return fiber.StatusTooManyRequests, APNSReasonTooManyRequests
+	case router.ReasonNotCancellable:
+		return fiber.StatusBadRequest, APNSReasonBadRequest
+	case router.ReasonPeerUnreachable, router.ReasonPeerRejected, router.ReasonHopLimitExceeded, router.ReasonRoutingLoop:
+		return fiber.StatusServiceUnavailable, APNSReasonServiceUnavailable
+	case router.ReasonInternalError:
+		return fiber.StatusInternalServerError, APNSReasonInternalServerError
+	default:
+		return fiber.StatusBadRequest, APNSReasonBadRequest
+	}
+}
+
+// Most APNS libraries refuse to talk anything but HTTP/2, which fiber can't do.
+// This serves just the provider endpoint over TLS w/ HTTP/2 on it's own port.
+func createAPNSHTTP2Server(port int) {
+	app := fiber.New()
+	app.Post("/3/device/:token", APNSProviderSend)
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: adaptor.FiberApp(app),
+	}
+
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{*keys.ServerTLSCert},
+	}
+
+	log.Printf("APNS HTTP/2 server listening on port %d", port)
+	if err := server.ServeTLS(l, "", ""); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAPNSErrorFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantReason string
+	}{
+		{name: "missing topic", err: router.ErrTopicRequired, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonMissingTopic},
+		{name: "long collapse id", err: router.ErrCollapseIdTooLong, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonBadCollapseId},
+		{name: "deliver_at after expiration", err: router.ErrDeliverAtAfterExpiration, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonBadExpirationDate},
+		{name: "other bad request", err: router.ErrDeliverOnceScheduled, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonBadRequest},
+		{name: "unknown token", err: router.ErrRoutingKeyInvalid, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonBadDeviceToken},
+		{name: "provider not allowed", err: router.ErrProviderNotAllowed, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonTopicDisallowed},
+		{name: "auth required", err: router.ErrProviderAuthRequired, wantStatus: fiber.StatusForbidden, wantReason: APNSReasonMissingProviderToken},
+		{name: "alerts turned off", err: router.ErrNotificationTypesOff, wantStatus: fiber.StatusOK, wantReason: ""},
+		{name: "schedule full", err: router.ErrScheduleFull, wantStatus: fiber.StatusTooManyRequests, wantReason: APNSReasonTooManyRequests},
+		{name: "idempotency key in use", err: router.ErrIdempotencyKeyInUse, wantStatus: fiber.StatusTooManyRequests, wantReason: APNSReasonTooManyRequests},
+		{name: "idempotency key reused", err: router.ErrIdempotencyKeyReused, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonBadMessageId},
+		{name: "not cancellable", err: router.ErrNotCancellable, wantStatus: fiber.StatusBadRequest, wantReason: APNSReasonBadRequest},
+		{name: "not ours", err: errors.New("something broke"), wantStatus: fiber.StatusInternalServerError, wantReason: APNSReasonInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reason := apnsErrorFor(tt.err)
+			if status != tt.wantStatus || reason != tt.wantReason {
+				t.Errorf("got %d %q, want %d %q", status, reason, tt.wantStatus, tt.wantReason)
+			}
+		})
+	}
+}
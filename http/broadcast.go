@@ -0,0 +1,107 @@
+package http
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/gofiber/fiber/v2"
+)
+
+type BroadcastResponse struct {
+	Status          string             `json:"status"`
+	Reason          router.ErrorReason `json:"reason,omitempty"`
+	Message         string             `json:"message,omitempty"`
+	BroadcastId     string             `json:"broadcast_id,omitempty"`
+	BundleId        string             `json:"bundle_id,omitempty"`
+	BroadcastStatus string             `json:"broadcast_status,omitempty"` // running, done, expired or failed
+	TotalTokens     int                `json:"total_tokens"`               // how many tokens there were when it started
+	Queued          int                `json:"queued"`
+	Skipped         int                `json:"skipped"` // the user turned off everything in it
+	Failed          int                `json:"failed"`
+	LastError       *string            `json:"last_error,omitempty"`
+	CreatedAt       *time.Time         `json:"created_at,omitempty"`
+	UpdatedAt       *time.Time         `json:"updated_at,omitempty"`
+	FinishedAt      *time.Time         `json:"finished_at,omitempty"`
+}
+
+// Broadcast starts sending a notification to every token for the topic (bundle id). It replies right away, and
+// the sender can check how it's going with BroadcastStatus.
+func Broadcast(c *fiber.Ctx) error {
+	var data router.DataToSend
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(BroadcastResponse{
+			Status:  "error",
+			Reason:  router.ReasonBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	provider, err := providerauth.Authenticate(c.Get("Authorization"))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(BroadcastResponse{
+			Status:  "error",
+			Reason:  router.ReasonUnauthorized,
+			Message: err.Error(),
+		})
+	}
+	data.Provider = provider
+
+	broadcast, err := router.StartBroadcast(data)
+	if err != nil {
+		return c.Status(StatusForReason(router.ReasonOf(err))).JSON(BroadcastResponse{
+			Status:  "error",
+			Reason:  router.ReasonOf(err),
+			Message: err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(broadcastResponse(broadcast))
+}
+
+func BroadcastStatus(c *fiber.Ctx) error {
+	provider, err := providerauth.Authenticate(c.Get("Authorization"))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(BroadcastResponse{
+			Status:  "error",
+			Reason:  router.ReasonUnauthorized,
+			Message: err.Error(),
+		})
+	}
+
+	broadcast, err := router.GetBroadcast(c.Params("broadcast_id"), provider)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(BroadcastResponse{
+			Status:  "error",
+			Message: "no broadcast with that id",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(BroadcastResponse{
+			Status:  "error",
+			Reason:  router.ReasonInternalError,
+			Message: err.Error(),
+		})
+	}
+
+	return c.JSON(broadcastResponse(broadcast))
+}
+
+func broadcastResponse(broadcast *db.Broadcast) BroadcastResponse {
+	return BroadcastResponse{
+		Status:          "success",
+		BroadcastId:     broadcast.BroadcastId,
+		BundleId:        broadcast.BundleId,
+		BroadcastStatus: broadcast.Status,
+		TotalTokens:     broadcast.TotalTokens,
+		Queued:          broadcast.Queued,
+		Skipped:         broadcast.Skipped,
+		Failed:          broadcast.Failed,
+		LastError:       broadcast.LastError,
+		CreatedAt:       &broadcast.CreatedAt,
+		UpdatedAt:       &broadcast.UpdatedAt,
+		FinishedAt:      broadcast.FinishedAt,
+	}
+}
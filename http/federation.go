@@ -0,0 +1,53 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Preloading/SkyglowNotificationServer/federation"
+	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/gofiber/fiber/v2"
+)
+
+var errOriginMismatch = errors.New("request was signed by a different server than it claims to be from")
+
+// verifyFederationRequest checks the signature of a request from another server, and gives back who signed it.
+// Unsigned requests give back "", unless we require them to be signed.
+func verifyFederationRequest(c *fiber.Ctx) (string, error) {
+	getHeader := func(key string) string { return c.Get(key) }
+
+	if !federation.IsSigned(getHeader) {
+		if Config.RequireSignedFederation {
+			return "", federation.ErrNotSigned
+		}
+		return "", nil
+	}
+
+	origin, err := federation.VerifyRequest(c.Method(), c.Path(), getHeader, c.Body())
+	if err != nil {
+		return "", fmt.Errorf("could not verify request: %w", err)
+	}
+	return origin, nil
+}
+
+// verifyFederationOrigin is verifyFederationRequest, but the signer must be claimedOrigin.
+// It also checks claimedOrigin's peer policy.
+func verifyFederationOrigin(c *fiber.Ctx, claimedOrigin string) error {
+	origin, err := verifyFederationRequest(c)
+	if err != nil {
+		return err
+	}
+	if origin != "" && origin != claimedOrigin {
+		return errOriginMismatch
+	}
+	return router.CheckInboundPeer(claimedOrigin, origin != "", c.IP(), len(c.Body()))
+}
+
+// federationErrorStatus is the status code for an error from verifyFederationOrigin
+func federationErrorStatus(err error) int {
+	var routerErr *router.RouterError
+	if errors.As(err, &routerErr) {
+		return StatusForReason(routerErr.Reason)
+	}
+	return fiber.StatusUnauthorized
+}
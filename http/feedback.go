@@ -1,17 +1,15 @@
 package http
 
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net"
-	"net/http"
 	"time"
 
 	db "github.com/Preloading/SkyglowNotificationServer/database"
-	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -40,9 +38,11 @@ type SetFeedbackProviderForTokenReqBody struct {
 type RelayFeedback struct {
 	RoutingKeyStr string `json:"routing_key"`
 	RoutingKey    []byte `json:"-"`
-	ServerAddress string `json:"server_address"`
-	Type          int    `json:"type"`
-	Reason        string `json:"reason"`
+	// servers from before this was fixed send the routing key as device_token
+	LegacyRoutingKeyStr string `json:"device_token"`
+	ServerAddress       string `json:"server_address"`
+	Type                int    `json:"type"`
+	Reason              string `json:"reason"`
 }
 
 func RegisterForFeedback(c *fiber.Ctx) error {
@@ -98,29 +98,14 @@ func RegisterForFeedback(c *fiber.Ctx) error {
 			return err
 		}
 
-		txts, err := net.LookupTXT(fmt.Sprintf("_sgn.%s", data.ServerAddress))
+		serverData, err := discovery.Lookup(data.ServerAddress)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"status": "could not find token's notification server",
 			})
 		}
-		var serverData router.ServerTXT
-
-		found := false
-		for _, txt := range txts {
-			serverData, err = router.ParseServerTXT(txt)
-			if err == nil {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"status": "could not find token's notification server",
-			})
-		}
 
-		resp, err := http.Post(fmt.Sprintf("%s/set_feedback_provider_for_token", serverData.HTTPAddress), "application/json", bytes.NewBuffer(setTokenFeedbackProviderJson))
+		resp, err := federation.Post(data.ServerAddress, fmt.Sprintf("%s/set_feedback_provider_for_token", serverData.HTTPAddress), "application/json", setTokenFeedbackProviderJson)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"status": "failed to relay feedback registration to token owner ",
@@ -150,6 +135,12 @@ func SetFeedbackProviderForToken(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := verifyFederationOrigin(c, data.ProviderDomain); err != nil {
+		return c.Status(federationErrorStatus(err)).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
 	// decode the hex device token
 	data.RoutingKey, err = hex.DecodeString(data.RoutingKeyStr)
 	if err != nil {
@@ -234,7 +225,16 @@ func RelayedFeedback(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := verifyFederationOrigin(c, data.ServerAddress); err != nil {
+		return c.Status(federationErrorStatus(err)).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
 	// decode the hex device token
+	if data.RoutingKeyStr == "" {
+		data.RoutingKeyStr = data.LegacyRoutingKeyStr
+	}
 	data.RoutingKey, err = hex.DecodeString(data.RoutingKeyStr)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -3,6 +3,7 @@ package http
 import (
 	"github.com/Preloading/SkyglowNotificationServer/config"
 	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -25,6 +26,14 @@ func CreateHTTPServer(_keys configPkg.CryptoKeys, _config configPkg.Config) {
 	app.Use(logger.New())
 
 	app.Post("/send", NotificationSend)
+	app.Post("/send_batch", NotificationSendBatch)
+	app.Get("/relay_status/:message_id", RelayStatus)
+	app.Get("/message/:message_id", MessageStatus)
+	app.Delete("/message/:message_id", CancelMessage)
+	app.Post("/message_status_callback", MessageStatusCallback)
+	app.Post("/broadcast", Broadcast)
+	app.Get("/broadcast/:broadcast_id", BroadcastStatus)
+	app.Post("/3/device/:token", APNSProviderSend) // APNS compatible provider API
 
 	// Websocket route
 	app.Use("/ws", func(c *fiber.Ctx) error {
@@ -32,6 +41,13 @@ func CreateHTTPServer(_keys configPkg.CryptoKeys, _config configPkg.Config) {
 		// requested upgrade to the WebSocket protocol.
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("allowed", true)
+			if c.Get("Authorization") != "" {
+				provider, err := providerauth.Authenticate(c.Get("Authorization"))
+				if err != nil {
+					return fiber.ErrUnauthorized
+				}
+				c.Locals("provider", provider)
+			}
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
@@ -51,6 +67,10 @@ func CreateHTTPServer(_keys configPkg.CryptoKeys, _config configPkg.Config) {
 		return c.SendFile("keys/server_public_key.pem")
 	})
 
+	if Config.APNSHTTP2Port != 0 {
+		go createAPNSHTTP2Server(Config.APNSHTTP2Port)
+	}
+
 	app.Listen(":7878")
 }
 
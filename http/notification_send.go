@@ -1,26 +1,344 @@
 package http
 
 import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Preloading/SkyglowNotificationServer/federation"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
 	"github.com/Preloading/SkyglowNotificationServer/router"
 	"github.com/gofiber/fiber/v2"
 )
 
+type SendResponse struct {
+	Status       string             `json:"status"`
+	Reason       router.ErrorReason `json:"reason,omitempty"`
+	Message      string             `json:"message,omitempty"`
+	MessageId    string             `json:"message_id,omitempty"`
+	StrippedKeys []string           `json:"stripped_keys,omitempty"`
+	Data         *router.DataToSend `json:"data,omitempty"`
+}
+
 func NotificationSend(c *fiber.Ctx) error {
 	var data router.DataToSend
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		return c.Status(fiber.StatusBadRequest).JSON(SendResponse{
+			Status:  "error",
+			Reason:  router.ReasonBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	if data.IdempotencyKey == "" {
+		data.IdempotencyKey = c.Get("Idempotency-Key")
+	}
+
+	if c.Get("Authorization") != "" {
+		provider, err := providerauth.Authenticate(c.Get("Authorization"))
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(SendResponse{
+				Status:  "error",
+				Reason:  router.ReasonUnauthorized,
+				Message: err.Error(),
+			})
+		}
+		data.Provider = provider
+	}
+
+	// relayed from another server, which should've signed it
+	if len(data.Hops) > 0 {
+		origin, err := verifyFederationRequest(c)
+		if err == nil && origin != "" && origin != data.Hops[len(data.Hops)-1] {
+			err = errOriginMismatch
+		}
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(SendResponse{
+				Status:  "error",
+				Reason:  router.ReasonUnauthorized,
+				Message: err.Error(),
+			})
+		}
+		data.RelayedFrom = origin
+
+		size, err := router.PayloadSize(data)
+		if err == nil {
+			err = router.CheckInboundPeer(data.Hops[len(data.Hops)-1], origin != "", c.IP(), size)
+		}
+		if err != nil {
+			return c.Status(StatusForReason(router.ReasonOf(err))).JSON(sendErrorResponse(err, router.SendResult{}))
+		}
+	}
+
+	result, err := router.SendMessageToRouter(data)
+	if result.Replayed {
+		c.Set("Idempotent-Replayed", "true")
+	}
+
+	if err != nil {
+		return c.Status(StatusForReason(router.ReasonOf(err))).JSON(sendErrorResponse(err, result))
+	}
+
+	if result.RelayQueued {
+		// it's on it's way to the other server, they can check on it with /relay_status
+		return c.Status(fiber.StatusAccepted).JSON(SendResponse{
+			Status:    "accepted",
+			MessageId: result.MessageId,
+			Data:      &data,
+		})
+	}
+
+	return c.JSON(SendResponse{
+		Status:       sendStatus(result),
+		MessageId:    result.MessageId,
+		StrippedKeys: result.StrippedKeys,
+		Data:         &data,
+	})
+}
+
+// deliver once messages to devices that aren't connected are dropped, which isn't an error, but isn't sent either
+func sendStatus(result router.SendResult) string {
+	if result.Dropped {
+		return "dropped"
+	}
+	return "success"
+}
+
+type RelayStatusResponse struct {
+	Status      string    `json:"status"`
+	MessageId   string    `json:"message_id"`
+	Destination string    `json:"destination"`
+	RelayStatus string    `json:"relay_status"` // pending, delivered, failed, dead, expired or cancelled
+	Attempts    int       `json:"attempts"`
+	LastError   *string   `json:"last_error,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// what the other server replied with, the last time we tried
+	RemoteStatus    *string `json:"remote_status,omitempty"`
+	RemoteReason    *string `json:"remote_reason,omitempty"`
+	RemoteMessageId *string `json:"remote_message_id,omitempty"`
+}
+
+// RelayStatus tells whoever sent a relayed message how it's going, with the same credentials rules as MessageStatus.
+func RelayStatus(c *fiber.Ctx) error {
+	provider, server, err := messageRequester(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
+	relay, err := router.GetRelayStatus(c.Params("message_id"), provider, server)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status": "no relay with that message id",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
+	return c.JSON(RelayStatusResponse{
+		Status:      "success",
+		MessageId:   relay.MessageId,
+		Destination: relay.Destination,
+		RelayStatus: relay.Status,
+		Attempts:    relay.Attempts,
+		LastError:   relay.LastError,
+		UpdatedAt:   relay.UpdatedAt,
+
+		RemoteStatus:    relay.RemoteStatus,
+		RemoteReason:    relay.RemoteReason,
+		RemoteMessageId: relay.RemoteMessageId,
+	})
+}
+
+type MessageStatusResponse struct {
+	Status        string               `json:"status"`
+	MessageId     string               `json:"message_id"`
+	MessageStatus string               `json:"message_status"` // accepted, relayed, queued, delivered, acked, expired or dropped
+	Reason        *string              `json:"reason,omitempty"`
+	CreatedAt     time.Time            `json:"created_at"`
+	UpdatedAt     time.Time            `json:"updated_at"`
+	History       []MessageStatusEvent `json:"history"`
+}
+
+type MessageStatusEvent struct {
+	MessageStatus string    `json:"message_status"`
+	Reason        *string   `json:"reason,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// messageRequester is who's asking about a message, a provider (nil if they didn't authenticate) or a server
+// if they signed the request. Other servers can ask about messages they relayed to us.
+func messageRequester(c *fiber.Ctx) (*providerauth.Provider, string, error) {
+	var provider *providerauth.Provider
+	if c.Get("Authorization") != "" {
+		var err error
+		provider, err = providerauth.Authenticate(c.Get("Authorization"))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	server := ""
+	if federation.IsSigned(func(key string) string { return c.Get(key) }) {
+		var err error
+		server, err = verifyFederationRequest(c)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return provider, server, nil
+}
+
+// MessageStatus tells whoever sent a message where it's at. They have to ask with the same credentials they sent it with.
+func MessageStatus(c *fiber.Ctx) error {
+	provider, server, err := messageRequester(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
+	status, err := router.GetMessageStatus(c.Params("message_id"), provider, server)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status": "no message with that id",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status": err.Error(),
 		})
 	}
 
-	err := router.SendMessageToRouter(data)
+	history := make([]MessageStatusEvent, len(status.Events))
+	for i, event := range status.Events {
+		history[i] = MessageStatusEvent{
+			MessageStatus: event.Status,
+			Reason:        event.Reason,
+			At:            event.At,
+		}
+	}
+
+	return c.JSON(MessageStatusResponse{
+		Status:        "success",
+		MessageId:     status.MessageId,
+		MessageStatus: status.Status,
+		Reason:        status.Reason,
+		CreatedAt:     status.CreatedAt,
+		UpdatedAt:     status.UpdatedAt,
+		History:       history,
+	})
+}
+
+// CancelMessage cancels a scheduled message, for whoever sent it.
+func CancelMessage(c *fiber.Ctx) error {
+	provider, server, err := messageRequester(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(SendResponse{
+			Status:  "error",
+			Reason:  router.ReasonUnauthorized,
+			Message: err.Error(),
+		})
+	}
+
+	messageId := c.Params("message_id")
+	err = router.CancelMessage(messageId, provider, server)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(SendResponse{
+			Status:    "error",
+			Message:   "no message with that id",
+			MessageId: messageId,
+		})
+	} else if err != nil {
+		return c.Status(StatusForReason(router.ReasonOf(err))).JSON(sendErrorResponse(err, router.SendResult{MessageId: messageId}))
+	}
+
+	return c.JSON(SendResponse{
+		Status:    "success",
+		MessageId: messageId,
+	})
+}
 
+// MessageStatusCallback is where servers we relayed a message to tell us what happened to it.
+func MessageStatusCallback(c *fiber.Ctx) error {
+	getHeader := func(key string) string { return c.Get(key) }
+	if !federation.IsSigned(getHeader) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status": federation.ErrNotSigned.Error(),
+		})
+	}
+	origin, err := federation.VerifyRequest(c.Method(), c.Path(), getHeader, c.Body())
+	if err == nil {
+		err = router.CheckInboundPeer(origin, true, c.IP(), len(c.Body()))
+	}
 	if err != nil {
-		return c.SendString(err.Error())
+		return c.Status(federationErrorStatus(err)).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
+	var callback router.StatusCallbackRequest
+	if err := c.BodyParser(&callback); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	}
+
+	err = router.ApplyStatusCallback(origin, callback)
+	if errors.Is(err, router.ErrUnknownRelay) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(StatusForReason(router.ReasonOf(err))).JSON(fiber.Map{
+			"status": err.Error(),
+		})
 	}
 
 	return c.JSON(fiber.Map{
 		"status": "success",
-		"data":   data,
 	})
 }
+
+func sendErrorResponse(err error, result router.SendResult) SendResponse {
+	return SendResponse{
+		Status:       "error",
+		Reason:       router.ReasonOf(err),
+		Message:      err.Error(),
+		MessageId:    result.MessageId,
+		StrippedKeys: result.StrippedKeys,
+	}
+}
+
+// StatusForReason maps the router's error reasons to the HTTP status code we reply with.
+func StatusForReason(reason router.ErrorReason) int {
+	switch reason {
+	case router.ReasonBadRequest, router.ReasonBadRoutingKey, router.ReasonMessageExpired:
+		return fiber.StatusBadRequest
+	case router.ReasonUnknownToken:
+		return fiber.StatusNotFound
+	case router.ReasonTokenMarkedForRemoval, router.ReasonTokenInvalid:
+		return fiber.StatusGone
+	case router.ReasonUnauthorized:
+		return fiber.StatusUnauthorized
+	case router.ReasonTopicMismatch, router.ReasonProviderNotAllowed, router.ReasonRelayNotAccepted, router.ReasonPeerNotAllowed:
+		return fiber.StatusForbidden
+	case router.ReasonPayloadTooLarge:
+		return fiber.StatusRequestEntityTooLarge
+	case router.ReasonNotificationTypesOff, router.ReasonIdempotencyKeyReused:
+		return fiber.StatusUnprocessableEntity
+	case router.ReasonIdempotencyKeyInUse, router.ReasonNotCancellable:
+		return fiber.StatusConflict
+	case router.ReasonPeerUnreachable, router.ReasonPeerRejected:
+		return fiber.StatusBadGateway
+	case router.ReasonHopLimitExceeded, router.ReasonRoutingLoop:
+		return fiber.StatusLoopDetected
+	case router.ReasonRateLimited, router.ReasonScheduleFull:
+		return fiber.StatusTooManyRequests
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/Preloading/SkyglowNotificationServer/router"
+	"github.com/gofiber/fiber/v2"
+)
+
+type SendBatchResponse struct {
+	Status  string             `json:"status"`
+	Reason  router.ErrorReason `json:"reason,omitempty"`
+	Message string             `json:"message,omitempty"`
+	Sent    int                `json:"sent"`
+	Failed  int                `json:"failed"`
+	Results []SendResponse     `json:"results,omitempty"` // in the same order as the request
+}
+
+func NotificationSendBatch(c *fiber.Ctx) error {
+	var data []router.DataToSend
+	if err := json.Unmarshal(c.Body(), &data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(SendBatchResponse{
+			Status:  "error",
+			Reason:  router.ReasonBadRequest,
+			Message: err.Error(),
+		})
+	}
+	if len(data) == 0 || len(data) > router.MaxBatchSize {
+		return c.Status(fiber.StatusBadRequest).JSON(SendBatchResponse{
+			Status:  "error",
+			Reason:  router.ReasonBadRequest,
+			Message: fmt.Sprintf("a batch must have between 1 and %d notifications", router.MaxBatchSize),
+		})
+	}
+
+	if c.Get("Authorization") != "" {
+		provider, err := providerauth.Authenticate(c.Get("Authorization"))
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(SendBatchResponse{
+				Status:  "error",
+				Reason:  router.ReasonUnauthorized,
+				Message: err.Error(),
+			})
+		}
+		for i := range data {
+			data[i].Provider = provider
+		}
+	}
+
+	results := router.SendMessageBatch(data)
+
+	response := SendBatchResponse{
+		Status:  "success",
+		Results: make([]SendResponse, len(results)),
+	}
+	for i, result := range results {
+		switch {
+		case result.Err != nil:
+			response.Results[i] = sendErrorResponse(result.Err, result.Result)
+			response.Failed++
+		case result.Result.RelayQueued:
+			response.Results[i] = SendResponse{Status: "accepted", MessageId: result.Result.MessageId}
+			response.Sent++
+		default:
+			response.Results[i] = SendResponse{
+				Status:       sendStatus(result.Result),
+				MessageId:    result.Result.MessageId,
+				StrippedKeys: result.Result.StrippedKeys,
+			}
+			response.Sent++
+		}
+	}
+
+	return c.JSON(response)
+}
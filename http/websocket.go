@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"log"
 
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
 	"github.com/Preloading/SkyglowNotificationServer/router"
 	"github.com/gofiber/contrib/websocket"
-	"github.com/gofiber/fiber/v2"
 )
 
 func BaseWebsocket(c *websocket.Conn) {
@@ -27,12 +27,30 @@ func BaseWebsocket(c *websocket.Conn) {
 			break
 		}
 
-		router.SendMessageToLocalRouter(data)
+		if provider, ok := c.Locals("provider").(*providerauth.Provider); ok {
+			data.Provider = provider
+		}
+
+		// same body as /send, so the same codes work here
+		// relays only come in through /send, where the relaying server's signature & peer policy are checked
+		var response SendResponse
+		var result router.SendResult
+		var sendErr error = router.ErrRelayOverWebsocket
+		if len(data.Hops) == 0 {
+			result, sendErr = router.SendMessageToLocalRouter(data)
+		}
+		if sendErr != nil {
+			response = sendErrorResponse(sendErr, result)
+		} else {
+			response = SendResponse{
+				Status:       sendStatus(result),
+				MessageId:    result.MessageId,
+				StrippedKeys: result.StrippedKeys,
+				Data:         &data,
+			}
+		}
 
-		if err = c.WriteJSON(fiber.Map{
-			"status": "Message sent",
-			"data":   data,
-		}); err != nil {
+		if err = c.WriteJSON(response); err != nil {
 			log.Println("write:", err)
 			break
 		}
@@ -3,11 +3,17 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/Preloading/SkyglowNotificationServer/config"
 	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
 	"github.com/Preloading/SkyglowNotificationServer/feedbackmgr"
 	"github.com/Preloading/SkyglowNotificationServer/http"
+	"github.com/Preloading/SkyglowNotificationServer/peerpolicy"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
 	"github.com/Preloading/SkyglowNotificationServer/router"
 	"github.com/Preloading/SkyglowNotificationServer/tcpproto"
 )
@@ -18,6 +24,13 @@ func main() {
 		panic(err)
 	}
 	fmt.Println("Loaded config successfully")
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(c, os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(c.ServerAddress) > 16 {
 		panic(errors.New("server address is greater than 16 in length! Please change to be 16 or under charactors"))
 	}
@@ -26,15 +39,72 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	atRestKeys, err := config.LoadAtRestKeys(c)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println("Loaded keys successfully")
 
+	if err := providerauth.LoadProviders(c); err != nil {
+		panic(err)
+	}
+
+	if err := peerpolicy.Load(c); err != nil {
+		panic(err)
+	}
+	config.WatchConfig(func(newConfig config.Config) {
+		// both are checked before either is used, so a mistake in one doesn't leave us with half a reload
+		policies, err := peerpolicy.Parse(newConfig)
+		if err != nil {
+			fmt.Printf("Failed to reload peer policies, keeping the old ones (and the old providers): %v\n", err)
+			return
+		}
+		providers, err := providerauth.ParseProviders(newConfig)
+		if err != nil {
+			fmt.Printf("Failed to reload providers, keeping the old ones (and the old peer policies): %v\n", err)
+			return
+		}
+		peerpolicy.Use(policies)
+		providerauth.UseProviders(providers)
+		fmt.Println("Reloaded peer policies & providers")
+	})
+
+	discovery.Init(c)
+	if err := federation.Init(*keys, c); err != nil {
+		panic(err)
+	}
+
 	// Initialize the database connection
-	db.InitDB(c.DB_DSN)
+	db.InitDB(c.DB_TYPE, c.DB_DSN)
+	if err := migrateOnBoot(c); err != nil {
+		panic(err)
+	}
+	if err := db.UseAtRestKeys(atRestKeys, c.AtRestKeyId); err != nil {
+		panic(err)
+	}
 	router.Config = c
+	if err := router.StartCluster(); err != nil {
+		panic(err)
+	}
+	router.StartQueueSweeper(5 * time.Minute)
+	router.StartReencryption(10 * time.Minute)
+	router.StartScheduler()
+	router.StartBroadcastWorker()
+	router.StartRelayWorkers(c.RelayWorkers)
+	router.StartStatusCallbackWorker()
 	fmt.Println("Starting TCP Server...")
 	go tcpproto.CreateTCPServer(uint16(c.TCPPort), *keys, c)
+	if c.APNSLegacyPort != 0 {
+		fmt.Println("Starting legacy APNS gateway...")
+		go tcpproto.CreateLegacyAPNSGateway(uint16(c.APNSLegacyPort), *keys, c)
+	}
+	if c.APNSFeedbackPort != 0 {
+		fmt.Println("Starting legacy APNS feedback server...")
+		go tcpproto.CreateLegacyAPNSFeedbackServer(uint16(c.APNSFeedbackPort), *keys, c)
+	}
 	fmt.Println("Starting HTTP Server...")
 	go http.CreateHTTPServer(*keys, c)
 	feedbackmgr.StartFeedbackCycle(c)
+	feedbackmgr.StartRetention(c)
 	select {}
 }
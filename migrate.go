@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Preloading/SkyglowNotificationServer/config"
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+var errMigrateUsage = errors.New("usage: skyglownotifserver migrate status|up")
+
+// runMigrate is `skyglownotifserver migrate status|up`
+func runMigrate(c config.Config, args []string) error {
+	if len(args) != 1 {
+		return errMigrateUsage
+	}
+
+	db.InitDB(c.DB_TYPE, c.DB_DSN)
+	switch args[0] {
+	case "status":
+		states, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		if len(states) == 0 {
+			fmt.Printf("%s databases don't have migrations\n", c.DB_TYPE)
+		}
+		for _, state := range states {
+			if state.AppliedAt == nil {
+				fmt.Printf("%-40s pending\n", state.Migration)
+			} else {
+				fmt.Printf("%-40s applied %s\n", state.Migration, state.AppliedAt.Format("2006-01-02 15:04:05"))
+			}
+		}
+	case "up":
+		applied, err := db.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied %s\n", m)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to migrate, the database is up to date")
+		}
+	default:
+		return errMigrateUsage
+	}
+	return nil
+}
+
+func migrateOnBoot(c config.Config) error {
+	if !c.AutoMigrate {
+		pending, err := db.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("the database has %d migrations waiting, run `skyglownotifserver migrate up` (or turn on AUTO_MIGRATE)", len(pending))
+		}
+		return nil
+	}
+
+	applied, err := db.Migrate()
+	for _, m := range applied {
+		fmt.Printf("Applied migration %s\n", m)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+// Per server rules for who we talk to, and how much. Keyed by server address, with "*" for everyone else.
+// Requests that aren't signed can't be trusted to be from who they say, so they get the "*" limits, per remote address.
+
+package peerpolicy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+)
+
+type Action string
+
+const (
+	ActionAllow         Action = "allow"
+	ActionDeny          Action = "deny"
+	ActionRequireSigned Action = "require_signed" // their requests to us must be signed
+)
+
+const defaultPeer = "*"
+
+var (
+	ErrDenied          = errors.New("this server isn't allowed to federate with us")
+	ErrNotSigned       = errors.New("requests from this server must be signed")
+	ErrRateLimited     = errors.New("too many requests for this server, slow down")
+	ErrPayloadTooLarge = errors.New("payload is too large for this server")
+)
+
+type Policy struct {
+	Action         Action
+	RateLimit      float64 // requests per second, each way. 0 is unlimited
+	Burst          int
+	MaxPayloadSize int // 0 is whatever the normal limit is
+}
+
+// buckets that have been idle for this long, and have filled back up, are forgotten. A new one would be the same.
+const bucketIdleTimeout = 10 * time.Minute
+
+// Which bucket a request takes from. Unsigned requests could be claiming to be anyone, so they're limited by the
+// address they came from, with the "*" policy's limits.
+type bucketKey struct {
+	peer      string // whose policy the limits come from
+	from      string // the remote address, for unsigned requests
+	direction string
+}
+
+var (
+	policies = map[string]Policy{}
+	// the buckets are kept across reloads, so reloading doesn't reset anyone's limit
+	buckets   = map[bucketKey]*bucket{}
+	lastSweep time.Time
+	policyMu  sync.Mutex
+)
+
+// Load (re)loads the policies from the config. Safe to call while running.
+func Load(c configPkg.Config) error {
+	loaded, err := Parse(c)
+	if err != nil {
+		return err
+	}
+	Use(loaded)
+	return nil
+}
+
+// Parse checks the policies in the config, without using them yet.
+func Parse(c configPkg.Config) (map[string]Policy, error) {
+	loaded := make(map[string]Policy, len(c.PeerPolicies))
+	for server, policyConfig := range c.PeerPolicies {
+		action := Action(strings.ToLower(policyConfig.Action))
+		switch action {
+		case "":
+			action = ActionAllow
+		case ActionAllow, ActionDeny, ActionRequireSigned:
+		default:
+			return nil, fmt.Errorf("peer policy %s: ACTION must be allow, deny or require_signed", server)
+		}
+		if policyConfig.RateLimit < 0 || policyConfig.Burst < 0 || policyConfig.MaxPayloadSize < 0 {
+			return nil, fmt.Errorf("peer policy %s: limits can't be negative", server)
+		}
+
+		loaded[strings.ToLower(server)] = Policy{
+			Action:         action,
+			RateLimit:      policyConfig.RateLimit,
+			Burst:          policyConfig.Burst,
+			MaxPayloadSize: policyConfig.MaxPayloadSize,
+		}
+	}
+
+	return loaded, nil
+}
+
+// Use swaps in policies from Parse.
+func Use(loaded map[string]Policy) {
+	policyMu.Lock()
+	policies = loaded
+	for key, b := range buckets {
+		policy := policyForLocked(key.peer)
+		b.setLimit(policy.RateLimit, policy.Burst)
+	}
+	policyMu.Unlock()
+}
+
+// For gets the policy for a server.
+func For(server string) Policy {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	return policyForLocked(strings.ToLower(server))
+}
+
+func policyForLocked(server string) Policy {
+	if policy, ok := policies[server]; ok {
+		return policy
+	}
+	if policy, ok := policies[defaultPeer]; ok {
+		return policy
+	}
+	return Policy{Action: ActionAllow}
+}
+
+// CheckOutbound checks if we can send payloadSize bytes to server right now.
+func CheckOutbound(server string, payloadSize int) error {
+	server = strings.ToLower(server)
+	return check(For(server), bucketKey{peer: server, direction: "out"}, payloadSize)
+}
+
+// CheckInbound checks a request from server. signed is if the request's signature was verified to be from them.
+// Unsigned requests are limited by remoteAddress instead, since anyone can say they're server.
+func CheckInbound(server string, signed bool, remoteAddress string, payloadSize int) error {
+	server = strings.ToLower(server)
+	policy := For(server)
+	if signed {
+		return check(policy, bucketKey{peer: server, direction: "in"}, payloadSize)
+	}
+
+	if policy.Action == ActionRequireSigned {
+		return ErrNotSigned
+	}
+	limits := For(defaultPeer)
+	limits.Action = policy.Action
+	return check(limits, bucketKey{peer: defaultPeer, from: remoteAddress, direction: "in"}, payloadSize)
+}
+
+func check(policy Policy, key bucketKey, payloadSize int) error {
+	if policy.Action == ActionDeny {
+		return ErrDenied
+	}
+	if policy.MaxPayloadSize > 0 && payloadSize > policy.MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	if policy.RateLimit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	policyMu.Lock()
+	if now.Sub(lastSweep) > bucketIdleTimeout {
+		for k, b := range buckets {
+			if b.idle(now) {
+				delete(buckets, k)
+			}
+		}
+		lastSweep = now
+	}
+	b := buckets[key]
+	if b == nil {
+		b = newBucket(policy.RateLimit, policy.Burst)
+		buckets[key] = b
+	}
+	policyMu.Unlock()
+
+	if !b.take() {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// bucket is a token bucket, refilled at rate per second up to burst.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	b := &bucket{last: time.Now()}
+	b.setLimit(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *bucket) setLimit(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// idle is if the bucket hasn't been used in bucketIdleTimeout, and it's full again.
+func (b *bucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	idleFor := now.Sub(b.last)
+	return idleFor > bucketIdleTimeout && (b.rate <= 0 || b.tokens+idleFor.Seconds()*b.rate >= b.burst)
+}
+
+func (b *bucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.rate <= 0 {
+		return true // the limit was taken away by a reload
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,202 @@
+package peerpolicy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+)
+
+// useTestPolicies swaps in policies for a test, with no buckets, and clears them after.
+func useTestPolicies(t *testing.T, loaded map[string]Policy) {
+	t.Helper()
+	policyMu.Lock()
+	buckets = map[bucketKey]*bucket{}
+	policyMu.Unlock()
+	Use(loaded)
+	t.Cleanup(func() {
+		policyMu.Lock()
+		buckets = map[bucketKey]*bucket{}
+		policyMu.Unlock()
+		Use(map[string]Policy{})
+	})
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  configPkg.PeerPolicyConfig
+		want    Policy
+		wantErr bool
+	}{
+		{name: "no action is allow", policy: configPkg.PeerPolicyConfig{}, want: Policy{Action: ActionAllow}},
+		{name: "any case", policy: configPkg.PeerPolicyConfig{Action: "Require_Signed"}, want: Policy{Action: ActionRequireSigned}},
+		{name: "limits", policy: configPkg.PeerPolicyConfig{Action: "deny", RateLimit: 2, Burst: 5, MaxPayloadSize: 100}, want: Policy{Action: ActionDeny, RateLimit: 2, Burst: 5, MaxPayloadSize: 100}},
+		{name: "unknown action", policy: configPkg.PeerPolicyConfig{Action: "maybe"}, wantErr: true},
+		{name: "negative limit", policy: configPkg.PeerPolicyConfig{RateLimit: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded, err := Parse(configPkg.Config{PeerPolicies: map[string]configPkg.PeerPolicyConfig{"Other.Example.com": tt.policy}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && loaded["other.example.com"] != tt.want {
+				t.Errorf("got %+v, want %+v", loaded["other.example.com"], tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckInbound(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies map[string]Policy
+		server   string
+		signed   bool
+		size     int
+		want     error
+	}{
+		{name: "no policies", server: "other.example.com"},
+		{name: "denied", policies: map[string]Policy{"other.example.com": {Action: ActionDeny}}, server: "other.example.com", signed: true, want: ErrDenied},
+		{name: "denied, any case", policies: map[string]Policy{"other.example.com": {Action: ActionDeny}}, server: "Other.Example.com", signed: true, want: ErrDenied},
+		{name: "everyone else denied", policies: map[string]Policy{"*": {Action: ActionDeny}}, server: "other.example.com", signed: true, want: ErrDenied},
+		{name: "allowed over everyone else", policies: map[string]Policy{"*": {Action: ActionDeny}, "other.example.com": {Action: ActionAllow}}, server: "other.example.com", signed: true},
+		{name: "signing required, signed", policies: map[string]Policy{"other.example.com": {Action: ActionRequireSigned}}, server: "other.example.com", signed: true},
+		{name: "signing required, unsigned", policies: map[string]Policy{"other.example.com": {Action: ActionRequireSigned}}, server: "other.example.com", want: ErrNotSigned},
+		{name: "payload too large", policies: map[string]Policy{"other.example.com": {MaxPayloadSize: 10}}, server: "other.example.com", signed: true, size: 11, want: ErrPayloadTooLarge},
+		{name: "payload just fits", policies: map[string]Policy{"other.example.com": {MaxPayloadSize: 10}}, server: "other.example.com", signed: true, size: 10},
+		// anyone can claim to be other.example.com, so it's limits only count when it's signed
+		{name: "unsigned gets everyone else's size limit", policies: map[string]Policy{"*": {MaxPayloadSize: 10}, "other.example.com": {MaxPayloadSize: 100}}, server: "other.example.com", size: 50, want: ErrPayloadTooLarge},
+		{name: "unsigned still gets the server's action", policies: map[string]Policy{"other.example.com": {Action: ActionDeny}}, server: "other.example.com", want: ErrDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestPolicies(t, tt.policies)
+			if err := CheckInbound(tt.server, tt.signed, "192.0.2.1", tt.size); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	limited := Policy{Action: ActionAllow, RateLimit: 0.001, Burst: 2}
+
+	tests := []struct {
+		name     string
+		policies map[string]Policy
+		check    func() error
+		want     []error // what each check in a row gives back
+	}{
+		{
+			name:     "outbound",
+			policies: map[string]Policy{"other.example.com": limited},
+			check:    func() error { return CheckOutbound("other.example.com", 0) },
+			want:     []error{nil, nil, ErrRateLimited},
+		},
+		{
+			name:     "inbound, signed",
+			policies: map[string]Policy{"other.example.com": limited},
+			check:    func() error { return CheckInbound("other.example.com", true, "192.0.2.1", 0) },
+			want:     []error{nil, nil, ErrRateLimited},
+		},
+		{
+			name:     "unlimited",
+			policies: map[string]Policy{"other.example.com": {Action: ActionAllow}},
+			check:    func() error { return CheckOutbound("other.example.com", 0) },
+			want:     []error{nil, nil, nil, nil},
+		},
+		{
+			name:     "burst of 0 is 1",
+			policies: map[string]Policy{"other.example.com": {RateLimit: 0.001}},
+			check:    func() error { return CheckOutbound("other.example.com", 0) },
+			want:     []error{nil, ErrRateLimited},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestPolicies(t, tt.policies)
+			for i, want := range tt.want {
+				if err := tt.check(); !errors.Is(err, want) {
+					t.Fatalf("check %d: got %v, want %v", i+1, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	useTestPolicies(t, map[string]Policy{
+		"*":                 {RateLimit: 0.001, Burst: 1},
+		"other.example.com": {RateLimit: 0.001, Burst: 1},
+	})
+
+	if err := CheckOutbound("other.example.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	// each way has it's own bucket
+	if err := CheckInbound("other.example.com", true, "192.0.2.1", 0); err != nil {
+		t.Errorf("inbound was limited by outbound: %v", err)
+	}
+
+	// unsigned requests are limited by where they come from, so someone pretending to be other.example.com can't
+	// use up it's limit, or anyone else's
+	if err := CheckInbound("other.example.com", false, "192.0.2.1", 0); err != nil {
+		t.Errorf("unsigned was limited by signed: %v", err)
+	}
+	if err := CheckInbound("third.example.com", false, "192.0.2.1", 0); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got %v for the same address claiming to be someone else, want %v", err, ErrRateLimited)
+	}
+	if err := CheckInbound("other.example.com", false, "192.0.2.2", 0); err != nil {
+		t.Errorf("another address was limited: %v", err)
+	}
+}
+
+func TestReloadKeepsBuckets(t *testing.T) {
+	useTestPolicies(t, map[string]Policy{"other.example.com": {RateLimit: 0.001, Burst: 1}})
+
+	if err := CheckOutbound("other.example.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	Use(map[string]Policy{"other.example.com": {RateLimit: 0.001, Burst: 1}})
+	if err := CheckOutbound("other.example.com", 0); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got %v after a reload, want %v", err, ErrRateLimited)
+	}
+
+	// taking the limit away lets it through straight away
+	Use(map[string]Policy{"other.example.com": {}})
+	if err := CheckOutbound("other.example.com", 0); err != nil {
+		t.Errorf("got %v with no limit", err)
+	}
+}
+
+func TestBucketIdle(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		last   time.Time
+		tokens float64
+		rate   float64
+		want   bool
+	}{
+		{name: "just used", last: now, tokens: 5, rate: 1},
+		{name: "full, but not idle long enough", last: now.Add(-bucketIdleTimeout / 2), tokens: 5, rate: 1},
+		{name: "idle & full", last: now.Add(-2 * bucketIdleTimeout), tokens: 5, rate: 1, want: true},
+		{name: "idle & filled back up", last: now.Add(-2 * bucketIdleTimeout), tokens: 0, rate: 1, want: true},
+		{name: "idle, still filling", last: now.Add(-2 * bucketIdleTimeout), tokens: 0, rate: 0.0001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bucket{rate: tt.rate, burst: 5, tokens: tt.tokens, last: tt.last}
+			if got := b.idle(now); got != tt.want {
+				t.Errorf("idle is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Credentials for providers (the backends sending notifications), each scoped to a set of bundle ids.
+
+package providerauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+)
+
+// APNS refuses tokens older than an hour, so do we
+const maxTokenAge = time.Hour
+
+var (
+	ErrMissingCredentials = errors.New("missing provider credentials")
+	ErrInvalidCredentials = errors.New("invalid provider credentials")
+	ErrExpiredToken       = errors.New("provider token has expired")
+)
+
+type Provider struct {
+	Name      string
+	BundleIds []string
+
+	apiKeyHash []byte
+	certHash   []byte
+
+	// JWT
+	keyId     string
+	teamId    string
+	publicKey *ecdsa.PublicKey
+}
+
+var (
+	providers   []*Provider
+	providersMu sync.RWMutex
+)
+
+// LoadProviders (re)loads the providers from the config.
+func LoadProviders(c configPkg.Config) error {
+	loaded, err := ParseProviders(c)
+	if err != nil {
+		return err
+	}
+	UseProviders(loaded)
+	return nil
+}
+
+// ParseProviders checks the providers in the config, and loads their keys, without using them yet.
+func ParseProviders(c configPkg.Config) ([]*Provider, error) {
+	loaded := make([]*Provider, 0, len(c.Providers))
+	for _, providerConfig := range c.Providers {
+		provider := &Provider{
+			Name:      providerConfig.Name,
+			BundleIds: providerConfig.BundleIds,
+			keyId:     providerConfig.KeyId,
+			teamId:    providerConfig.TeamId,
+		}
+
+		if providerConfig.APIKeyHash != "" {
+			hash, err := hex.DecodeString(providerConfig.APIKeyHash)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("provider %s: API_KEY_SHA256 must be a hex SHA256", providerConfig.Name)
+			}
+			provider.apiKeyHash = hash
+		}
+
+		if providerConfig.CertHash != "" {
+			hash, err := hex.DecodeString(providerConfig.CertHash)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("provider %s: CERT_SHA256 must be a hex SHA256", providerConfig.Name)
+			}
+			provider.certHash = hash
+		}
+
+		if providerConfig.PublicKeyPath != "" {
+			if providerConfig.KeyId == "" || providerConfig.TeamId == "" {
+				return nil, fmt.Errorf("provider %s: KEY_ID and TEAM_ID are needed for JWTs", providerConfig.Name)
+			}
+			publicKey, err := loadECPublicKey(providerConfig.PublicKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("provider %s: %w", providerConfig.Name, err)
+			}
+			provider.publicKey = publicKey
+		}
+
+		loaded = append(loaded, provider)
+	}
+
+	return loaded, nil
+}
+
+// UseProviders swaps in providers from ParseProviders.
+func UseProviders(loaded []*Provider) {
+	providersMu.Lock()
+	providers = loaded
+	providersMu.Unlock()
+}
+
+func loadECPublicKey(path string) (*ecdsa.PublicKey, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("public key is not PEM")
+	}
+	parsedKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := parsedKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an EC key")
+	}
+	return publicKey, nil
+}
+
+// CanSendTo reports if this provider is allowed to send to the app.
+func (p *Provider) CanSendTo(bundleId string) bool {
+	for _, allowed := range p.BundleIds {
+		if allowed == "*" || allowed == bundleId {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate checks an Authorization header, which is "Bearer <API key or ES256 JWT>".
+func Authenticate(authorization string) (*Provider, error) {
+	if authorization == "" {
+		return nil, ErrMissingCredentials
+	}
+	scheme, credential, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || credential == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	if strings.Count(credential, ".") == 2 {
+		return authenticateJWT(credential)
+	}
+	return authenticateAPIKey(credential)
+}
+
+func authenticateAPIKey(apiKey string) (*Provider, error) {
+	hash := sha256.Sum256([]byte(apiKey))
+
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	for _, provider := range providers {
+		if provider.apiKeyHash != nil && subtle.ConstantTimeCompare(provider.apiKeyHash, hash[:]) == 1 {
+			return provider, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// AuthenticateCertificate finds the provider for a TLS client certificate (DER).
+func AuthenticateCertificate(certDER []byte) (*Provider, error) {
+	hash := sha256.Sum256(certDER)
+
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	for _, provider := range providers {
+		if provider.certHash != nil && subtle.ConstantTimeCompare(provider.certHash, hash[:]) == 1 {
+			return provider, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// The same tokens APNS takes: {"alg":"ES256","kid":KEY_ID} {"iss":TEAM_ID,"iat":...}
+func authenticateJWT(token string) (*Provider, error) {
+	parts := strings.Split(token, ".")
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil || header.Alg != "ES256" {
+		return nil, ErrInvalidCredentials
+	}
+
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	providersMu.RLock()
+	var provider *Provider
+	for _, p := range providers {
+		if p.publicKey != nil && p.keyId == header.Kid && p.teamId == claims.Iss {
+			provider = p
+			break
+		}
+	}
+	providersMu.RUnlock()
+	if provider == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return nil, ErrInvalidCredentials
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(provider.publicKey, hash[:], r, s) {
+		return nil, ErrInvalidCredentials
+	}
+
+	issuedAt := time.Unix(claims.Iat, 0)
+	if time.Since(issuedAt) > maxTokenAge || time.Until(issuedAt) > 5*time.Minute {
+		return nil, ErrExpiredToken
+	}
+
+	return provider, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
@@ -0,0 +1,126 @@
+package router
+
+import (
+	"sync"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+const (
+	MaxBatchSize = 500
+	batchWorkers = 16 // how many messages in a batch get checked at once, most of the time is spent looking up tokens
+)
+
+var (
+	ErrRelayedBatch = newRouterError(ReasonBadRequest, "relayed messages have to be sent one at a time", nil)
+	// a batch is queued together, so one message in it can't be replayed on it's own
+	ErrIdempotentBatch = newRouterError(ReasonBadRequest, "idempotency keys can't be used in a batch, send it on it's own", nil)
+)
+
+// BatchResult is what happened to one message in a batch, in the same spot as the message was.
+type BatchResult struct {
+	Result SendResult
+	Err    error
+}
+
+// SendMessageBatch routes a batch of messages from a sender. Every message gets it's own result, one failing
+// doesn't stop the rest. The messages are checked concurrently, and then queued together, one transaction for
+// our devices and one for each server we're relaying to.
+func SendMessageBatch(msgs []DataToSend) []BatchResult {
+	results := make([]BatchResult, len(msgs))
+	prepared := make([]preparedMessage, len(msgs))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < batchWorkers && w < len(msgs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				prepared[i], results[i].Err = prepareBatchMessage(msgs[i])
+				results[i].Result = prepared[i].result
+			}
+		}()
+	}
+	for i := range msgs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var local []int
+	relays := map[string][]int{} // by destination
+	for i := range prepared {
+		if results[i].Err != nil {
+			continue
+		}
+		if prepared[i].relay != nil {
+			relays[prepared[i].relay.Destination] = append(relays[prepared[i].relay.Destination], i)
+		} else {
+			local = append(local, i)
+		}
+	}
+
+	commitBatch(local, prepared, results, func(group []int) error {
+		var queued []db.QueuedMessage
+		var dropped []db.DroppedMessage
+		for _, i := range group {
+			if prepared[i].dropped {
+				// these don't go in the queue, they just need a status
+				dropped = append(dropped, droppedMessage(prepared[i]))
+				continue
+			}
+			queued = append(queued, *prepared[i].queued)
+		}
+		return db.QueueAndDropMessages(queued, dropped, Config.QueueDepth)
+	})
+	for _, group := range relays {
+		commitBatch(group, prepared, results, func(group []int) error {
+			relayRows := make([]db.OutboundRelay, len(group))
+			for j, i := range group {
+				relayRows[j] = *prepared[i].relay
+			}
+			return db.QueueRelays(relayRows)
+		})
+	}
+
+	for _, i := range local {
+		if results[i].Err == nil && !prepared[i].dropped {
+			sendToConnection(prepared[i].msg)
+		}
+	}
+
+	return results
+}
+
+func prepareBatchMessage(msg DataToSend) (preparedMessage, error) {
+	if msg.ServerAddress == "" {
+		return preparedMessage{}, ErrServerAddressEmpty
+	}
+	if len(msg.Hops) > 0 {
+		return preparedMessage{}, ErrRelayedBatch
+	}
+	if msg.IdempotencyKey != "" {
+		return preparedMessage{}, ErrIdempotentBatch
+	}
+	assignMessageId(&msg)
+	return prepareMessage(msg)
+}
+
+// commitBatch queues a group of messages in one go. If that fails, they're queued one at a time instead,
+// so one bad message only fails itself.
+func commitBatch(group []int, prepared []preparedMessage, results []BatchResult, queue func(group []int) error) {
+	if len(group) == 0 {
+		return
+	}
+	if err := queue(group); err == nil {
+		return
+	} else if len(group) == 1 {
+		results[group[0]] = BatchResult{Err: queueError(err)}
+		return
+	}
+
+	for _, i := range group {
+		commitBatch([]int{i}, prepared, results, queue)
+	}
+}
@@ -0,0 +1,35 @@
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+func TestSendMessageBatch(t *testing.T) {
+	routingKey := useTestStore(t)
+
+	results := SendMessageBatch([]DataToSend{
+		testMessage(routingKey, "", "hello"),
+		testMessage(routingKey, "key", "hello"), // it'd never be replayed, so it's turned away
+		testMessage(routingKey, "", "goodbye"),
+		{RoutingKeyStr: routingKey},
+	})
+
+	wantErrs := []error{nil, ErrIdempotentBatch, nil, ErrServerAddressEmpty}
+	for i, want := range wantErrs {
+		if !errors.Is(results[i].Err, want) {
+			t.Errorf("message %d: got %v, want %v", i, results[i].Err, want)
+		}
+	}
+
+	queued, err := db.GetUnacknowledgedMessagesAfterUnixTime("device@"+testServerAddress, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 2 {
+		t.Errorf("%d messages queued, want 2", len(queued))
+	}
+}
@@ -0,0 +1,200 @@
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/google/uuid"
+)
+
+// A broadcast sends the same notification to every valid token for an app on this server. It's saved, and the
+// broadcast worker queues it a batch of tokens at a time, saving how far it got after each one. Each batch is it's
+// own short transaction, with a break in between, so the queue & everything else still gets a turn.
+
+const (
+	broadcastLease    = 2 * time.Minute
+	broadcastIdleWait = 5 * time.Second
+)
+
+var (
+	ErrBroadcastAuthRequired = newRouterError(ReasonUnauthorized, "provider credentials are required to broadcast", nil)
+	ErrBroadcastTopic        = newRouterError(ReasonBadRequest, "topic is required to broadcast", nil)
+	ErrBroadcastEncrypted    = newRouterError(ReasonBadRequest, "broadcasts can't be encrypted, every device has it's own key", nil)
+)
+
+// StartBroadcast checks a notification and saves it to be broadcast to every token for msg.Topic.
+func StartBroadcast(msg DataToSend) (*db.Broadcast, error) {
+	if msg.Provider == nil {
+		return nil, ErrBroadcastAuthRequired
+	}
+	if msg.Topic == "" {
+		return nil, ErrBroadcastTopic
+	}
+	if msg.IsEncrypted {
+		return nil, ErrBroadcastEncrypted
+	}
+	if err := checkProvider(msg, msg.Topic); err != nil {
+		return nil, err
+	}
+	if _, err := checkQueueOptions(msg); err != nil {
+		return nil, err
+	}
+	if err := checkPayloadSize(msg); err != nil {
+		return nil, err
+	}
+
+	// it's going to a lot of tokens, so none of these mean anything
+	msg.RoutingKeyStr = ""
+	msg.ServerAddress = ""
+	msg.MessageId = ""
+	msg.Hops = nil
+	msg.TotalHops = 0
+	msg.IdempotencyKey = ""
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, newRouterError(ReasonBadRequest, "data could not be encoded", err)
+	}
+
+	broadcast, err := db.CreateBroadcast(db.Broadcast{
+		BroadcastId: uuid.New().String(),
+		Sender:      senderForProvider(msg.Provider),
+		BundleId:    msg.Topic,
+		Body:        body,
+	})
+	if err != nil {
+		return nil, newRouterError(ReasonInternalError, "failed to save broadcast", err)
+	}
+	return broadcast, nil
+}
+
+// GetBroadcast gets how a broadcast is going. Only the provider that started it can see it, everyone else gets
+// sql.ErrNoRows.
+func GetBroadcast(broadcastId string, provider *providerauth.Provider) (*db.Broadcast, error) {
+	broadcast, err := db.GetBroadcast(broadcastId)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil || broadcast.Sender != senderForProvider(provider) {
+		return nil, sql.ErrNoRows
+	}
+	return broadcast, nil
+}
+
+// StartBroadcastWorker starts the worker that queues broadcasts.
+func StartBroadcastWorker() {
+	go func() {
+		for {
+			broadcast, err := db.ClaimBroadcast(broadcastLease)
+			if err != nil {
+				log.Printf("failed to claim a broadcast: %v\n", err)
+				time.Sleep(broadcastIdleWait)
+				continue
+			}
+			if broadcast == nil {
+				time.Sleep(broadcastIdleWait)
+				continue
+			}
+			runBroadcast(*broadcast)
+		}
+	}()
+}
+
+func runBroadcast(broadcast db.Broadcast) {
+	var template DataToSend
+	if err := json.Unmarshal(broadcast.Body, &template); err != nil {
+		lastError := err.Error()
+		db.FinishBroadcast(broadcast.BroadcastId, db.BroadcastStatusFailed, &lastError)
+		return
+	}
+
+	cursor := broadcast.Cursor
+	for {
+		if template.Expiration != 0 && template.Expiration <= time.Now().Unix() {
+			db.FinishBroadcast(broadcast.BroadcastId, db.BroadcastStatusExpired, nil)
+			return
+		}
+
+		tokens, err := db.GetBroadcastTokens(broadcast.BundleId, cursor, Config.BroadcastBatchSize)
+		if err != nil {
+			// someone else will pick it up once the lease runs out
+			log.Printf("failed to get tokens for broadcast %s: %v\n", broadcast.BroadcastId, err)
+			return
+		}
+		if len(tokens) == 0 {
+			if err := db.FinishBroadcast(broadcast.BroadcastId, db.BroadcastStatusDone, nil); err != nil {
+				log.Printf("failed to finish broadcast %s: %v\n", broadcast.BroadcastId, err)
+			}
+			return
+		}
+
+		if err := queueBroadcastBatch(broadcast, template, tokens); err != nil {
+			log.Printf("failed to queue a batch of broadcast %s: %v\n", broadcast.BroadcastId, err)
+			return
+		}
+		cursor = tokens[len(tokens)-1].RoutingToken
+
+		time.Sleep(Config.BroadcastBatchDelay)
+	}
+}
+
+// queueBroadcastBatch queues the broadcast for a batch of tokens, and sends it to anyone who's connected.
+func queueBroadcastBatch(broadcast db.Broadcast, template DataToSend, tokens []db.NotificationToken) error {
+	broadcastId := broadcast.BroadcastId
+	opts, err := checkQueueOptions(template)
+	if err != nil {
+		return err
+	}
+
+	progress := db.BroadcastProgress{Cursor: tokens[len(tokens)-1].RoutingToken}
+	var msgs []DataToSend
+	var queued []db.QueuedMessage
+	for _, token := range tokens {
+		msg := template
+		msg.MessageId = uuid.New().String()
+		msg.CreatedAt = time.Now()
+		msg.RoutingKey = token.RoutingToken
+		msg.DeviceAddress = token.DeviceAddress
+
+		var hasSomethingToShow bool
+		msg.Data, _, hasSomethingToShow = filterNotificationTypes(template.Data, token.NotificationType)
+		if !hasSomethingToShow {
+			progress.Skipped++
+			continue
+		}
+
+		m := newQueuedMessage(msg, opts)
+		m.Sender = broadcast.Sender
+		msgs = append(msgs, msg)
+		queued = append(queued, m)
+	}
+
+	progress.Queued = len(queued)
+	if err := db.QueueBroadcastBatch(broadcastId, queued, Config.QueueDepth, progress, broadcastLease); err != nil {
+		// something in the batch couldn't be queued (like a full schedule), so go one at a time to find it
+		log.Printf("failed to queue broadcast %s as a batch, trying one at a time: %v\n", broadcastId, err)
+		progress.Queued = 0
+		sent := msgs[:0]
+		for i, m := range queued {
+			if err := db.QueueMessages([]db.QueuedMessage{m}, Config.QueueDepth); err != nil {
+				progress.Failed++
+				continue
+			}
+			progress.Queued++
+			sent = append(sent, msgs[i])
+		}
+		msgs = sent
+		if err := db.UpdateBroadcastProgress(broadcastId, progress, broadcastLease); err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range msgs {
+		sendToConnection(msg)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/google/uuid"
+)
+
+// With CLUSTER on, a few servers can share a database (behind a load balancer or similar). Each one keeps track of
+// which devices are connected to it in the database, and listens on it's own postgres channel. When a message is
+// for a device connected to another server, it's told to send it over it's channel. Only the message id goes over,
+// the message itself is read from the queue, so it's never too big for a NOTIFY.
+
+const (
+	clusterHeartbeat       = 30 * time.Second
+	clusterInstanceTimeout = 2 * time.Minute // a server that hasn't checked in for this long is gone
+
+	clusterEventDeliver  = "deliver"
+	clusterEventReplaced = "replaced"
+)
+
+// us, in the cluster. Empty when CLUSTER is off.
+var instanceId string
+
+type clusterEvent struct {
+	Type          string    `json:"type"`
+	DeviceAddress string    `json:"device_address"`
+	MessageId     string    `json:"message_id,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at,omitempty"` // when the new connection was made, for replaced
+}
+
+// StartCluster joins the cluster, if CLUSTER is on. It has to be called before any devices connect.
+func StartCluster() error {
+	if !Config.Cluster {
+		return nil
+	}
+
+	id := strings.ReplaceAll(uuid.New().String(), "-", "")
+	if err := db.HeartbeatInstance(id); err != nil {
+		return err
+	}
+	if err := db.Listen(clusterChannel(id), handleClusterEvent); err != nil {
+		return err
+	}
+	instanceId = id
+
+	go func() {
+		ticker := time.NewTicker(clusterHeartbeat)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := db.HeartbeatInstance(instanceId); err != nil {
+				log.Printf("failed to check in with the cluster: %v\n", err)
+			}
+			if n, err := db.PurgeDeadInstances(clusterInstanceTimeout); err != nil {
+				log.Printf("failed to purge dead cluster instances: %v\n", err)
+			} else if n > 0 {
+				log.Printf("forgot about %d servers that left the cluster\n", n)
+			}
+		}
+	}()
+
+	log.Printf("joined the cluster as %s\n", instanceId)
+	return nil
+}
+
+func clusterChannel(instanceId string) string {
+	return "sgn_" + instanceId
+}
+
+func publishClusterEvent(to string, event clusterEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to encode cluster event: %v\n", err)
+		return
+	}
+	if err := db.Notify(clusterChannel(to), string(payload)); err != nil {
+		log.Printf("failed to send %s for %s to %s: %v\n", event.Type, event.DeviceAddress, to, err)
+	}
+}
+
+// claimConnection records that the device is connected to us, and tells the server it was connected to before
+// that it's been replaced.
+func claimConnection(deviceAddress string, connectedAt time.Time) {
+	if instanceId == "" {
+		return
+	}
+	previous, err := db.SetConnectionOwner(deviceAddress, instanceId, connectedAt)
+	if err != nil {
+		log.Printf("failed to claim the connection for %s: %v\n", deviceAddress, err)
+		return
+	}
+	if previous != nil {
+		publishClusterEvent(*previous, clusterEvent{Type: clusterEventReplaced, DeviceAddress: deviceAddress, ConnectedAt: connectedAt})
+	}
+}
+
+func releaseConnection(deviceAddress string) {
+	if instanceId == "" {
+		return
+	}
+	if err := db.RemoveConnectionOwner(deviceAddress, instanceId); err != nil {
+		log.Printf("failed to release the connection for %s: %v\n", deviceAddress, err)
+	}
+}
+
+// sendToClusterConnection tells whichever server the device is connected to to send it the message.
+func sendToClusterConnection(msg DataToSend) {
+	if instanceId == "" {
+		return
+	}
+	owner, err := db.GetConnectionOwner(msg.DeviceAddress)
+	if errors.Is(err, sql.ErrNoRows) {
+		// it'll get it next time it polls
+		return
+	} else if err != nil {
+		log.Printf("failed to find the connection for %s: %v\n", msg.DeviceAddress, err)
+		return
+	}
+	if owner == instanceId {
+		// it's already gone from us, we just haven't released it yet
+		return
+	}
+	publishClusterEvent(owner, clusterEvent{Type: clusterEventDeliver, DeviceAddress: msg.DeviceAddress, MessageId: msg.MessageId})
+}
+
+func handleClusterEvent(payload string) {
+	var event clusterEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		log.Printf("failed to read cluster event: %v\n", err)
+		return
+	}
+
+	switch event.Type {
+	case clusterEventDeliver:
+		queued, err := db.GetQueuedMessage(event.MessageId)
+		if errors.Is(err, sql.ErrNoRows) {
+			// acked, expired or replaced before it got here
+			return
+		} else if err != nil {
+			log.Printf("failed to get message %s for the cluster: %v\n", event.MessageId, err)
+			return
+		}
+		sendToLocalConnection(dataFromQueued(*queued))
+	case clusterEventReplaced:
+		connectionsMu.Lock()
+		conn, ok := connections[event.DeviceAddress]
+		// if it connected to us again after connecting over there, this one's the newest
+		if ok && conn.since.Before(event.ConnectedAt) {
+			delete(connections, event.DeviceAddress)
+		} else {
+			ok = false
+		}
+		connectionsMu.Unlock()
+
+		if ok {
+			disconnect(conn.ch, true)
+		}
+	default:
+		log.Printf("unknown cluster event %q\n", event.Type)
+	}
+}
@@ -0,0 +1,57 @@
+package router
+
+import (
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+// Messages sent with deliver_once are handed to the device if it's connected right now, and dropped instead of
+// queued if it isn't. It's what APNS does with an apns-expiration of 0 (and the legacy binary API with an expiry of 0).
+
+// a deliver once message is only queued long enough for the connection it was sent to to get it (or for a relay
+// to reach the device's server)
+const deliverOnceWindow = time.Minute
+
+var ErrDeliverOnceScheduled = newRouterError(ReasonBadRequest, "deliver_once messages can't have a deliver_at", nil)
+
+// the reason deliver once messages get in their status when the device wasn't there
+var deliverOnceDroppedReason = "the device wasn't connected, and it was only to be delivered once"
+
+// ApplyAPNSExpiration sets a message's expiration the way APNS reads it. If the sender didn't give one (given is
+// false), it's kept for as long as the server keeps messages. 0 is deliver it now or never, anything else is a unix
+// timestamp.
+func ApplyAPNSExpiration(msg *DataToSend, expiration int64, given bool) {
+	switch {
+	case !given:
+		msg.Expiration = 0
+	case expiration == 0:
+		msg.DeliverOnce = true
+	default:
+		msg.Expiration = expiration
+	}
+}
+
+// deliverOnceExpiration caps when a deliver once message expires to deliverOnceWindow from now.
+func deliverOnceExpiration(msg DataToSend, expiresAt *time.Time) *time.Time {
+	if !msg.DeliverOnce {
+		return expiresAt
+	}
+	limit := time.Now().Add(deliverOnceWindow)
+	if expiresAt != nil && expiresAt.Before(limit) {
+		return expiresAt
+	}
+	return &limit
+}
+
+// isConnected is if the device is connected to us, or another server in the cluster, right now.
+func isConnected(deviceAddress string) bool {
+	connectionsMu.RLock()
+	_, ok := connections[deviceAddress]
+	connectionsMu.RUnlock()
+	if ok || instanceId == "" {
+		return ok
+	}
+	owner, err := db.GetConnectionOwner(deviceAddress)
+	return err == nil && owner != instanceId
+}
@@ -0,0 +1,112 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Preloading/SkyglowNotificationServer/peerpolicy"
+)
+
+// ErrorReason is a stable code for why a message couldn't be routed, safe for senders to switch on.
+type ErrorReason string
+
+const (
+	ReasonBadRequest            ErrorReason = "BadRequest"
+	ReasonBadRoutingKey         ErrorReason = "BadRoutingKey"
+	ReasonUnknownToken          ErrorReason = "UnknownToken"
+	ReasonTokenMarkedForRemoval ErrorReason = "TokenMarkedForRemoval"
+	ReasonTokenInvalid          ErrorReason = "TokenInvalid"
+	ReasonTopicMismatch         ErrorReason = "TopicMismatch"
+	ReasonPayloadTooLarge       ErrorReason = "PayloadTooLarge"
+	ReasonMessageExpired        ErrorReason = "MessageExpired"
+	ReasonNotificationTypesOff  ErrorReason = "NotificationTypesOff"
+	ReasonPeerUnreachable       ErrorReason = "PeerUnreachable"
+	ReasonPeerRejected          ErrorReason = "PeerRejected"
+	ReasonHopLimitExceeded      ErrorReason = "HopLimitExceeded"
+	ReasonRoutingLoop           ErrorReason = "RoutingLoop"
+	ReasonUnauthorized          ErrorReason = "Unauthorized"
+	ReasonProviderNotAllowed    ErrorReason = "ProviderNotAllowed"
+	ReasonRelayNotAccepted      ErrorReason = "RelayNotAccepted"
+	ReasonPeerNotAllowed        ErrorReason = "PeerNotAllowed"
+	ReasonRateLimited           ErrorReason = "RateLimited"
+	ReasonIdempotencyKeyReused  ErrorReason = "IdempotencyKeyReused"
+	ReasonIdempotencyKeyInUse   ErrorReason = "IdempotencyKeyInUse"
+	ReasonScheduleFull          ErrorReason = "ScheduleFull"
+	ReasonNotCancellable        ErrorReason = "NotCancellable"
+	ReasonInternalError         ErrorReason = "InternalError"
+)
+
+type RouterError struct {
+	Reason  ErrorReason
+	Message string
+	Err     error // what caused it, if anything
+}
+
+func (e *RouterError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *RouterError) Unwrap() error {
+	return e.Err
+}
+
+func newRouterError(reason ErrorReason, message string, err error) *RouterError {
+	return &RouterError{Reason: reason, Message: message, Err: err}
+}
+
+var (
+	ErrServerAddressEmpty    = newRouterError(ReasonBadRequest, "server address is empty, cannot send message", nil)
+	ErrRoutingKeyNotHex      = newRouterError(ReasonBadRoutingKey, "routing key not in hex", nil)
+	ErrRoutingKeyInvalid     = newRouterError(ReasonUnknownToken, "routing key invalid", nil)
+	ErrTokenMarkedForRemoval = newRouterError(ReasonTokenMarkedForRemoval, "routing key is marked for removal", nil)
+	ErrTokenNoLongerValid    = newRouterError(ReasonTokenInvalid, "routing key is no longer valid", nil)
+	ErrTopicMismatch         = newRouterError(ReasonTopicMismatch, "bundle id isn't correct for this routing key", nil)
+	ErrPayloadTooLarge       = newRouterError(ReasonPayloadTooLarge, "payload is too large (> 4096 bytes)", nil)
+	ErrMessageExpired        = newRouterError(ReasonMessageExpired, "message has already expired", nil)
+	ErrCollapseIdTooLong     = newRouterError(ReasonBadRequest, "collapse id is too long (> 64)", nil)
+	ErrNotificationTypesOff  = newRouterError(ReasonNotificationTypesOff, "the user has turned off every notification type in this message", nil)
+	ErrHopLimitExceeded      = newRouterError(ReasonHopLimitExceeded, "hop limit exceeded", nil)
+	ErrRoutingLoop           = newRouterError(ReasonRoutingLoop, "message has already been through this server", nil)
+	ErrProviderAuthRequired  = newRouterError(ReasonUnauthorized, "provider credentials are required to send", nil)
+	ErrProviderNotAllowed    = newRouterError(ReasonProviderNotAllowed, "provider isn't allowed to send to this app", nil)
+	ErrTopicRequired         = newRouterError(ReasonBadRequest, "topic is required when sending to another server", nil)
+	ErrRelayNotAccepted      = newRouterError(ReasonRelayNotAccepted, "this server doesn't accept relayed messages", nil)
+	ErrRelayNotSigned        = newRouterError(ReasonUnauthorized, "relayed messages must be signed by the relaying server", nil)
+	ErrRelayOverWebsocket    = newRouterError(ReasonBadRequest, "relayed messages have to be sent to /send", nil)
+)
+
+// peerPolicyError turns an error from peerpolicy into one of ours.
+func peerPolicyError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, peerpolicy.ErrDenied):
+		return newRouterError(ReasonPeerNotAllowed, err.Error(), nil)
+	case errors.Is(err, peerpolicy.ErrNotSigned):
+		return newRouterError(ReasonUnauthorized, err.Error(), nil)
+	case errors.Is(err, peerpolicy.ErrRateLimited):
+		return newRouterError(ReasonRateLimited, err.Error(), nil)
+	case errors.Is(err, peerpolicy.ErrPayloadTooLarge):
+		return newRouterError(ReasonPayloadTooLarge, err.Error(), nil)
+	default:
+		return newRouterError(ReasonInternalError, "failed to check peer policy", err)
+	}
+}
+
+// CheckInboundPeer checks a federation request from server against it's peer policy.
+// signed is if we verified the request's signature came from server, remoteAddress is where an unsigned one came from.
+func CheckInboundPeer(server string, signed bool, remoteAddress string, payloadSize int) error {
+	return peerPolicyError(peerpolicy.CheckInbound(server, signed, remoteAddress, payloadSize))
+}
+
+// ReasonOf gets the reason out of an error from the router. Anything we didn't make ourselves is an internal error.
+func ReasonOf(err error) ErrorReason {
+	var routerErr *RouterError
+	if errors.As(err, &routerErr) {
+		return routerErr.Reason
+	}
+	return ReasonInternalError
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+	// how long a request has to finish before a retry with the same key can take over, it's only this short so a
+	// request that never finished (the server crashed) doesn't hold the key for the whole IDEMPOTENCY_WINDOW
+	idempotencyLease = 30 * time.Second
+)
+
+var (
+	ErrIdempotencyKeyTooLong = newRouterError(ReasonBadRequest, "idempotency key is too long (> 255)", nil)
+	ErrIdempotencyKeyReused  = newRouterError(ReasonIdempotencyKeyReused, "idempotency key was already used for a different notification", nil)
+	ErrIdempotencyKeyInUse   = newRouterError(ReasonIdempotencyKeyInUse, "a notification with this idempotency key is still being sent", nil)
+)
+
+// what we remember about a request with an idempotency key
+type idempotentResult struct {
+	MessageId    string      `json:"message_id,omitempty"`
+	RelayQueued  bool        `json:"relay_queued,omitempty"`
+	Dropped      bool        `json:"dropped,omitempty"`
+	StrippedKeys []string    `json:"stripped_keys,omitempty"`
+	Reason       ErrorReason `json:"reason,omitempty"`
+	Message      string      `json:"message,omitempty"`
+}
+
+// sendIdempotently routes a message once per idempotency key. Sending it again with the same key (within
+// IDEMPOTENCY_WINDOW) gives back what happened the first time, without queueing it again.
+// Keys are per sender, so two senders picking the same key don't get each other's results.
+func sendIdempotently(msg DataToSend) (SendResult, error) {
+	if len(msg.IdempotencyKey) > maxIdempotencyKeyLength {
+		return SendResult{}, ErrIdempotencyKeyTooLong
+	}
+
+	scope := senderOf(msg)
+	requestHash, err := idempotencyRequestHash(msg)
+	if err != nil {
+		return SendResult{}, newRouterError(ReasonBadRequest, "data could not be encoded", err)
+	}
+
+	claimed, existing, err := db.ClaimIdempotencyKey(scope, msg.IdempotencyKey, requestHash, idempotencyLease)
+	if err != nil {
+		return SendResult{}, newRouterError(ReasonInternalError, "failed to check idempotency key", err)
+	}
+	if !claimed {
+		if !bytes.Equal(existing.RequestHash, requestHash) {
+			return SendResult{}, ErrIdempotencyKeyReused
+		}
+		if existing.Result == nil {
+			return SendResult{}, ErrIdempotencyKeyInUse
+		}
+
+		var stored idempotentResult
+		if err := json.Unmarshal(existing.Result, &stored); err != nil {
+			return SendResult{}, newRouterError(ReasonInternalError, "failed to read idempotency key", err)
+		}
+		result := SendResult{MessageId: stored.MessageId, RelayQueued: stored.RelayQueued, StrippedKeys: stored.StrippedKeys, Dropped: stored.Dropped, Replayed: true}
+		if stored.Reason != "" {
+			return result, newRouterError(stored.Reason, stored.Message, nil)
+		}
+		return result, nil
+	}
+
+	result, err := withMessageIdentity(msg, routeMessage)
+
+	if err != nil {
+		switch ReasonOf(err) {
+		case ReasonInternalError, ReasonPeerUnreachable, ReasonRateLimited:
+			// it might work next time, so let them retry it for real
+			if releaseErr := db.ReleaseIdempotencyKey(scope, msg.IdempotencyKey); releaseErr != nil {
+				log.Printf("failed to release idempotency key: %v\n", releaseErr)
+			}
+			return result, err
+		}
+	}
+
+	stored := idempotentResult{MessageId: result.MessageId, RelayQueued: result.RelayQueued, StrippedKeys: result.StrippedKeys, Dropped: result.Dropped}
+	if err != nil {
+		stored.Reason = ReasonOf(err)
+		stored.Message = err.Error()
+	}
+	storedJson, _ := json.Marshal(stored)
+	if finishErr := db.FinishIdempotencyKey(scope, msg.IdempotencyKey, storedJson, Config.IdempotencyWindow); finishErr != nil {
+		log.Printf("failed to save idempotency key: %v\n", finishErr)
+	}
+	return result, err
+}
+
+func idempotencyRequestHash(msg DataToSend) ([]byte, error) {
+	// the message id is ours to set, a sender retrying might not send back what it was given
+	msg.MessageId = ""
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(encoded)
+	return hash[:], nil
+}
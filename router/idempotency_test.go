@@ -0,0 +1,170 @@
+package router
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+)
+
+const testServerAddress = "sgn.example.com"
+
+// useTestStore gives a test it's own memory store, with a token for com.example.app on it. The routing key is given
+// back as hex, like senders have it.
+func useTestStore(t *testing.T) string {
+	t.Helper()
+	useTestConfig(t, configPkg.Config{ServerAddress: testServerAddress, QueueDepth: 10, IdempotencyWindow: time.Hour})
+	db.UseStore(db.NewMemoryStore())
+
+	routingKey := []byte("routing key")
+	if err := db.SaveNewToken("device@"+testServerAddress, routingKey, "com.example.app", db.NotificationTypeAlert); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(routingKey)
+}
+
+func testMessage(routingKey string, idempotencyKey string, alert string) DataToSend {
+	return DataToSend{
+		Data:           map[string]interface{}{"aps": map[string]interface{}{"alert": alert}},
+		RoutingKeyStr:  routingKey,
+		ServerAddress:  testServerAddress,
+		IdempotencyKey: idempotencyKey,
+	}
+}
+
+func TestIdempotencyRequestHash(t *testing.T) {
+	hello := DataToSend{Data: map[string]interface{}{"aps": map[string]interface{}{"alert": "hello"}}, RoutingKeyStr: "abcd", ServerAddress: "sgn.example.com"}
+
+	tests := []struct {
+		name     string
+		change   func(*DataToSend)
+		wantSame bool
+	}{
+		{name: "same again", change: func(*DataToSend) {}, wantSame: true},
+		{name: "another message id", change: func(msg *DataToSend) { msg.MessageId = "another" }, wantSame: true},
+		{name: "another alert", change: func(msg *DataToSend) {
+			msg.Data = map[string]interface{}{"aps": map[string]interface{}{"alert": "goodbye"}}
+		}},
+		{name: "another device", change: func(msg *DataToSend) { msg.RoutingKeyStr = "dcba" }},
+	}
+
+	want, err := idempotencyRequestHash(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := hello
+			tt.change(&msg)
+			got, err := idempotencyRequestHash(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, want) != tt.wantSame {
+				t.Errorf("hashed the same: %v, want %v", !tt.wantSame, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestSendIdempotently(t *testing.T) {
+	app := &providerauth.Provider{Name: "app", BundleIds: []string{"com.example.app"}}
+	other := &providerauth.Provider{Name: "other", BundleIds: []string{"com.example.app"}}
+
+	tests := []struct {
+		name string
+		// the second send, after "hello" was sent with the key "key" by app
+		key          string
+		alert        string
+		provider     *providerauth.Provider
+		wantErr      error
+		wantReplayed bool
+		wantQueued   int // how many messages end up queued
+	}{
+		{name: "same again", key: "key", alert: "hello", provider: app, wantReplayed: true, wantQueued: 1},
+		{name: "something else with the same key", key: "key", alert: "goodbye", provider: app, wantErr: ErrIdempotencyKeyReused, wantQueued: 1},
+		{name: "another key", key: "another key", alert: "hello", provider: app, wantQueued: 2},
+		{name: "no key", key: "", alert: "hello", provider: app, wantQueued: 2},
+		{name: "another sender with the same key", key: "key", alert: "hello", provider: other, wantQueued: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routingKey := useTestStore(t)
+
+			first := testMessage(routingKey, "key", "hello")
+			first.Provider = app
+			firstResult, err := SendMessageToRouter(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			second := testMessage(routingKey, tt.key, tt.alert)
+			second.Provider = tt.provider
+			result, err := SendMessageToRouter(second)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if result.Replayed != tt.wantReplayed {
+				t.Errorf("replayed is %v, want %v", result.Replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && result.MessageId != firstResult.MessageId {
+				t.Errorf("replayed message id %s, want %s", result.MessageId, firstResult.MessageId)
+			}
+
+			queued, err := db.GetUnacknowledgedMessagesAfterUnixTime("device@"+testServerAddress, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queued) != tt.wantQueued {
+				t.Errorf("%d messages queued, want %d", len(queued), tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestSendIdempotentlyRemembersErrors(t *testing.T) {
+	useTestStore(t)
+
+	// the alert's all there is, and it's turned off, so it's never going to work
+	if err := db.SaveNewToken("device@"+testServerAddress, []byte("quiet"), "com.example.app", 0); err != nil {
+		t.Fatal(err)
+	}
+	msg := testMessage(hex.EncodeToString([]byte("quiet")), "key", "hello")
+	if _, err := SendMessageToRouter(msg); !errors.Is(err, ErrNotificationTypesOff) {
+		t.Fatalf("got %v, want %v", err, ErrNotificationTypesOff)
+	}
+
+	result, err := SendMessageToRouter(msg)
+	if ReasonOf(err) != ReasonOf(ErrNotificationTypesOff) || !result.Replayed {
+		t.Errorf("got %v (replayed %v), want the first error replayed", err, result.Replayed)
+	}
+}
+
+func TestSendIdempotentlyInProgress(t *testing.T) {
+	routingKey := useTestStore(t)
+	msg := testMessage(routingKey, "key", "hello")
+
+	// someone else has it, and hasn't finished yet
+	hash, err := idempotencyRequestHash(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed, _, err := db.ClaimIdempotencyKey(senderOf(msg), "key", hash, 100*time.Millisecond); !claimed || err != nil {
+		t.Fatalf("couldn't claim the key: %v", err)
+	}
+	if _, err := SendMessageToRouter(msg); !errors.Is(err, ErrIdempotencyKeyInUse) {
+		t.Fatalf("got %v, want %v", err, ErrIdempotencyKeyInUse)
+	}
+
+	// once their lease is up, it's ours
+	time.Sleep(150 * time.Millisecond)
+	if result, err := SendMessageToRouter(msg); err != nil || result.Replayed {
+		t.Errorf("got %v (replayed %v), want it sent", err, result.Replayed)
+	}
+}
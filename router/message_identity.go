@@ -0,0 +1,107 @@
+package router
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how long we remember relayed messages, so the same one coming in twice (e.g. the other server retried after a timeout)
+// only gets queued once
+const seenMessageWindow = 10 * time.Minute
+
+type seenMessage struct {
+	result    SendResult
+	expiresAt time.Time
+}
+
+var (
+	seenMessages   = map[string]seenMessage{}
+	seenMessagesMu sync.Mutex
+)
+
+// withMessageIdentity gives a message it's id, makes sure it isn't going in circles, and drops it if we've already
+// routed it, before handing it to route.
+func withMessageIdentity(msg DataToSend, route func(DataToSend) (SendResult, error)) (SendResult, error) {
+	for _, hop := range msg.Hops {
+		if strings.EqualFold(hop, Config.ServerAddress) {
+			return SendResult{}, ErrRoutingLoop
+		}
+	}
+
+	assignMessageId(&msg)
+
+	// messages straight from a sender always get a new id, so there's nothing to compare them to
+	if len(msg.Hops) == 0 {
+		return route(msg)
+	}
+
+	key := seenMessageKey(msg)
+	if result, seen := claimMessageId(key, msg.MessageId); seen {
+		return result, nil
+	}
+	result, err := route(msg)
+	if err != nil {
+		// let them try again
+		forgetMessageId(key)
+		return result, err
+	}
+	rememberMessageId(key, result)
+	return result, nil
+}
+
+// assignMessageId gives a message it's id when it first comes in. Relayed messages keep the one they were given
+// by the first server, so it's the same everywhere it goes. Everything else gets a new one, senders don't get to
+// pick it, or they could take one that's already in use.
+func assignMessageId(msg *DataToSend) {
+	if len(msg.Hops) > 0 {
+		if _, err := uuid.Parse(msg.MessageId); err == nil {
+			return
+		}
+	}
+	msg.MessageId = uuid.New().String()
+}
+
+// the id alone isn't enough, or another server could stop a message it didn't send by reusing it's id
+func seenMessageKey(msg DataToSend) string {
+	return msg.MessageId + "|" + strings.ToLower(msg.ServerAddress) + "|" + strings.ToLower(msg.RoutingKeyStr)
+}
+
+// claimMessageId marks a message as being routed, or gives back what happened last time if it already was.
+func claimMessageId(key string, messageId string) (SendResult, bool) {
+	seenMessagesMu.Lock()
+	defer seenMessagesMu.Unlock()
+
+	if seen, ok := seenMessages[key]; ok && time.Now().Before(seen.expiresAt) {
+		return seen.result, true
+	}
+	// if the same one comes in while we're still routing it, it gets this
+	seenMessages[key] = seenMessage{result: SendResult{MessageId: messageId}, expiresAt: time.Now().Add(seenMessageWindow)}
+	return SendResult{}, false
+}
+
+func rememberMessageId(key string, result SendResult) {
+	seenMessagesMu.Lock()
+	seenMessages[key] = seenMessage{result: result, expiresAt: time.Now().Add(seenMessageWindow)}
+	seenMessagesMu.Unlock()
+}
+
+func forgetMessageId(key string) {
+	seenMessagesMu.Lock()
+	delete(seenMessages, key)
+	seenMessagesMu.Unlock()
+}
+
+func forgetOldMessageIds() {
+	seenMessagesMu.Lock()
+	defer seenMessagesMu.Unlock()
+
+	now := time.Now()
+	for key, seen := range seenMessages {
+		if !now.Before(seen.expiresAt) {
+			delete(seenMessages, key)
+		}
+	}
+}
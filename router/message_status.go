@@ -0,0 +1,63 @@
+package router
+
+import (
+	"database/sql"
+	"log"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+)
+
+// everyone who didn't authenticate is the same sender, so they can't be told apart when asking about a message
+const anonymousSender = "anonymous"
+
+// senderOf is who sent a message, as far as idempotency keys & the status API are concerned. A relay is from the
+// server that signed it. Anyone can fill in hops, so an unsigned relay is no one in particular.
+func senderOf(msg DataToSend) string {
+	switch {
+	case msg.RelayedFrom != "":
+		return senderForServer(msg.RelayedFrom)
+	case msg.Provider != nil:
+		return senderForProvider(msg.Provider)
+	default:
+		return anonymousSender
+	}
+}
+
+func senderForServer(server string) string {
+	return "server:" + server
+}
+
+// senderForProvider is who a provider is, nil being everyone who didn't authenticate.
+func senderForProvider(provider *providerauth.Provider) string {
+	if provider == nil {
+		return anonymousSender
+	}
+	return "provider:" + provider.Name
+}
+
+// MarkMessageDelivered records that a message was written to the device's connection.
+func MarkMessageDelivered(messageId string) {
+	if err := db.SetMessageStatus(messageId, db.MessageStatusDelivered, nil); err != nil {
+		log.Printf("failed to mark %s as delivered: %v\n", messageId, err)
+	}
+}
+
+// GetMessageStatus gets where a message is at. Only whoever sent it can see it, everyone else gets sql.ErrNoRows.
+// provider is who's asking, or nil if they didn't authenticate. server is the server asking, if it's signed the request.
+// Messages sent without credentials can't be looked up, anyone could be asking.
+func GetMessageStatus(messageId string, provider *providerauth.Provider, server string) (*db.MessageStatus, error) {
+	status, err := db.GetMessageStatus(messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	requester := senderForProvider(provider)
+	if server != "" {
+		requester = senderForServer(server)
+	}
+	if requester == anonymousSender || status.Sender != requester {
+		return nil, sql.ErrNoRows
+	}
+	return status, nil
+}
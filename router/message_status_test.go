@@ -0,0 +1,103 @@
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+)
+
+func TestSenderOf(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  DataToSend
+		want string
+	}{
+		{name: "anonymous", msg: DataToSend{}, want: anonymousSender},
+		{name: "provider", msg: DataToSend{Provider: &providerauth.Provider{Name: "app"}}, want: "provider:app"},
+		{name: "signed relay", msg: DataToSend{Hops: []string{"first.example.com", "other.example.com"}, RelayedFrom: "other.example.com"}, want: "server:other.example.com"},
+		// the hops are only what the request said
+		{name: "signed relay, hops say someone else", msg: DataToSend{Hops: []string{"third.example.com"}, RelayedFrom: "other.example.com"}, want: "server:other.example.com"},
+		{name: "unsigned relay", msg: DataToSend{Hops: []string{"other.example.com"}}, want: anonymousSender},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := senderOf(tt.msg); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMessageStatus(t *testing.T) {
+	app := &providerauth.Provider{Name: "app", BundleIds: []string{"com.example.app"}}
+	other := &providerauth.Provider{Name: "other", BundleIds: []string{"com.example.app"}}
+
+	tests := []struct {
+		name        string
+		sentBy      *providerauth.Provider
+		askedBy     *providerauth.Provider
+		askedByPeer string
+		wantFound   bool
+	}{
+		{name: "sender", sentBy: app, askedBy: app, wantFound: true},
+		{name: "another provider", sentBy: app, askedBy: other},
+		{name: "without credentials", sentBy: app},
+		{name: "another server", sentBy: app, askedByPeer: "other.example.com"},
+		// anyone could be asking
+		{name: "sent & asked without credentials", sentBy: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testMessage(useTestStore(t), "", "hello")
+			msg.Provider = tt.sentBy
+			result, err := SendMessageToRouter(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := GetMessageStatus(result.MessageId, tt.askedBy, tt.askedByPeer)
+			if tt.wantFound {
+				if err != nil || status.Status != db.MessageStatusQueued {
+					t.Errorf("got %+v, %v, want it queued", status, err)
+				}
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("got %+v, %v, want %v", status, err, sql.ErrNoRows)
+			}
+		})
+	}
+}
+
+func TestRelayedMessageStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		relayedFrom string // who signed it, if anyone
+		wantFound   bool
+	}{
+		{name: "signed", relayedFrom: "other.example.com", wantFound: true},
+		{name: "unsigned", relayedFrom: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testMessage(useTestStore(t), "", "hello")
+			Config.AcceptRelayedMessages = true
+			msg.Hops = []string{"other.example.com"}
+			msg.RelayedFrom = tt.relayedFrom
+			result, err := SendMessageToRouter(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// anyone can say they're other.example.com, it only counts if they signed it
+			_, err = GetMessageStatus(result.MessageId, nil, "other.example.com")
+			if found := err == nil; found != tt.wantFound {
+				t.Errorf("found it: %v (%v), want %v", found, err, tt.wantFound)
+			}
+		})
+	}
+}
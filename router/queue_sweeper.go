@@ -0,0 +1,40 @@
+package router
+
+import (
+	"log"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+var sweeperTicker *time.Ticker
+
+// StartQueueSweeper purges expired messages from the queue every interval.
+// Polls already skip expired messages, this just stops them piling up. Old idempotency keys, message statuses & broadcasts go too.
+func StartQueueSweeper(interval time.Duration) {
+	sweeperTicker = time.NewTicker(interval)
+
+	go func() {
+		for range sweeperTicker.C {
+			forgetOldMessageIds()
+			if _, err := db.PurgeExpiredIdempotencyKeys(); err != nil {
+				log.Printf("failed to purge expired idempotency keys: %v\n", err)
+			}
+			if _, err := db.PurgeOldMessageStatuses(Config.MessageStatusRetention); err != nil {
+				log.Printf("failed to purge old message statuses: %v\n", err)
+			}
+			if _, err := db.PurgeOldBroadcasts(Config.MessageStatusRetention); err != nil {
+				log.Printf("failed to purge old broadcasts: %v\n", err)
+			}
+
+			purged, err := db.PurgeExpiredMessages()
+			if err != nil {
+				log.Printf("failed to purge expired messages: %v\n", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("purged %d expired messages\n", purged)
+			}
+		}
+	}()
+}
@@ -0,0 +1,43 @@
+package router
+
+import (
+	"log"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+// rows are re-encrypted this many at a time, with a break in between
+const (
+	reencryptBatchSize  = 500
+	reencryptBatchDelay = 100 * time.Millisecond
+)
+
+// StartReencryption moves queued messages, relays & broadcasts onto the current at rest key every interval, so after
+// AT_REST_KEY_ID is changed nothing's left under the old one (and if it's cleared, they're decrypted). It also goes
+// straight away, so a rotation gets picked up as soon as we start.
+func StartReencryption(interval time.Duration) {
+	go func() {
+		for {
+			moved := 0
+			var cursor db.ReencryptCursor
+			for {
+				n, done, err := db.ReencryptAtRest(&cursor, reencryptBatchSize)
+				if err != nil {
+					log.Printf("failed to re-encrypt at rest: %v\n", err)
+					break
+				}
+				moved += n
+				if done {
+					break
+				}
+				time.Sleep(reencryptBatchDelay)
+			}
+			if moved > 0 {
+				log.Printf("re-encrypted %d queued messages, relays & broadcasts with the current at rest key\n", moved)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/google/uuid"
+)
+
+const (
+	relayBaseBackoff = 5 * time.Second
+	relayMaxBackoff  = time.Hour
+	relayLease       = 2 * time.Minute // how long a worker gets to deliver a relay before someone else tries
+	relayBatchSize   = 10
+	relayIdleWait    = time.Second
+)
+
+// QueueMessageForRelay stores a message for another server, and the relay workers will deliver it.
+func QueueMessageForRelay(msg DataToSend) (SendResult, error) {
+	prepared, err := prepareRelay(msg)
+	if err != nil {
+		return SendResult{}, err
+	}
+	return commitMessage(prepared)
+}
+
+func prepareRelay(msg DataToSend) (preparedMessage, error) {
+	relayMsg := msg
+	relayMsg.TotalHops = relayMsg.TotalHops + 1
+	if relayMsg.TotalHops > 10 || relayMsg.TotalHops < 0 {
+		return preparedMessage{}, ErrHopLimitExceeded
+	}
+
+	relayMsg.Hops = append(relayMsg.Hops, Config.ServerAddress)
+	if relayMsg.MessageId == "" {
+		relayMsg.MessageId = uuid.New().String()
+	}
+	relayMsg.CreatedAt = time.Now()
+	relayMsg.StatusCallback = Config.StatusCallbacks
+
+	if relayMsg.Expiration != 0 && relayMsg.Expiration <= relayMsg.CreatedAt.Unix() {
+		return preparedMessage{}, ErrMessageExpired
+	}
+	// the other server holds it back, but we can tell them it's wrong before it gets there
+	if _, err := checkDeliverAt(relayMsg); err != nil {
+		return preparedMessage{}, err
+	}
+	var expiresAt *time.Time
+	if relayMsg.Expiration != 0 {
+		expiration := time.Unix(relayMsg.Expiration, 0)
+		expiresAt = &expiration
+	}
+	// the other server does the dropping, there's just no point in retrying for long
+	expiresAt = deliverOnceExpiration(relayMsg, expiresAt)
+
+	relayMsgJson, err := json.Marshal(relayMsg)
+	if err != nil {
+		return preparedMessage{}, newRouterError(ReasonBadRequest, "data could not be encoded", err)
+	}
+
+	return preparedMessage{
+		msg:    relayMsg,
+		result: SendResult{MessageId: relayMsg.MessageId, RelayQueued: true},
+		relay: &db.OutboundRelay{
+			MessageId:        relayMsg.MessageId,
+			Destination:      relayMsg.ServerAddress,
+			Body:             relayMsgJson,
+			NextAttemptAt:    relayMsg.CreatedAt,
+			ExpiresAt:        expiresAt,
+			CreatedAt:        relayMsg.CreatedAt,
+			Sender:           senderOf(msg),
+			StatusCallbackTo: statusCallbackTo(msg),
+		},
+	}, nil
+}
+
+// StartRelayWorkers starts the workers that deliver queued relays to other servers.
+func StartRelayWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go relayWorker()
+	}
+}
+
+func relayWorker() {
+	for {
+		relays, err := db.ClaimDueRelays(relayBatchSize, relayLease)
+		if err != nil {
+			log.Printf("failed to claim relays: %v\n", err)
+			time.Sleep(relayIdleWait * 5)
+			continue
+		}
+		if len(relays) == 0 {
+			time.Sleep(relayIdleWait)
+			continue
+		}
+
+		for _, relay := range relays {
+			attemptRelay(relay)
+		}
+	}
+}
+
+func attemptRelay(relay db.OutboundRelay) {
+	if relay.ExpiresAt != nil && !relay.ExpiresAt.After(time.Now()) {
+		db.FinishRelay(relay.MessageId, db.RelayStatusExpired, relay.Attempts, relay.LastError)
+		return
+	}
+
+	attempts := relay.Attempts + 1
+	remote, err := RouteMessageToProperServer(relay.Body, relay.Destination)
+	if remote != nil {
+		if err := db.RecordRelayResponse(relay.MessageId, nonEmpty(remote.Status), nonEmpty(string(remote.Reason)), nonEmpty(remote.MessageId)); err != nil {
+			log.Printf("failed to save the response for relay %s: %v\n", relay.MessageId, err)
+		}
+	}
+	if err == nil {
+		if err := db.FinishRelay(relay.MessageId, db.RelayStatusDelivered, attempts, nil); err != nil {
+			log.Printf("failed to mark relay %s as delivered: %v\n", relay.MessageId, err)
+		}
+		return
+	}
+
+	lastError := err.Error()
+	var routerErr *RouterError
+	if errors.As(err, &routerErr) && routerErr.Reason == ReasonPeerRejected {
+		// trying again won't help
+		db.FinishRelay(relay.MessageId, db.RelayStatusFailed, attempts, &lastError)
+		return
+	}
+
+	if attempts >= Config.RelayMaxAttempts {
+		log.Printf("giving up relaying %s to %s after %d attempts: %v\n", relay.MessageId, relay.Destination, attempts, err)
+		db.FinishRelay(relay.MessageId, db.RelayStatusDead, attempts, &lastError)
+		return
+	}
+
+	nextAttemptAt := time.Now().Add(relayBackoff(attempts))
+	if relay.ExpiresAt != nil && nextAttemptAt.After(*relay.ExpiresAt) {
+		db.FinishRelay(relay.MessageId, db.RelayStatusExpired, attempts, &lastError)
+		return
+	}
+	if err := db.RetryRelayAt(relay.MessageId, attempts, nextAttemptAt, lastError); err != nil {
+		log.Printf("failed to reschedule relay %s: %v\n", relay.MessageId, err)
+	}
+}
+
+// exponential backoff, with up to half of it as jitter so a server coming back up doesn't get everything at once
+func relayBackoff(attempts int) time.Duration {
+	backoff := relayBaseBackoff << (attempts - 1)
+	if backoff > relayMaxBackoff || backoff <= 0 {
+		backoff = relayMaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// GetRelayStatus gets what happened to a message we relayed to another server. Like GetMessageStatus, only whoever
+// sent it can see it, everyone else gets sql.ErrNoRows.
+func GetRelayStatus(messageId string, provider *providerauth.Provider, server string) (*db.OutboundRelay, error) {
+	if _, err := GetMessageStatus(messageId, provider, server); err != nil {
+		return nil, err
+	}
+	return db.GetRelay(messageId)
+}
@@ -0,0 +1,30 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		max      time.Duration // it's jittered down to half of this
+	}{
+		{1, relayBaseBackoff},
+		{2, 2 * relayBaseBackoff},
+		{3, 4 * relayBaseBackoff},
+		{10, relayBaseBackoff << 9},
+		{11, relayMaxBackoff},
+		{64, relayMaxBackoff}, // shifted out of range
+		{1000, relayMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := relayBackoff(tt.attempts)
+			if backoff < tt.max/2 || backoff > tt.max {
+				t.Fatalf("attempt %d backed off %s, want %s to %s", tt.attempts, backoff, tt.max/2, tt.max)
+			}
+		}
+	}
+}
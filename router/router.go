@@ -2,20 +2,23 @@ package router
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
 	db "github.com/Preloading/SkyglowNotificationServer/database"
-	"github.com/google/uuid"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
+	"github.com/Preloading/SkyglowNotificationServer/peerpolicy"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
 )
 
 type DataToSend struct {
@@ -42,253 +45,539 @@ type DataToSend struct {
 	TotalHops int      `json:"total_hops,omitempty" plist:"-"`
 	Hops      []string `json:"hops,omitempty" plist:"-"`
 
-	CreatedAt time.Time `json:"-" plist:"-"`
+	CreatedAt  time.Time `json:"-" plist:"-"`
+	Expiration int64     `json:"expiration,omitempty" plist:"-"`  // unix timestamp, 0 never expires. v2 sends it in it's own field, v1 doesn't know about it
+	CollapseId string    `json:"collapse_id,omitempty" plist:"-"` // replaces queued messages with the same id, empty keeps all
+	DeliverAt  int64     `json:"deliver_at,omitempty" plist:"-"`  // unix timestamp, it's held back until then. 0 is right away
+
+	// send it if the device is connected right now, and drop it if it isn't, see deliver_once.go
+	DeliverOnce bool `json:"deliver_once,omitempty" plist:"-"`
+
+	// sending again with the same key gives back the first result instead of sending it twice
+	IdempotencyKey string `json:"idempotency_key,omitempty" plist:"-"`
+
+	// the server relaying this wants to hear what happens to it, see StartStatusCallbackWorker
+	StatusCallback bool `json:"status_callback,omitempty" plist:"-"`
+
+	// Who is sending this, nil if they didn't authenticate
+	Provider *providerauth.Provider `json:"-" plist:"-"`
+	// The server that relayed this to us, if it signed the request
+	RelayedFrom string `json:"-" plist:"-"`
+}
+
+type SendResult struct {
+	MessageId    string
+	RelayQueued  bool     // it's going to another server, check on it with GetRelayStatus
+	StrippedKeys []string // aps keys removed because the user turned that notification type off
+	Replayed     bool     // this is what happened the first time this idempotency key was used
+	Dropped      bool     // it was deliver once, and the device wasn't connected
 }
 
 type DataUpdate struct {
 	DataToSend DataToSend
 	Disconnect bool
+	Replaced   bool // the device connected again, so this connection's being dropped for the new one
 }
 
 type RemoveToken struct {
 	DeviceToken []byte
 }
 
-type ServerTXT struct {
-	TCPAddress  string
-	TCPPort     int
-	HTTPAddress string
+const MaxPayloadSize = 4096
+
+// a device connected to us
+type connection struct {
+	ch    chan DataUpdate
+	since time.Time
 }
 
 var (
-	connections   map[string]chan DataUpdate
+	connections   map[string]connection
 	connectionsMu sync.RWMutex
 	Config        configPkg.Config
 )
 
+// AddConnection sends the device's messages to messageChan. If the device was already connected, here or on
+// another server in the cluster, that connection is told it's been replaced.
 func AddConnection(deviceUUID string, messageChan chan DataUpdate) {
-	var needRemove bool
+	now := time.Now()
 
 	connectionsMu.Lock()
 	if connections == nil {
-		connections = make(map[string]chan DataUpdate)
-	}
-	if _, ok := connections[deviceUUID]; ok {
-		needRemove = true
+		connections = make(map[string]connection)
 	}
+	old, replaced := connections[deviceUUID]
+	connections[deviceUUID] = connection{ch: messageChan, since: now}
 	connectionsMu.Unlock()
 
-	if needRemove {
-		RemoveConnection(deviceUUID)
-		DisconnectConnection(deviceUUID)
+	if replaced {
+		disconnect(old.ch, true)
 	}
-
-	connectionsMu.Lock()
-	connections[deviceUUID] = messageChan
-	connectionsMu.Unlock()
+	claimConnection(deviceUUID, now)
 }
-func DisconnectConnection(deviceUUID string) {
-	connectionsMu.RLock()
-	ch, ok := connections[deviceUUID]
-	connectionsMu.RUnlock()
 
-	if ok {
-		select {
-		case ch <- DataUpdate{Disconnect: true}:
-			// Message sent to connection
-		default:
-			// Channel is full or blocked, optionally handle this case
-			fmt.Println("Channel is full or blocked, message not sent to connection")
-		}
+func disconnect(ch chan DataUpdate, replaced bool) {
+	select {
+	case ch <- DataUpdate{Disconnect: true, Replaced: replaced}:
+		// Message sent to connection
+	default:
+		// Channel is full or blocked, optionally handle this case
+		fmt.Println("Channel is full or blocked, message not sent to connection")
 	}
 }
 
-func RemoveConnection(deviceUUID string) {
+// RemoveConnection stops sending the device's messages to messageChan. If the device has connected again since,
+// the new connection is left alone.
+func RemoveConnection(deviceUUID string, messageChan chan DataUpdate) {
 	connectionsMu.Lock()
-	defer connectionsMu.Unlock()
-
-	if connections == nil {
+	current, ok := connections[deviceUUID]
+	if !ok || current.ch != messageChan {
+		connectionsMu.Unlock()
 		return
 	}
-	if _, ok := connections[deviceUUID]; !ok {
-		return
-	}
-	connections[deviceUUID] = nil
 	delete(connections, deviceUUID)
+	connectionsMu.Unlock()
 
+	releaseConnection(deviceUUID)
 }
 
-func SendMessageToRouter(msg DataToSend) error {
+func SendMessageToRouter(msg DataToSend) (SendResult, error) {
 	if msg.ServerAddress == "" {
-		return errors.New("server address is empty, cannot send message")
+		return SendResult{}, ErrServerAddressEmpty
 	}
 
+	if msg.IdempotencyKey != "" {
+		return sendIdempotently(msg)
+	}
+	return withMessageIdentity(msg, routeMessage)
+}
+
+func routeMessage(msg DataToSend) (SendResult, error) {
+	prepared, err := prepareMessage(msg)
+	if err != nil {
+		return prepared.result, err
+	}
+	return commitMessage(prepared)
+}
+
+// preparedMessage is a message that passed all the checks, and just needs to be queued.
+type preparedMessage struct {
+	msg    DataToSend
+	result SendResult
+	queued *db.QueuedMessage // for one of our devices
+	relay  *db.OutboundRelay // for another server
+	// deliver once, to a device that isn't connected. Nothing's queued, it just gets a status
+	dropped bool
+}
+
+func prepareMessage(msg DataToSend) (preparedMessage, error) {
 	if msg.ServerAddress == Config.ServerAddress {
 		// This is one of us, lets send it off to the local router
-		err := SendMessageToLocalRouter(msg)
-		return err
+		return prepareLocalMessage(msg)
 	} else {
 		// This message is to be sent to someone else's server, lets go find them
-		_, err := RouteMessageToProperServer(msg, msg.ServerAddress)
-		return err // TODO
+		size, err := PayloadSize(msg)
+		if err != nil {
+			return preparedMessage{}, err
+		}
+		if size > MaxPayloadSize {
+			return preparedMessage{}, ErrPayloadTooLarge
+		}
+		if err := peerPolicyError(peerpolicy.CheckOutbound(msg.ServerAddress, size)); err != nil {
+			return preparedMessage{}, err
+		}
+		// we can't see the other server's tokens, so the provider has to tell them what app it's for
+		if len(msg.Hops) == 0 && (msg.Provider != nil || Config.RequireProviderAuth) {
+			if msg.Topic == "" {
+				return preparedMessage{}, ErrTopicRequired
+			}
+			if err := checkProvider(msg, msg.Topic); err != nil {
+				return preparedMessage{}, err
+			}
+		}
+		return prepareRelay(msg)
+	}
+}
+
+// commitMessage queues a prepared message on it's own.
+func commitMessage(prepared preparedMessage) (SendResult, error) {
+	if prepared.dropped {
+		if err := dropUnqueued(prepared); err != nil {
+			return SendResult{}, newRouterError(ReasonInternalError, "failed to drop message", err)
+		}
+		return prepared.result, nil
 	}
+	if prepared.relay != nil {
+		if err := db.QueueRelay(*prepared.relay); err != nil {
+			return SendResult{}, newRouterError(ReasonInternalError, "failed to queue relay", err)
+		}
+		return prepared.result, nil
+	}
+
+	if err := db.QueueMessages([]db.QueuedMessage{*prepared.queued}, Config.QueueDepth); err != nil {
+		return SendResult{}, queueError(err)
+	}
+	sendToConnection(prepared.msg)
+	return prepared.result, nil
 }
 
-func SendMessageToLocalRouter(msg DataToSend) error {
-	msg.MessageId = uuid.New().String()
+func SendMessageToLocalRouter(msg DataToSend) (SendResult, error) {
+	return withMessageIdentity(msg, func(msg DataToSend) (SendResult, error) {
+		prepared, err := prepareLocalMessage(msg)
+		if err != nil {
+			return prepared.result, err
+		}
+		return commitMessage(prepared)
+	})
+}
+
+func prepareLocalMessage(msg DataToSend) (preparedMessage, error) {
+	result := SendResult{}
+
 	msg.CreatedAt = time.Now()
 
+	opts, err := checkQueueOptions(msg)
+	if err != nil {
+		return preparedMessage{result: result}, err
+	}
+	if err := checkPayloadSize(msg); err != nil {
+		return preparedMessage{result: result}, err
+	}
+
 	// decode routing key hex
 	routingKey, err := hex.DecodeString(msg.RoutingKeyStr)
 	if err != nil {
-		return errors.New("routing key not in hex")
+		return preparedMessage{result: result}, ErrRoutingKeyNotHex
 	}
 
 	msg.RoutingKey = routingKey
 
 	// query device address
 	deviceInfo, err := db.GetToken(routingKey)
-	if err != nil {
-		return errors.New("routing key invalid")
+	if errors.Is(err, sql.ErrNoRows) {
+		return preparedMessage{result: result}, ErrRoutingKeyInvalid
+	} else if err != nil {
+		return preparedMessage{result: result}, newRouterError(ReasonInternalError, "failed to look up routing key", err)
 	}
 
 	if !deviceInfo.IsValid {
 		if deviceInfo.MarkedForRemovalAt != nil {
-			return errors.New("routing key is marked for removal")
+			return preparedMessage{result: result}, ErrTokenMarkedForRemoval
 		} else {
-			return errors.New("routing key is no longer valid")
+			return preparedMessage{result: result}, ErrTokenNoLongerValid
 		}
 	}
 
 	if msg.Topic != "" {
 		if msg.Topic != deviceInfo.AppBundleId {
-			return errors.New("bundle id isn't correct for this routing key")
+			return preparedMessage{result: result}, ErrTopicMismatch
 		}
 	} else {
 		msg.Topic = deviceInfo.AppBundleId
 	}
 
+	if err := checkProvider(msg, deviceInfo.AppBundleId); err != nil {
+		return preparedMessage{result: result}, err
+	}
+
+	// encrypted messages can't be looked into, so the device will have to deal with it
+	if !msg.IsEncrypted {
+		var hasSomethingToShow bool
+		msg.Data, result.StrippedKeys, hasSomethingToShow = filterNotificationTypes(msg.Data, deviceInfo.NotificationType)
+		if !hasSomethingToShow {
+			return preparedMessage{result: result}, ErrNotificationTypesOff
+		}
+	}
+
 	msg.DeviceAddress = deviceInfo.DeviceAddress
+	result.MessageId = msg.MessageId
 
-	if msg.IsEncrypted {
-		err := db.QueueEncryptedMessage(db.QueuedMessage{
-			MessageId: msg.MessageId,
-			CreatedAt: msg.CreatedAt,
+	if msg.DeliverOnce && !isConnected(msg.DeviceAddress) {
+		result.Dropped = true
+		return preparedMessage{msg: msg, result: result, dropped: true}, nil
+	}
 
-			IsEncrypted: true,
+	queued := newQueuedMessage(msg, opts)
+	return preparedMessage{msg: msg, result: result, queued: &queued}, nil
+}
 
-			Ciphertext: &msg.Ciphertext,
-			DataType:   &msg.DataType,
-			IV:         &msg.IV,
+func dropUnqueued(prepared preparedMessage) error {
+	d := droppedMessage(prepared)
+	return db.DropUnqueuedMessage(d.MessageId, d.Sender, d.Reason)
+}
 
-			RoutingKey:    routingKey,
-			DeviceAddress: msg.DeviceAddress,
-		})
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-	} else {
-		err := db.QueueUnencryptedMessage(db.QueuedMessage{
-			MessageId: msg.MessageId,
-			CreatedAt: msg.CreatedAt,
+func droppedMessage(prepared preparedMessage) db.DroppedMessage {
+	return db.DroppedMessage{MessageId: prepared.msg.MessageId, Sender: senderOf(prepared.msg), Reason: deliverOnceDroppedReason}
+}
 
-			IsEncrypted: false,
+// how a message is queued, from it's expiration, deliver_at & collapse_id
+type queueOptions struct {
+	expiresAt  *time.Time
+	deliverAt  *time.Time
+	collapseId *string
+}
 
-			Data: msg.Data,
+func checkQueueOptions(msg DataToSend) (queueOptions, error) {
+	var opts queueOptions
+	if msg.Expiration != 0 && msg.Expiration <= time.Now().Unix() {
+		return opts, ErrMessageExpired
+	}
+	if msg.Expiration != 0 {
+		expiration := time.Unix(msg.Expiration, 0)
+		opts.expiresAt = &expiration
+	}
+	opts.expiresAt = deliverOnceExpiration(msg, opts.expiresAt)
 
-			RoutingKey:    routingKey,
-			DeviceAddress: msg.DeviceAddress,
-		})
-		if err != nil {
-			fmt.Println(err.Error())
-		}
+	deliverAt, err := checkDeliverAt(msg)
+	if err != nil {
+		return opts, err
 	}
+	opts.deliverAt = deliverAt
 
+	if len(msg.CollapseId) > 64 {
+		return opts, ErrCollapseIdTooLong
+	}
+	if msg.CollapseId != "" {
+		collapseId := msg.CollapseId
+		opts.collapseId = &collapseId
+	}
+	return opts, nil
+}
+
+// newQueuedMessage makes the row for a checked message, with it's routing key & device address filled in.
+func newQueuedMessage(msg DataToSend, opts queueOptions) db.QueuedMessage {
+	queued := db.QueuedMessage{
+		MessageId:  msg.MessageId,
+		CreatedAt:  msg.CreatedAt,
+		ExpiresAt:  opts.expiresAt,
+		CollapseId: opts.collapseId,
+		DeliverAt:  opts.deliverAt,
+
+		IsEncrypted: msg.IsEncrypted,
+
+		RoutingKey:    msg.RoutingKey,
+		DeviceAddress: msg.DeviceAddress,
+
+		Sender:           senderOf(msg),
+		StatusCallbackTo: statusCallbackTo(msg),
+	}
+	if msg.IsEncrypted {
+		queued.Ciphertext = &msg.Ciphertext
+		queued.DataType = &msg.DataType
+		queued.IV = &msg.IV
+	} else {
+		queued.Data = msg.Data
+	}
+	return queued
+}
+
+// sendToConnection hands a queued message to the device, if it's connected to us, or another server in the cluster,
+// right now. Scheduled messages are left for the scheduler.
+func sendToConnection(msg DataToSend) {
+	if isScheduled(msg) {
+		return
+	}
+	if !sendToLocalConnection(msg) {
+		sendToClusterConnection(msg)
+	}
+}
+
+// sendToLocalConnection is false if the device isn't connected to us.
+func sendToLocalConnection(msg DataToSend) bool {
 	connectionsMu.RLock()
-	ch, ok := connections[msg.DeviceAddress]
+	conn, ok := connections[msg.DeviceAddress]
 	connectionsMu.RUnlock()
 
 	if ok {
 		select {
-		case ch <- DataUpdate{DataToSend: msg, Disconnect: false}:
+		case conn.ch <- DataUpdate{DataToSend: msg, Disconnect: false}:
 			// Message sent to connection
 		default:
 			// Channel is full or blocked, optionally handle this case
 			fmt.Println("Channel is full or blocked, message not sent to connection")
 		}
 	}
+	return ok
+}
+
+// checkProvider makes sure whoever sent this is allowed to send to the app.
+// Messages relayed from other servers were checked by the server they first came into.
+func checkProvider(msg DataToSend, bundleId string) error {
+	if msg.Provider != nil {
+		if !msg.Provider.CanSendTo(bundleId) {
+			return ErrProviderNotAllowed
+		}
+		return nil
+	}
+
+	if len(msg.Hops) > 0 {
+		if !Config.AcceptRelayedMessages {
+			return ErrRelayNotAccepted
+		}
+		// unsigned relays are only as trustworthy as the Hops field, which anyone can set, so they don't get past
+		// REQUIRE_PROVIDER_AUTH either
+		if msg.RelayedFrom == "" && Config.RequireSignedFederation {
+			return ErrRelayNotSigned
+		}
+		if msg.RelayedFrom == "" && Config.RequireProviderAuth {
+			return ErrProviderAuthRequired
+		}
+		return nil
+	}
+
+	if Config.RequireProviderAuth {
+		return ErrProviderAuthRequired
+	}
+	return nil
+}
+
+func checkPayloadSize(msg DataToSend) error {
+	size, err := PayloadSize(msg)
+	if err != nil {
+		return err
+	}
+	if size > MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
 	return nil
 }
 
-func RouteMessageToProperServer(msg DataToSend, server string) (*http.Response, error) {
-	txts, err := net.LookupTXT(fmt.Sprintf("_sgn.%s", server))
+// PayloadSize is how big the notification is, the ciphertext if it's encrypted or the encoded data if it's not.
+func PayloadSize(msg DataToSend) (int, error) {
+	if msg.IsEncrypted {
+		return len(msg.Ciphertext), nil
+	}
+
+	encoded, err := json.Marshal(msg.Data)
 	if err != nil {
-		return nil, errors.New("failed to lookup txt record")
+		return 0, newRouterError(ReasonBadRequest, "data could not be encoded", err)
+	}
+	return len(encoded), nil
+}
+
+// filterNotificationTypes strips the aps keys the user has turned off, and reports if there's anything left worth sending.
+// Content available pushes are always let through, since they aren't shown to the user.
+func filterNotificationTypes(data map[string]interface{}, allowedTypes int) (filtered map[string]interface{}, stripped []string, hasSomethingToShow bool) {
+	aps, ok := data["aps"].(map[string]interface{})
+	if !ok {
+		return data, nil, true // nothing for us to filter, the app can figure it out
+	}
+
+	typeKeys := []struct {
+		key  string
+		flag int
+	}{
+		{"badge", db.NotificationTypeBadge},
+		{"sound", db.NotificationTypeSound},
+		{"alert", db.NotificationTypeAlert},
 	}
-	var serverData ServerTXT
 
-	found := false
-	for _, txt := range txts {
-		serverData, err = ParseServerTXT(txt)
-		if err == nil {
-			found = true
-			break
+	filteredAps := make(map[string]interface{}, len(aps))
+	for key, value := range aps {
+		filteredAps[key] = value
+	}
+	for _, typeKey := range typeKeys {
+		if _, ok := filteredAps[typeKey.key]; ok && allowedTypes&typeKey.flag == 0 {
+			delete(filteredAps, typeKey.key)
+			stripped = append(stripped, typeKey.key)
 		}
 	}
-	if !found {
-		return nil, errors.New("server could not be found")
+
+	if len(stripped) == 0 {
+		return data, nil, true
 	}
 
-	relayMsg := msg
-	relayMsg.TotalHops = relayMsg.TotalHops + 1
-	if relayMsg.TotalHops > 10 || relayMsg.TotalHops < 0 {
-		return nil, errors.New("hop limit exceeded")
+	filtered = make(map[string]interface{}, len(data))
+	for key, value := range data {
+		filtered[key] = value
 	}
+	filtered["aps"] = filteredAps
 
-	relayMsg.Hops = append(relayMsg.Hops, Config.ServerAddress)
+	_, hasBadge := filteredAps["badge"]
+	_, hasSound := filteredAps["sound"]
+	_, hasAlert := filteredAps["alert"]
+	_, isContentAvailable := filteredAps["content-available"]
+	hasSomethingToShow = hasBadge || hasSound || hasAlert || isContentAvailable
 
-	relayMsgJson, err := json.Marshal(relayMsg)
+	return filtered, stripped, hasSomethingToShow
+}
+
+// RemoteResponse is what another server replies to a relayed message with. It's the same as the /send response,
+// less the parts we don't care about.
+type RemoteResponse struct {
+	Status    string      `json:"status"` // success, accepted (it's being relayed again) or error
+	Reason    ErrorReason `json:"reason,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	MessageId string      `json:"message_id,omitempty"`
+}
+
+// RouteMessageToProperServer posts an already prepared relay (see QueueMessageForRelay) to the server's /send.
+// The server's response is given back if it sent one we could read, even if it's an error.
+func RouteMessageToProperServer(relayMsgJson []byte, server string) (*RemoteResponse, error) {
+	serverData, err := discovery.Lookup(server)
 	if err != nil {
-		return nil, err
+		return nil, newRouterError(ReasonPeerUnreachable, "server could not be found", err)
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/send", serverData.HTTPAddress), "application/json", bytes.NewBuffer(relayMsgJson))
+	resp, err := federation.Post(server, fmt.Sprintf("%s/send", serverData.HTTPAddress), "application/json", relayMsgJson)
 	if err != nil {
-		return nil, err
+		if federation.IsPolicyError(err) {
+			// it'll keep getting blocked, no point retrying
+			return nil, newRouterError(ReasonPeerRejected, "server isn't somewhere we're allowed to connect to", err)
+		}
+		return nil, newRouterError(ReasonPeerUnreachable, "failed to relay message", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	// older servers (and proxies in front of them) might not reply with json
+	var remote *RemoteResponse
+	detail := string(body)
+	var parsed RemoteResponse
+	if err := json.Unmarshal(body, &parsed); err == nil && parsed.Status != "" {
+		remote = &parsed
+		detail = remoteErrorDetail(parsed)
 	}
-	return resp, nil
-}
 
-func ParseServerTXT(input string) (ServerTXT, error) {
-	var result ServerTXT
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return remote, nil
+	case resp.StatusCode == http.StatusLoopDetected:
+		// it's been there before (or gone through too many servers), it won't get any better
+		return remote, newRouterError(ReasonPeerRejected, fmt.Sprintf("server replied with %d: %s", resp.StatusCode, detail), nil)
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		// worth trying again later
+		return remote, newRouterError(ReasonPeerUnreachable, fmt.Sprintf("server replied with %d: %s", resp.StatusCode, detail), nil)
+	default:
+		return remote, newRouterError(ReasonPeerRejected, fmt.Sprintf("server replied with %d: %s", resp.StatusCode, detail), nil)
+	}
+}
 
-	// Split the input by spaces to get key-value pairs
-	parts := strings.Fields(input)
+func remoteErrorDetail(remote RemoteResponse) string {
+	switch {
+	case remote.Reason != "" && remote.Message != "":
+		return fmt.Sprintf("%s (%s)", remote.Message, remote.Reason)
+	case remote.Reason != "":
+		return string(remote.Reason)
+	default:
+		return remote.Message
+	}
+}
 
-	for _, part := range parts {
-		kv := strings.SplitN(part, "=", 2)
-		if len(kv) != 2 {
-			return result, fmt.Errorf("invalid format in part: %s", part)
-		}
+// SplitDeviceToken splits a full 32 byte device token (the one apps hand to their
+// providers) into the server it belongs to, and the routing key for it.
+// The first 16 bytes are the server address padded with 0x00, the last 16 are K,
+// and the routing key is SHA256(K).
+func SplitDeviceToken(deviceToken []byte) (serverAddress string, routingKey []byte, err error) {
+	if len(deviceToken) != 32 {
+		return "", nil, errors.New("device token must be 32 bytes")
+	}
 
-		key := kv[0]
-		value := kv[1]
-
-		switch key {
-		case "tcp_addr":
-			// TODO: Validate that this is not localhost or reserved IPs
-			result.TCPAddress = value
-		case "tcp_port":
-			port, err := strconv.Atoi(value)
-			if err != nil {
-				return result, fmt.Errorf("invalid TCP port: %v", err)
-			}
-			result.TCPPort = port
-		case "http_addr":
-			// TODO: Validate this is starts with either https or http, and that it is not localhost or reserved IPs
-			result.HTTPAddress = value
-		}
+	serverAddress = string(bytes.TrimRight(deviceToken[:16], "\x00"))
+	if serverAddress == "" {
+		return "", nil, errors.New("device token has no server address")
 	}
 
-	return result, nil
+	routingKeyHash := sha256.Sum256(deviceToken[16:])
+	return serverAddress, routingKeyHash[:], nil
 }
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"errors"
+	"testing"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/google/uuid"
+)
+
+// useTestConfig sets Config for a test, and puts it back after.
+func useTestConfig(t *testing.T, c configPkg.Config) {
+	t.Helper()
+	saved := Config
+	Config = c
+	t.Cleanup(func() { Config = saved })
+}
+
+func TestCheckProvider(t *testing.T) {
+	app := &providerauth.Provider{Name: "app", BundleIds: []string{"com.example.app"}}
+	everything := &providerauth.Provider{Name: "everything", BundleIds: []string{"*"}}
+
+	tests := []struct {
+		name   string
+		config configPkg.Config
+		msg    DataToSend
+		want   error
+	}{
+		{name: "no auth needed", msg: DataToSend{}},
+		{name: "auth required", config: configPkg.Config{RequireProviderAuth: true}, msg: DataToSend{}, want: ErrProviderAuthRequired},
+		{name: "provider for the app", config: configPkg.Config{RequireProviderAuth: true}, msg: DataToSend{Provider: app}},
+		{name: "provider for another app", msg: DataToSend{Provider: &providerauth.Provider{Name: "other", BundleIds: []string{"com.example.other"}}}, want: ErrProviderNotAllowed},
+		{name: "provider for everything", msg: DataToSend{Provider: everything}},
+		{name: "provider with no apps", msg: DataToSend{Provider: &providerauth.Provider{Name: "none"}}, want: ErrProviderNotAllowed},
+
+		{name: "relay not accepted", msg: DataToSend{Hops: []string{"other.example.com"}}, want: ErrRelayNotAccepted},
+		{name: "unsigned relay", config: configPkg.Config{AcceptRelayedMessages: true}, msg: DataToSend{Hops: []string{"other.example.com"}}},
+		{name: "unsigned relay, signing required", config: configPkg.Config{AcceptRelayedMessages: true, RequireSignedFederation: true}, msg: DataToSend{Hops: []string{"other.example.com"}}, want: ErrRelayNotSigned},
+		// anyone can fill in hops, so it can't be used to get around provider auth
+		{name: "unsigned relay, auth required", config: configPkg.Config{AcceptRelayedMessages: true, RequireProviderAuth: true}, msg: DataToSend{Hops: []string{"other.example.com"}}, want: ErrProviderAuthRequired},
+		{name: "signed relay, auth required", config: configPkg.Config{AcceptRelayedMessages: true, RequireProviderAuth: true, RequireSignedFederation: true}, msg: DataToSend{Hops: []string{"other.example.com"}, RelayedFrom: "other.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, tt.config)
+			if err := checkProvider(tt.msg, "com.example.app"); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssignMessageId(t *testing.T) {
+	relayedId := "6f1ed002-ab5d-42f3-a1f4-1c3b3e5c8d2a"
+
+	tests := []struct {
+		name     string
+		msg      DataToSend
+		wantKept bool
+	}{
+		{name: "direct", msg: DataToSend{}},
+		// senders can't pick it, or they could take one that's already in use
+		{name: "direct, id filled in", msg: DataToSend{MessageId: relayedId}},
+		{name: "relayed", msg: DataToSend{MessageId: relayedId, Hops: []string{"other.example.com"}}, wantKept: true},
+		{name: "relayed, not a uuid", msg: DataToSend{MessageId: "not a uuid", Hops: []string{"other.example.com"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			assignMessageId(&msg)
+			if _, err := uuid.Parse(msg.MessageId); err != nil {
+				t.Fatalf("got %q, want a uuid", msg.MessageId)
+			}
+			if kept := msg.MessageId == tt.msg.MessageId; kept != tt.wantKept {
+				t.Errorf("kept the id: %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+)
+
+// Messages with a deliver_at are queued like any other, but held back (polls skip them) until they're due.
+// The scheduler then releases them, and sends them to the device if it's connected.
+
+const (
+	schedulerInterval  = time.Second
+	schedulerBatchSize = 100
+)
+
+var (
+	ErrDeliverAtAfterExpiration = newRouterError(ReasonBadRequest, "deliver_at is after the message expires", nil)
+	ErrDeliverAtTooFarAhead     = newRouterError(ReasonBadRequest, "deliver_at is too far in the future", nil)
+	ErrScheduleFull             = newRouterError(ReasonScheduleFull, "too many scheduled messages for this routing key", nil)
+	ErrNotCancellable           = newRouterError(ReasonNotCancellable, "message has already been sent, or wasn't scheduled", nil)
+)
+
+var schedulerTicker *time.Ticker
+
+// checkDeliverAt checks a message's deliver_at, and gives back when to hold it until. nil is right away.
+func checkDeliverAt(msg DataToSend) (*time.Time, error) {
+	if !isScheduled(msg) {
+		return nil, nil
+	}
+	if msg.DeliverOnce {
+		return nil, ErrDeliverOnceScheduled
+	}
+	deliverAt := time.Unix(msg.DeliverAt, 0)
+	if msg.Expiration != 0 && msg.DeliverAt >= msg.Expiration {
+		return nil, ErrDeliverAtAfterExpiration
+	}
+	if Config.MaxScheduleAhead > 0 && time.Until(deliverAt) > Config.MaxScheduleAhead {
+		return nil, ErrDeliverAtTooFarAhead
+	}
+	return &deliverAt, nil
+}
+
+// deliver_at in the past is the same as not having one
+func isScheduled(msg DataToSend) bool {
+	return msg.DeliverAt != 0 && msg.DeliverAt > time.Now().Unix()
+}
+
+// queueError turns an error from queueing a message into one of ours.
+func queueError(err error) error {
+	if errors.Is(err, db.ErrScheduleFull) {
+		return ErrScheduleFull
+	}
+	fmt.Println(err.Error())
+	return newRouterError(ReasonInternalError, "failed to queue message", err)
+}
+
+// StartScheduler releases scheduled messages when they're due.
+func StartScheduler() {
+	schedulerTicker = time.NewTicker(schedulerInterval)
+
+	go func() {
+		for range schedulerTicker.C {
+			for {
+				released, err := db.ReleaseDueMessages(schedulerBatchSize)
+				if err != nil {
+					log.Printf("failed to release scheduled messages: %v\n", err)
+					break
+				}
+				for _, m := range released {
+					sendToConnection(dataFromQueued(m))
+				}
+				if len(released) < schedulerBatchSize {
+					break
+				}
+			}
+		}
+	}()
+}
+
+func dataFromQueued(m db.QueuedMessage) DataToSend {
+	msg := DataToSend{
+		IsEncrypted:   m.IsEncrypted,
+		Data:          m.Data,
+		DeviceAddress: m.DeviceAddress,
+		RoutingKey:    m.RoutingKey,
+		MessageId:     m.MessageId,
+		CreatedAt:     m.CreatedAt,
+	}
+	if m.ExpiresAt != nil {
+		msg.Expiration = m.ExpiresAt.Unix()
+	}
+	if m.IsEncrypted {
+		msg.Ciphertext = *m.Ciphertext
+		msg.DataType = *m.DataType
+		msg.IV = *m.IV
+	}
+	return msg
+}
+
+// CancelMessage cancels a scheduled message that hasn't been sent yet. Like GetMessageStatus, only whoever sent it
+// can cancel it, everyone else gets sql.ErrNoRows. If we relayed it to another server, it's cancelled there.
+func CancelMessage(messageId string, provider *providerauth.Provider, server string) error {
+	if _, err := GetMessageStatus(messageId, provider, server); err != nil {
+		return err
+	}
+
+	cancelled, err := db.CancelScheduledMessage(messageId)
+	if err != nil {
+		return newRouterError(ReasonInternalError, "failed to cancel message", err)
+	}
+	if cancelled {
+		return nil
+	}
+
+	relay, err := db.GetRelay(messageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotCancellable
+	} else if err != nil {
+		return newRouterError(ReasonInternalError, "failed to look up relay", err)
+	}
+
+	var relayMsg DataToSend
+	if err := json.Unmarshal(relay.Body, &relayMsg); err != nil || !isScheduled(relayMsg) {
+		return ErrNotCancellable
+	}
+
+	switch relay.Status {
+	case db.RelayStatusPending:
+		cancelled, err := db.CancelPendingRelay(messageId)
+		if err != nil {
+			return newRouterError(ReasonInternalError, "failed to cancel relay", err)
+		}
+		if cancelled {
+			return nil
+		}
+		// it got there while we were cancelling it
+		return cancelRemoteMessage(relay.Destination, messageId)
+	case db.RelayStatusDelivered:
+		return cancelRemoteMessage(relay.Destination, messageId)
+	default:
+		return ErrNotCancellable
+	}
+}
+
+func cancelRemoteMessage(server string, messageId string) error {
+	serverData, err := discovery.Lookup(server)
+	if err != nil {
+		return newRouterError(ReasonPeerUnreachable, "server could not be found", err)
+	}
+
+	resp, err := federation.Delete(server, fmt.Sprintf("%s/message/%s", serverData.HTTPAddress, messageId))
+	if err != nil {
+		return newRouterError(ReasonPeerUnreachable, "failed to cancel message on the other server", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusNotFound:
+		return ErrNotCancellable
+	default:
+		return newRouterError(ReasonPeerRejected, fmt.Sprintf("server replied with %d", resp.StatusCode), nil)
+	}
+}
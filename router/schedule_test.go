@@ -0,0 +1,45 @@
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	configPkg "github.com/Preloading/SkyglowNotificationServer/config"
+)
+
+func TestCheckDeliverAt(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name          string
+		deliverAt     int64
+		expiration    int64
+		wantScheduled bool
+		wantErr       error
+	}{
+		{name: "right away", deliverAt: 0},
+		{name: "in the past", deliverAt: now - 60},
+		{name: "later", deliverAt: now + 60, wantScheduled: true},
+		{name: "before it expires", deliverAt: now + 60, expiration: now + 120, wantScheduled: true},
+		{name: "when it expires", deliverAt: now + 60, expiration: now + 60, wantErr: ErrDeliverAtAfterExpiration},
+		{name: "after it expires", deliverAt: now + 120, expiration: now + 60, wantErr: ErrDeliverAtAfterExpiration},
+		{name: "too far ahead", deliverAt: now + 2*60*60, wantErr: ErrDeliverAtTooFarAhead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, configPkg.Config{MaxScheduleAhead: time.Hour})
+			deliverAt, err := checkDeliverAt(DataToSend{DeliverAt: tt.deliverAt, Expiration: tt.expiration})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if got := deliverAt != nil; got != tt.wantScheduled {
+				t.Fatalf("scheduled is %v, want %v", got, tt.wantScheduled)
+			}
+			if tt.wantScheduled && deliverAt.Unix() != tt.deliverAt {
+				t.Errorf("held until %v, want %v", deliverAt.Unix(), tt.deliverAt)
+			}
+		})
+	}
+}
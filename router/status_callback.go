@@ -0,0 +1,144 @@
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
+)
+
+// When a server relays a message to us with status_callback set, we tell it what happens to the message after we
+// accepted it (delivered, acked, expired or dropped) by posting to it's /message_status_callback.
+// This way the original sender can see it on /message/{id}, even if it went through a few servers.
+
+const (
+	statusCallbackLease     = 2 * time.Minute
+	statusCallbackBatchSize = 20
+)
+
+var ErrUnknownRelay = errors.New("we didn't relay a message with that id to you")
+
+// StatusCallbackRequest is the body of a /message_status_callback request.
+type StatusCallbackRequest struct {
+	MessageId     string    `json:"message_id"`
+	MessageStatus string    `json:"message_status"`
+	Reason        *string   `json:"reason,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// statusCallbackTo is the server to report a message's status to, if it asked. They have to have signed the
+// request, or anyone could get us to post to wherever they like.
+func statusCallbackTo(msg DataToSend) *string {
+	if !msg.StatusCallback || msg.RelayedFrom == "" {
+		return nil
+	}
+	server := msg.RelayedFrom
+	return &server
+}
+
+// ApplyStatusCallback records a status change reported by the server we relayed a message to.
+func ApplyStatusCallback(server string, callback StatusCallbackRequest) error {
+	relay, err := db.GetRelay(callback.MessageId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !strings.EqualFold(relay.Destination, server)) {
+		return ErrUnknownRelay
+	} else if err != nil {
+		return err
+	}
+
+	switch callback.MessageStatus {
+	case db.MessageStatusDelivered, db.MessageStatusAcked, db.MessageStatusExpired, db.MessageStatusDropped:
+	default:
+		return newRouterError(ReasonBadRequest, "message_status must be delivered, acked, expired or dropped", nil)
+	}
+	return db.SetMessageStatus(callback.MessageId, callback.MessageStatus, callback.Reason)
+}
+
+// StartStatusCallbackWorker starts the worker that sends status callbacks to other servers.
+func StartStatusCallbackWorker() {
+	go func() {
+		for {
+			callbacks, err := db.ClaimDueStatusCallbacks(statusCallbackBatchSize, statusCallbackLease)
+			if err != nil {
+				log.Printf("failed to claim status callbacks: %v\n", err)
+				time.Sleep(relayIdleWait * 5)
+				continue
+			}
+			if len(callbacks) == 0 {
+				time.Sleep(relayIdleWait)
+				continue
+			}
+
+			for _, callback := range callbacks {
+				attemptStatusCallback(callback)
+			}
+		}
+	}()
+}
+
+func attemptStatusCallback(callback db.StatusCallback) {
+	attempts := callback.Attempts + 1
+	retry, err := sendStatusCallback(callback)
+	if err == nil || !retry || attempts >= Config.RelayMaxAttempts {
+		if err != nil {
+			log.Printf("giving up telling %s about %s: %v\n", callback.Destination, callback.MessageId, err)
+		}
+		if err := db.FinishStatusCallback(callback.Id); err != nil {
+			log.Printf("failed to remove status callback %d: %v\n", callback.Id, err)
+		}
+		return
+	}
+
+	if err := db.RetryStatusCallbackAt(callback.Id, attempts, time.Now().Add(relayBackoff(attempts))); err != nil {
+		log.Printf("failed to reschedule status callback %d: %v\n", callback.Id, err)
+	}
+}
+
+// sendStatusCallback posts a callback to the server. retry is if it's worth trying again when it fails.
+func sendStatusCallback(callback db.StatusCallback) (retry bool, err error) {
+	serverData, err := discovery.Lookup(callback.Destination)
+	if err != nil {
+		return true, err
+	}
+
+	body, err := json.Marshal(StatusCallbackRequest{
+		MessageId:     callback.MessageId,
+		MessageStatus: callback.Status,
+		Reason:        callback.Reason,
+		At:            callback.At,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := federation.Post(callback.Destination, fmt.Sprintf("%s/message_status_callback", serverData.HTTPAddress), "application/json", body)
+	if err != nil {
+		return !federation.IsPolicyError(err), err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("server replied with %d: %s", resp.StatusCode, respBody)
+	default:
+		return false, fmt.Errorf("server replied with %d: %s", resp.StatusCode, respBody)
+	}
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
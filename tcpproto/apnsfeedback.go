@@ -0,0 +1,104 @@
+// Legacy APNS feedback service (feedback.push.apple.com:2196), served from feedback_to_send. Each provider only gets
+// each bit of feedback once.
+
+package tcpproto
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Preloading/SkyglowNotificationServer/config"
+	db "github.com/Preloading/SkyglowNotificationServer/database"
+)
+
+// Authentication is either:
+//   - a client certificate, where the feedback key is the SHA256 of the certificate (DER). Register your tokens for feedback with that key.
+//   - the feedback key, sent as [uint16 length][key] right after connecting, for clients that can be changed a bit.
+//
+// NOTE: the token in each tuple is the routing token, not the device token. We never see K, so we can't give the device token back.
+func CreateLegacyAPNSFeedbackServer(port uint16, _keys config.CryptoKeys, _config config.Config) {
+	PORTSTR := ":" + strconv.FormatUint(uint64(port), 10)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*_keys.ServerTLSCert},
+		MinVersion:   tls.VersionTLS10,
+		ClientAuth:   tls.RequestClientCert,
+	}
+
+	l, err := tls.Listen("tcp", PORTSTR, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	log.Printf("Legacy APNS feedback server listening on port %d", port)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go handleLegacyAPNSFeedbackConnection(c)
+	}
+}
+
+func handleLegacyAPNSFeedbackConnection(c net.Conn) {
+	defer c.Close()
+
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("TLS handshake error from %s: %v\n", c.RemoteAddr().String(), err)
+		return
+	}
+
+	var feedbackKey []byte
+	if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+		certHash := sha256.Sum256(peerCerts[0].Raw)
+		feedbackKey = certHash[:]
+	} else {
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		var err error
+		feedbackKey, err = readUint16PrefixedBytes(c)
+		if err != nil || len(feedbackKey) == 0 || len(feedbackKey) > 257 {
+			log.Printf("Legacy feedback client %s didn't authenticate\n", c.RemoteAddr().String())
+			return
+		}
+	}
+
+	// like APNS, each bit of feedback is only given out once. It's only marked as given out once it's been written
+	// though, so a provider that loses the connection gets it again next time.
+	feedbacks, err := db.GetUndeliveredLegacyFeedback(feedbackKey)
+	if err != nil {
+		log.Printf("Failed to get feedback for %s: %v\n", c.RemoteAddr().String(), err)
+		return
+	}
+	if len(feedbacks) == 0 {
+		return
+	}
+
+	payload := []byte{}
+	for _, feedback := range feedbacks {
+		addToPayload(&payload, uint32(feedback.CreatedAt.Unix()))
+		addToPayload(&payload, uint16(len(feedback.RoutingToken)))
+		addToPayload(&payload, feedback.RoutingToken)
+	}
+
+	c.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.Write(payload); err != nil {
+		log.Printf("Write error to %s: %v\n", c.RemoteAddr().String(), err)
+		return
+	}
+
+	if err := db.MarkLegacyFeedbackDelivered(feedbackKey, feedbacks[len(feedbacks)-1].CreatedAt); err != nil {
+		log.Printf("Failed to mark feedback for %s as delivered: %v\n", c.RemoteAddr().String(), err)
+	}
+}
@@ -0,0 +1,301 @@
+// Legacy APNS binary provider protocol (the pre HTTP/2 one), for reviving apps with old provider code.
+// https://developer.apple.com/library/archive/documentation/NetworkingInternet/Conceptual/RemoteNotificationsPG/BinaryProviderAPI.html
+
+package tcpproto
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Preloading/SkyglowNotificationServer/config"
+	"github.com/Preloading/SkyglowNotificationServer/providerauth"
+	"github.com/Preloading/SkyglowNotificationServer/router"
+)
+
+const (
+	APNS_STATUS_NO_ERROR             = 0
+	APNS_STATUS_PROCESSING_ERROR     = 1
+	APNS_STATUS_MISSING_DEVICE_TOKEN = 2
+	APNS_STATUS_MISSING_TOPIC        = 3
+	APNS_STATUS_MISSING_PAYLOAD      = 4
+	APNS_STATUS_INVALID_TOKEN_SIZE   = 5
+	APNS_STATUS_INVALID_TOPIC_SIZE   = 6
+	APNS_STATUS_INVALID_PAYLOAD_SIZE = 7
+	APNS_STATUS_INVALID_TOKEN        = 8
+	APNS_STATUS_SHUTDOWN             = 10
+	APNS_STATUS_UNKNOWN              = 255
+
+	apnsLegacyMaxPayloadSize = 2048
+)
+
+// the UID attribute in apple's push certs subject, which is the bundle id
+var oidUserId = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+type legacyAPNSNotification struct {
+	identifier  uint32
+	expiry      uint32
+	hasExpiry   bool // the simple format doesn't have one, and neither do frames without item 4
+	deviceToken []byte
+	payload     []byte
+}
+
+type legacyAPNSError struct {
+	status     uint8
+	identifier uint32
+}
+
+func (e *legacyAPNSError) Error() string {
+	return fmt.Sprintf("legacy apns error %d for notification %d", e.status, e.identifier)
+}
+
+func CreateLegacyAPNSGateway(port uint16, _keys config.CryptoKeys, _config config.Config) {
+	PORTSTR := ":" + strconv.FormatUint(uint64(port), 10)
+
+	// old provider code can be very old, so we can't be as picky as the device listener
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*_keys.ServerTLSCert},
+		MinVersion:   tls.VersionTLS10,
+		ClientAuth:   tls.RequestClientCert,
+	}
+
+	l, err := tls.Listen("tcp", PORTSTR, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	log.Printf("Legacy APNS gateway listening on port %d", port)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go handleLegacyAPNSConnection(c)
+	}
+}
+
+func handleLegacyAPNSConnection(c net.Conn) {
+	defer c.Close()
+	log.Printf("Legacy APNS provider connected: %s\n", c.RemoteAddr().String())
+
+	// if they gave us their old push cert, that tells us the topic, and maybe who they are
+	topic := ""
+	var provider *providerauth.Provider
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake error from %s: %v\n", c.RemoteAddr().String(), err)
+			return
+		}
+		if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+			topic = topicFromCertificate(peerCerts[0])
+			provider, _ = providerauth.AuthenticateCertificate(peerCerts[0].Raw)
+		}
+	}
+
+	r := bufio.NewReader(c)
+	for {
+		notification, err := readLegacyAPNSNotification(r)
+		if err != nil {
+			var apnsErr *legacyAPNSError
+			if errors.As(err, &apnsErr) {
+				sendLegacyAPNSError(c, apnsErr.status, apnsErr.identifier)
+			} else if !errors.Is(err, io.EOF) {
+				log.Printf("Read error from legacy APNS provider %s: %v\n", c.RemoteAddr().String(), err)
+			}
+			return
+		}
+
+		if status := sendLegacyAPNSNotification(notification, topic, provider); status != APNS_STATUS_NO_ERROR {
+			// APNS closes the connection after an error, and everything after it in the stream is dropped
+			sendLegacyAPNSError(c, status, notification.identifier)
+			return
+		}
+	}
+}
+
+func readLegacyAPNSNotification(r *bufio.Reader) (*legacyAPNSNotification, error) {
+	command, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &legacyAPNSNotification{}
+	switch command {
+	case 0: // simple
+		if n.deviceToken, err = readUint16PrefixedBytes(r); err != nil {
+			return nil, err
+		}
+		if n.payload, err = readUint16PrefixedBytes(r); err != nil {
+			return nil, err
+		}
+	case 1: // enhanced
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		n.identifier = binary.BigEndian.Uint32(header[0:4])
+		n.expiry = binary.BigEndian.Uint32(header[4:8])
+		n.hasExpiry = true
+		if n.deviceToken, err = readUint16PrefixedBytes(r); err != nil {
+			return nil, err
+		}
+		if n.payload, err = readUint16PrefixedBytes(r); err != nil {
+			return nil, err
+		}
+	case 2: // frame of items
+		frameLenRaw := make([]byte, 4)
+		if _, err := io.ReadFull(r, frameLenRaw); err != nil {
+			return nil, err
+		}
+		frameLen := binary.BigEndian.Uint32(frameLenRaw)
+		if frameLen > 4096 {
+			return nil, &legacyAPNSError{status: APNS_STATUS_INVALID_PAYLOAD_SIZE}
+		}
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+
+		for offset := 0; offset < len(frame); {
+			if offset+3 > len(frame) {
+				return nil, &legacyAPNSError{status: APNS_STATUS_PROCESSING_ERROR, identifier: n.identifier}
+			}
+			itemId := frame[offset]
+			itemLen := int(binary.BigEndian.Uint16(frame[offset+1 : offset+3]))
+			offset += 3
+			if offset+itemLen > len(frame) {
+				return nil, &legacyAPNSError{status: APNS_STATUS_PROCESSING_ERROR, identifier: n.identifier}
+			}
+			item := frame[offset : offset+itemLen]
+			offset += itemLen
+
+			switch itemId {
+			case 1: // device token
+				n.deviceToken = item
+			case 2: // payload
+				n.payload = item
+			case 3: // notification identifier
+				if itemLen != 4 {
+					return nil, &legacyAPNSError{status: APNS_STATUS_PROCESSING_ERROR}
+				}
+				n.identifier = binary.BigEndian.Uint32(item)
+			case 4: // expiration date
+				if itemLen != 4 {
+					return nil, &legacyAPNSError{status: APNS_STATUS_PROCESSING_ERROR, identifier: n.identifier}
+				}
+				n.expiry = binary.BigEndian.Uint32(item)
+				n.hasExpiry = true
+			case 5: // priority, we don't do anything with this
+			}
+		}
+	default:
+		return nil, &legacyAPNSError{status: APNS_STATUS_UNKNOWN}
+	}
+
+	if len(n.deviceToken) == 0 {
+		return nil, &legacyAPNSError{status: APNS_STATUS_MISSING_DEVICE_TOKEN, identifier: n.identifier}
+	}
+	if len(n.deviceToken) != 32 {
+		return nil, &legacyAPNSError{status: APNS_STATUS_INVALID_TOKEN_SIZE, identifier: n.identifier}
+	}
+	if len(n.payload) == 0 {
+		return nil, &legacyAPNSError{status: APNS_STATUS_MISSING_PAYLOAD, identifier: n.identifier}
+	}
+	if len(n.payload) > apnsLegacyMaxPayloadSize {
+		return nil, &legacyAPNSError{status: APNS_STATUS_INVALID_PAYLOAD_SIZE, identifier: n.identifier}
+	}
+
+	return n, nil
+}
+
+// returns the legacy APNS status code
+func sendLegacyAPNSNotification(n *legacyAPNSNotification, topic string, provider *providerauth.Provider) uint8 {
+	serverAddress, routingKey, err := router.SplitDeviceToken(n.deviceToken)
+	if err != nil {
+		return APNS_STATUS_INVALID_TOKEN
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(n.payload, &payload); err != nil {
+		return APNS_STATUS_PROCESSING_ERROR
+	}
+
+	msg := router.DataToSend{
+		Data:          payload,
+		RoutingKeyStr: hex.EncodeToString(routingKey),
+		ServerAddress: serverAddress,
+		Topic:         topic,
+		Provider:      provider,
+	}
+	// an expiry of 0 is don't store it, same as apns-expiration
+	router.ApplyAPNSExpiration(&msg, int64(n.expiry), n.hasExpiry)
+
+	_, err = router.SendMessageToRouter(msg)
+
+	if err == nil {
+		return APNS_STATUS_NO_ERROR
+	}
+
+	switch router.ReasonOf(err) {
+	case router.ReasonMessageExpired, router.ReasonNotificationTypesOff: // APNS silently drops these
+		return APNS_STATUS_NO_ERROR
+	case router.ReasonBadRoutingKey, router.ReasonUnknownToken, router.ReasonTokenMarkedForRemoval, router.ReasonTokenInvalid:
+		return APNS_STATUS_INVALID_TOKEN
+	case router.ReasonTopicMismatch, router.ReasonProviderNotAllowed, router.ReasonUnauthorized:
+		return APNS_STATUS_INVALID_TOKEN // APNS had no better code for a token from another app
+	case router.ReasonBadRequest:
+		return APNS_STATUS_MISSING_TOPIC
+	case router.ReasonPayloadTooLarge:
+		return APNS_STATUS_INVALID_PAYLOAD_SIZE
+	default:
+		log.Printf("legacy apns send failed: %v\n", err)
+		return APNS_STATUS_PROCESSING_ERROR
+	}
+}
+
+func sendLegacyAPNSError(c net.Conn, status uint8, identifier uint32) {
+	payload := []byte{8, status}
+	addToPayload(&payload, identifier)
+
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(payload); err != nil {
+		log.Printf("Write error to %s: %v\n", c.RemoteAddr().String(), err)
+	}
+}
+
+func readUint16PrefixedBytes(r io.Reader) ([]byte, error) {
+	lenRaw := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenRaw); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(lenRaw))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func topicFromCertificate(cert *x509.Certificate) string {
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidUserId) {
+			if uid, ok := name.Value.(string); ok {
+				return uid
+			}
+		}
+	}
+	return ""
+}
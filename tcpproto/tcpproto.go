@@ -10,11 +10,17 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/Preloading/SkyglowNotificationServer/config"
+	db "github.com/Preloading/SkyglowNotificationServer/database"
 	"github.com/Preloading/SkyglowNotificationServer/router"
 )
 
+// how often a connected device has when it was last seen updated. It only has to be well under any retention
+// period, so a device that's just sitting there connected isn't counted as dormant.
+const seenInterval = 10 * time.Minute
+
 var (
 	keys       config.CryptoKeys
 	configData config.Config
@@ -138,3 +144,17 @@ func encryptWithPubKey(data []byte, key *rsa.PublicKey) (*[]byte, error) {
 
 	return &encrypted, nil
 }
+
+// seenDevice records that a device talked to us, but only goes to the database once every seenInterval.
+// lastSeen is the connection's own, and is updated when the database is.
+func seenDevice(deviceAddress string, lastSeen *time.Time) {
+	now := time.Now()
+	if now.Sub(*lastSeen) < seenInterval {
+		return
+	}
+	if err := db.TouchDevice(deviceAddress); err != nil {
+		log.Printf("failed to update when %s was last seen: %v\n", deviceAddress, err)
+		return
+	}
+	*lastSeen = now
+}
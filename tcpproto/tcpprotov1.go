@@ -3,7 +3,6 @@
 package tcpproto
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
@@ -12,11 +11,12 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"reflect"
 	"time"
 
 	db "github.com/Preloading/SkyglowNotificationServer/database"
+	"github.com/Preloading/SkyglowNotificationServer/discovery"
+	"github.com/Preloading/SkyglowNotificationServer/federation"
 	"github.com/Preloading/SkyglowNotificationServer/feedbackmgr"
 	"github.com/Preloading/SkyglowNotificationServer/router"
 	"howett.net/plist"
@@ -53,6 +53,7 @@ func handleV1Connection(c net.Conn, channel chan router.DataUpdate, startByte by
 	authenticationNonce := ""
 
 	isAuthenticated := false
+	var lastSeen time.Time // when we last recorded the device as seen
 	messageLen := make([]byte, 3)
 	firstPacket := true
 
@@ -173,10 +174,11 @@ func handleV1Connection(c net.Conn, channel chan router.DataUpdate, startByte by
 						if device.Language != userLang {
 							db.UpdateLanguage(device.DeviceAddress, userLang)
 						}
+						seenDevice(device.DeviceAddress, &lastSeen)
 
 						isAuthenticated = true
 						router.AddConnection(userAddress, channel)
-						defer router.RemoveConnection(userAddress)
+						defer router.RemoveConnection(userAddress, channel)
 						go func() {
 							for msg := range channel {
 								if msg.Disconnect {
@@ -211,6 +213,7 @@ func handleV1Connection(c net.Conn, channel chan router.DataUpdate, startByte by
 				}
 			} else {
 				// Authenticated requests
+				seenDevice(userAddress, &lastSeen)
 				switch typeVal {
 				case 2: // Poll Unacked Notifications
 					unackedNotifications, err := db.GetUnacknowledgedMessages(userAddress)
@@ -318,7 +321,7 @@ func handleV1Connection(c net.Conn, channel chan router.DataUpdate, startByte by
 								feedbackmgr.SaveFeedbackWhenProviderIsUs(int(typeOfFeedback), reasonForFeedback, routingToken, configData.ServerAddress)
 							} else {
 								type RelayFeedback struct {
-									DeviceTokenStr string `json:"device_token"`
+									DeviceTokenStr string `json:"routing_key"`
 									ServerAddress  string `json:"server_address"`
 									Type           int    `json:"type"`
 									Reason         string `json:"reason"`
@@ -337,22 +340,12 @@ func handleV1Connection(c net.Conn, channel chan router.DataUpdate, startByte by
 									return
 								}
 
-								txts, err := net.LookupTXT(fmt.Sprintf("_sgn.%s", *token.FeedbackProviderAddress))
+								serverData, err := discovery.Lookup(*token.FeedbackProviderAddress)
 								if err != nil {
 									continue
 								}
-								var serverData router.ServerTXT
-
-								found := false
-								for _, txt := range txts {
-									serverData, err = router.ParseServerTXT(txt)
-									if err == nil {
-										found = true
-										break
-									}
-								}
-								if found {
-									http.Post(fmt.Sprintf("%s/relay_feedback", serverData.HTTPAddress), "application/json", bytes.NewBuffer(setTokenFeedbackProviderJson))
+								if resp, err := federation.Post(*token.FeedbackProviderAddress, fmt.Sprintf("%s/relay_feedback", serverData.HTTPAddress), "application/json", setTokenFeedbackProviderJson); err == nil {
+									resp.Body.Close()
 								}
 							}
 						}
@@ -433,5 +426,6 @@ func sendNotificationToClientV1(c net.Conn, data router.DataToSend) error {
 	if err := sendMessageToClientV1(c, dataToSend, 2); err != nil {
 		return err
 	}
+	router.MarkMessageDelivered(data.MessageId)
 	return nil
 }
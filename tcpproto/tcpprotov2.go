@@ -56,12 +56,17 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 	isRegistering := false
 	loginPhase := 0
 	isAuthenticated := false
+	var lastSeen time.Time // when we last recorded the device as seen
 	reloadedTokens := []tokenUpdate{}
 
 	readNotifications := func() {
 		for msg := range channel {
 			if msg.Disconnect {
 				log.Printf("Disconnecting from %s\n", c.RemoteAddr().String())
+				if msg.Replaced {
+					disconnectClientV2(c, SERVER_DISCONNECT_REPLACED, 0)
+					c.Close()
+				}
 				return
 			}
 			log.Printf("[%s] Sending Message from channel\n", c.RemoteAddr().String())
@@ -147,6 +152,10 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 		}
 
 		// lastContactTimestamp = time.Now().Unix() // feed the dog
+		if isAuthenticated {
+			// pings count, a device can sit connected without ever polling or acking
+			seenDevice(userAddress, &lastSeen)
+		}
 		switch messageId {
 		// global protocol stuff
 		case 0x27: // ping
@@ -294,7 +303,7 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 			// start notification stream
 			go readNotifications()
 			router.AddConnection(userAddress, channel)
-			defer router.RemoveConnection(userAddress)
+			defer router.RemoveConnection(userAddress, channel)
 
 			payload := []byte{0x00, 0x00, 0x00, V2ProtocolVersion} // why
 			addToPayload(&payload, uint16(len(userAddress)))
@@ -337,6 +346,7 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 
 			// we passed :D
 			clientPubKey = device.PublicKey
+			seenDevice(device.DeviceAddress, &lastSeen)
 
 			isAuthenticated = true
 			loginPhase = 99999
@@ -344,7 +354,7 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 			// start notification stream
 			go readNotifications()
 			router.AddConnection(userAddress, channel)
-			defer router.RemoveConnection(userAddress)
+			defer router.RemoveConnection(userAddress, channel)
 
 			sendMessageToClientV2(c, nil, 0x12)
 
@@ -380,7 +390,8 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 						RoutingKey:    unackedNotification.RoutingKey,
 						MessageId:     unackedNotification.MessageId,
 
-						CreatedAt: unackedNotification.CreatedAt,
+						CreatedAt:  unackedNotification.CreatedAt,
+						Expiration: unixOrZero(unackedNotification.ExpiresAt),
 					})
 				} else {
 					sendNotificationToClientV2(c, router.DataToSend{
@@ -392,7 +403,8 @@ func handleV2Connection(c net.Conn, channel chan router.DataUpdate) {
 						RoutingKey:    unackedNotification.RoutingKey,
 						MessageId:     unackedNotification.MessageId,
 
-						CreatedAt: unackedNotification.CreatedAt,
+						CreatedAt:  unackedNotification.CreatedAt,
+						Expiration: unixOrZero(unackedNotification.ExpiresAt),
 					})
 				}
 			}
@@ -513,7 +525,7 @@ func (m *clientMessage) readUint32() uint32 {
 }
 
 func (m *clientMessage) readUint64() uint64 {
-	data := uint64(m.data[m.offset])<<56 | uint64(m.data[m.offset+1])<<48 | uint64(m.data[m.offset+2])<<40 | uint64(m.data[m.offset+3]<<32) | uint64(m.data[m.offset+4])<<24 | uint64(m.data[m.offset+5])<<16 | uint64(m.data[m.offset+6])<<8 | uint64(m.data[m.offset+7])
+	data := uint64(m.data[m.offset])<<56 | uint64(m.data[m.offset+1])<<48 | uint64(m.data[m.offset+2])<<40 | uint64(m.data[m.offset+3])<<32 | uint64(m.data[m.offset+4])<<24 | uint64(m.data[m.offset+5])<<16 | uint64(m.data[m.offset+6])<<8 | uint64(m.data[m.offset+7])
 	m.offset += 8
 	return data
 }
@@ -537,7 +549,7 @@ func (m *clientMessage) readInt32() int32 {
 }
 
 func (m *clientMessage) readInt64() int64 {
-	data := int64(m.data[m.offset])<<56 | int64(m.data[m.offset+1])<<48 | int64(m.data[m.offset+2])<<40 | int64(m.data[m.offset+3]<<32) | int64(m.data[m.offset+4])<<24 | int64(m.data[m.offset+5])<<16 | int64(m.data[m.offset+6])<<8 | int64(m.data[m.offset+7])
+	data := int64(m.data[m.offset])<<56 | int64(m.data[m.offset+1])<<48 | int64(m.data[m.offset+2])<<40 | int64(m.data[m.offset+3])<<32 | int64(m.data[m.offset+4])<<24 | int64(m.data[m.offset+5])<<16 | int64(m.data[m.offset+6])<<8 | int64(m.data[m.offset+7])
 	m.offset += 8
 	return data
 }
@@ -554,6 +566,13 @@ func (m *clientMessage) readBytesWithLen(len uint) []byte {
 	return data
 }
 
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
 func disconnectClientV2(c net.Conn, reason uint8, reconnectAfter uint32) {
 	payload := []byte{reason}
 	addToPayload(&payload, reconnectAfter)
@@ -638,7 +657,7 @@ func sendNotificationToClientV2(c net.Conn, data router.DataToSend) error {
 	}
 	addToPayload(&payload, uuidRaw)
 	addToPayload(&payload, data.CreatedAt)
-	addToPayload(&payload, uint64(0)) // expiration
+	addToPayload(&payload, uint64(data.Expiration)) // expiration
 	flags := byte(0x00)
 	if data.IsEncrypted {
 		flags |= (1 << 0) // set encryption byte at pos 0
@@ -672,5 +691,6 @@ func sendNotificationToClientV2(c net.Conn, data router.DataToSend) error {
 	if err := sendMessageToClientV2(c, payload, 0x13); err != nil {
 		return err
 	}
+	router.MarkMessageDelivered(data.MessageId)
 	return nil
 }